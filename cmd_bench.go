@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mqtt-go/src/client"
+	"mqtt-go/src/server"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const benchUsage = `用法:
+  mqtt-go bench [-addr <地址>] [-clients 100] [-subs 1] [-qos 1] [-size 256] [-rate 10] [-duration 10s]
+
+未指定 -addr 时在进程内启动 broker. 发布方 i 向 -topic 中 {i} 替换为 i 的主题发布,
+每个订阅方订阅全部发布主题, 载荷前 8 字节为发送时间, 用于计算端到端延迟`
+
+// 压测参数
+type benchConfig struct {
+	addr     string
+	username string
+	password string
+
+	clients     int
+	subs        int
+	connectRate float64
+
+	topic    string
+	qos      int
+	size     int
+	rate     float64
+	count    int
+	duration time.Duration
+	inflight int
+	drain    time.Duration
+
+	// 等待发布确认的超时时间, 超时计为发布失败
+	ackTimeout time.Duration
+}
+
+// 压测统计
+type benchStats struct {
+	connectErrors   int64
+	subscribeErrors int64
+	publishErrors   int64
+	publishTimeouts int64
+	connectionLost  int64
+
+	published int64
+	acked     int64
+	received  int64
+
+	// 保护以下字段
+	lock      sync.Mutex
+	connects  []time.Duration
+	latencies []time.Duration
+	firstPub  time.Time
+	lastPub   time.Time
+	lastRecv  time.Time
+}
+
+// 负载生成及压测, 报告吞吐量、端到端延迟、连接延迟及错误数
+func benchMain(args []string) {
+	c := &benchConfig{}
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), benchUsage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&c.addr, "addr", "", "broker 地址, 如 tcp://127.0.0.1:1883, 为空则在进程内启动 broker")
+	fs.StringVar(&c.username, "username", "", "用户名")
+	fs.StringVar(&c.password, "password", "", "密码")
+	fs.IntVar(&c.clients, "clients", 100, "发布方数量")
+	fs.IntVar(&c.subs, "subs", 1, "订阅方数量, 每个订阅方订阅全部发布主题")
+	fs.Float64Var(&c.connectRate, "connect-rate", 0, "每秒新建连接数, 0 为不限制")
+	fs.StringVar(&c.topic, "topic", "bench/{i}", "发布主题, {i} 替换为发布方序号; 不含 {i} 时全部发布方共用一个主题")
+	fs.IntVar(&c.qos, "qos", 1, "发布及订阅 Qos")
+	fs.IntVar(&c.size, "size", 256, "载荷字节数, 至少 8")
+	fs.Float64Var(&c.rate, "rate", 10, "单个发布方每秒发布消息数, 0 为不限制")
+	fs.IntVar(&c.count, "count", 0, "单个发布方发布消息数, 0 为不限制, 以 -duration 结束")
+	fs.DurationVar(&c.duration, "duration", 10*time.Second, "发布时长")
+	fs.IntVar(&c.inflight, "inflight", 16, "单个发布方未确认的 qos1/qos2 消息数上限")
+	fs.DurationVar(&c.drain, "drain", 2*time.Second, "发布结束后等待投递完成的时长")
+	fs.DurationVar(&c.ackTimeout, "ack-timeout", 10*time.Second, "等待 qos1/qos2 发布确认的超时时间, 超时计为发布失败")
+	fs.Parse(args)
+
+	if c.clients < 1 || c.subs < 0 || c.qos < 0 || c.qos > 2 || c.inflight < 1 {
+		fs.Usage()
+		log.Fatal("参数非法")
+	}
+	if c.size < 8 {
+		c.size = 8
+	}
+
+	// 进程内 broker, 不输出 broker 日志
+	if c.addr == "" {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.SetOutput(ioutil.Discard)
+		go server.Serve(l)
+		c.addr = l.Addr().String()
+	}
+
+	stats := runBench(c)
+	stats.report(c)
+}
+
+// 发布方 i 的主题
+func (this *benchConfig) topicOf(i int) string {
+	return strings.ReplaceAll(this.topic, "{i}", strconv.Itoa(i))
+}
+
+// 全部发布主题, 不含 {i} 时仅一个
+func (this *benchConfig) topics() []string {
+	if !strings.Contains(this.topic, "{i}") {
+		return []string{this.topic}
+	}
+	topics := make([]string, 0, this.clients)
+	for i := 0; i < this.clients; i++ {
+		topics = append(topics, this.topicOf(i))
+	}
+	return topics
+}
+
+func (this *benchConfig) options(clientId string, stats *benchStats) *client.Options {
+	opts := client.NewOptions(this.addr, clientId)
+	opts.Username, opts.Password = this.username, this.password
+	opts.AutoReconnect = false
+	opts.OnConnectionLost = func(c *client.Client, err error) {
+		atomic.AddInt64(&stats.connectionLost, 1)
+	}
+	return opts
+}
+
+// 按 -connect-rate 建立连接, 失败返回 nil
+func (this *benchConfig) connect(opts *client.Options, stats *benchStats, pace <-chan time.Time) *client.Client {
+	if pace != nil {
+		<-pace
+	}
+
+	c := client.New(opts)
+	start := time.Now()
+	if err := c.Connect(); err != nil {
+		atomic.AddInt64(&stats.connectErrors, 1)
+		return nil
+	}
+	stats.lock.Lock()
+	stats.connects = append(stats.connects, time.Since(start))
+	stats.lock.Unlock()
+	return c
+}
+
+func runBench(c *benchConfig) *benchStats {
+	stats := &benchStats{}
+
+	var pace <-chan time.Time
+	if c.connectRate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / c.connectRate))
+		defer ticker.Stop()
+		pace = ticker.C
+	}
+
+	// 订阅方先于发布方建立连接
+	topics := c.topics()
+	subs := make([]*client.Client, c.subs)
+	var wg sync.WaitGroup
+	for i := range subs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sub := c.connect(c.options(fmt.Sprintf("bench-sub-%d", i), stats), stats, pace)
+			if sub == nil {
+				return
+			}
+			for _, topic := range topics {
+				if err := sub.Subscribe(topic, byte(c.qos), stats.onMessage).WaitTimeout(10 * time.Second); err != nil {
+					atomic.AddInt64(&stats.subscribeErrors, 1)
+				}
+			}
+			subs[i] = sub
+		}(i)
+	}
+	wg.Wait()
+
+	pubs := make([]*client.Client, c.clients)
+	for i := range pubs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			pubs[i] = c.connect(c.options(fmt.Sprintf("bench-pub-%d", i), stats), stats, pace)
+		}(i)
+	}
+	wg.Wait()
+
+	// 全部连接建立后开始发布
+	deadline := time.Now().Add(c.duration)
+	for i, pub := range pubs {
+		if pub == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, pub *client.Client) {
+			defer wg.Done()
+			c.publish(pub, c.topicOf(i), deadline, stats)
+		}(i, pub)
+	}
+	wg.Wait()
+
+	// 等待投递完成
+	expected := atomic.LoadInt64(&stats.published) * int64(c.subs)
+	for end := time.Now().Add(c.drain); time.Now().Before(end) && atomic.LoadInt64(&stats.received) < expected; {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, cc := range append(pubs, subs...) {
+		if cc != nil {
+			cc.Disconnect()
+		}
+	}
+	return stats
+}
+
+// 单个发布方按速率发布, 未确认的消息数达到 -inflight 时等待
+func (this *benchConfig) publish(pub *client.Client, topic string, deadline time.Time, stats *benchStats) {
+	var tick <-chan time.Time
+	if this.rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / this.rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	// 按发布顺序等待确认
+	tokens := make(chan *client.Token, this.inflight)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for token := range tokens {
+			if err := token.WaitTimeout(this.ackTimeout); err == client.ErrTimeout {
+				atomic.AddInt64(&stats.publishErrors, 1)
+				atomic.AddInt64(&stats.publishTimeouts, 1)
+			} else if err != nil {
+				atomic.AddInt64(&stats.publishErrors, 1)
+			} else {
+				atomic.AddInt64(&stats.acked, 1)
+			}
+		}
+	}()
+
+	payload := make([]byte, this.size)
+	for i := 8; i < len(payload); i++ {
+		payload[i] = 'x'
+	}
+	for n := 0; (this.count == 0 || n < this.count) && time.Now().Before(deadline); n++ {
+		if tick != nil {
+			<-tick
+		}
+
+		now := time.Now()
+		binary.BigEndian.PutUint64(payload, uint64(now.UnixNano()))
+		tokens <- pub.Publish(topic, byte(this.qos), false, payload)
+		atomic.AddInt64(&stats.published, 1)
+		stats.lock.Lock()
+		if stats.firstPub.IsZero() {
+			stats.firstPub = now
+		}
+		if now.After(stats.lastPub) {
+			stats.lastPub = now
+		}
+		stats.lock.Unlock()
+	}
+	close(tokens)
+	<-done
+}
+
+// 订阅方收到消息, 以载荷中的发送时间计算端到端延迟
+func (this *benchStats) onMessage(c *client.Client, msg *client.Message) {
+	now := time.Now()
+	atomic.AddInt64(&this.received, 1)
+	if len(msg.Payload) < 8 {
+		return
+	}
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(msg.Payload)))
+
+	this.lock.Lock()
+	this.latencies = append(this.latencies, now.Sub(sent))
+	this.lastRecv = now
+	this.lock.Unlock()
+}
+
+// 输出压测结果
+func (this *benchStats) report(c *benchConfig) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	fmt.Printf("broker: %s, 发布方: %d, 订阅方: %d, qos: %d, 载荷: %d 字节\n", c.addr, c.clients, c.subs, c.qos, c.size)
+	fmt.Printf("连接: 成功 %d, 失败 %d, 断开 %d\n", len(this.connects), this.connectErrors, this.connectionLost)
+	fmt.Printf("连接延迟: %s\n", percentiles(this.connects))
+
+	elapsed := this.lastPub.Sub(this.firstPub)
+	fmt.Printf("发布: %d 条, 确认 %d, 失败 %d (超时 %d), 吞吐量 %s\n", this.published, this.acked, this.publishErrors, this.publishTimeouts, throughput(this.published, elapsed))
+
+	expected := this.published * int64(c.subs)
+	elapsed = this.lastRecv.Sub(this.firstPub)
+	fmt.Printf("接收: %d/%d 条, 订阅失败 %d, 吞吐量 %s\n", this.received, expected, this.subscribeErrors, throughput(this.received, elapsed))
+	fmt.Printf("端到端延迟: %s\n", percentiles(this.latencies))
+}
+
+// 每秒消息数
+func throughput(n int64, elapsed time.Duration) string {
+	if elapsed <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.0f msg/s", float64(n)/elapsed.Seconds())
+}
+
+// 延迟分位数
+func percentiles(ds []time.Duration) string {
+	if len(ds) == 0 {
+		return "-"
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	at := func(p float64) time.Duration {
+		return ds[int(p*float64(len(ds)-1))]
+	}
+	return fmt.Sprintf("p50 %v, p90 %v, p99 %v, max %v", at(0.5), at(0.9), at(0.99), ds[len(ds)-1])
+}
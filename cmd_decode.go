@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mqtt-go/src/codec"
+	"mqtt-go/src/message"
+	"mqtt-go/src/pcap"
+	"mqtt-go/src/utils"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const decodeUsage = `用法:
+  mqtt-go decode -hex <数据|->
+  mqtt-go decode -base64 <数据|->
+  mqtt-go decode -raw <文件|->
+  mqtt-go decode -pcap <文件> [-port 1883]
+
+- 表示从标准输入读取. hex 数据可包含空白、冒号及 0x 前缀, 如 wireshark/tcpdump -X 的复制结果.
+报文违反规范时标记违反的条目并跳过该报文, 继续解码`
+
+// 报文检查器参数
+type decodeConfig struct {
+	// 载荷预览字节数
+	preview int
+
+	// 输出每个报文的十六进制转储
+	dump bool
+}
+
+// 解码 hex/base64/原始字节或 pcap 抓包中的 MQTT 报文并逐个输出
+func decodeMain(args []string) {
+	c := &decodeConfig{}
+	fs := flag.NewFlagSet("decode", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), decodeUsage)
+		fs.PrintDefaults()
+	}
+	hexData := fs.String("hex", "", "hex 数据, - 为标准输入")
+	base64Data := fs.String("base64", "", "base64 数据, - 为标准输入")
+	rawFile := fs.String("raw", "", "原始字节文件, - 为标准输入")
+	pcapFile := fs.String("pcap", "", "pcap 抓包文件")
+	port := fs.Int("port", 1883, "pcap 中 broker 的 TCP 端口, 0 为全部 TCP 连接")
+	fs.IntVar(&c.preview, "preview", 64, "载荷预览字节数")
+	fs.BoolVar(&c.dump, "dump", false, "输出每个报文的十六进制转储")
+	limits := fs.Bool("limits", false, "按 broker 默认的解码限制(报文大小、主题长度等)校验")
+	fs.Parse(args)
+
+	// 检查器默认只校验规范, 不受 broker 配置的限制约束
+	if !*limits {
+		codec.DecodeLimits = codec.Limits{}
+	}
+
+	set := 0
+	for _, v := range []string{*hexData, *base64Data, *rawFile, *pcapFile} {
+		if v != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		fs.Usage()
+		log.Fatal("须指定 -hex, -base64, -raw, -pcap 之一")
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+
+	if *pcapFile != "" {
+		if err := decodePcap(w, c, *pcapFile, uint16(*port)); err != nil {
+			w.Flush()
+			log.Fatal(err)
+		}
+		return
+	}
+
+	var data []byte
+	var err error
+	switch {
+	case *hexData != "":
+		data, err = parseHex(readArg(*hexData))
+	case *base64Data != "":
+		data, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(readArg(*base64Data)), ""))
+	default:
+		data, err = readFile(*rawFile)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s := &decodeStream{config: c}
+	s.feed(w, data, time.Time{})
+	s.finish(w)
+}
+
+// 参数为 - 时读取标准输入
+func readArg(v string) string {
+	if v != "-" {
+		return v
+	}
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return string(data)
+}
+
+func readFile(name string) ([]byte, error) {
+	if name == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(name)
+}
+
+// 解析 hex, 忽略空白、冒号、逗号及 0x 前缀
+func parseHex(s string) ([]byte, error) {
+	s = strings.NewReplacer("0x", "", "0X", "", ":", "", ",", "").Replace(s)
+	s = strings.Join(strings.Fields(s), "")
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("非法的 hex 数据: %v", err))
+	}
+	return data, nil
+}
+
+// 解码 pcap 中指定端口的 TCP 连接, 按抓包顺序输出两个方向的报文
+func decodePcap(w io.Writer, c *decodeConfig, name string, port uint16) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r, err := pcap.NewReader(bufio.NewReader(file))
+	if err != nil {
+		return err
+	}
+	assembler := pcap.NewAssembler()
+	streams := make(map[string]*decodeStream)
+	for {
+		seg, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var direction string
+		switch {
+		case port == 0:
+		case seg.Dst.Port == port:
+			direction = "客户端 -> 服务端"
+		case seg.Src.Port == port:
+			direction = "服务端 -> 客户端"
+		default:
+			continue
+		}
+
+		key := pcap.Key(seg.Src, seg.Dst)
+		s := streams[key]
+		if s == nil {
+			s = &decodeStream{config: c, label: key}
+			if direction != "" {
+				s.label += " (" + direction + ")"
+			}
+			streams[key] = s
+		}
+
+		data, gap := assembler.Add(seg)
+		if gap {
+			fmt.Fprintf(w, "!! %s 抓包数据缺失, 丢弃未解码的 %d 字节\n\n", s.label, len(s.buf))
+			s.buf = s.buf[:0]
+		}
+		s.feed(w, data, seg.Time)
+
+		if seg.FIN || seg.RST {
+			s.finish(w)
+			delete(streams, key)
+		}
+	}
+
+	for _, s := range streams {
+		s.finish(w)
+	}
+	return nil
+}
+
+// 单个方向的字节流, 缓存不完整的报文
+type decodeStream struct {
+	config *decodeConfig
+
+	// 数据流描述, 非 pcap 输入时为空
+	label string
+
+	buf []byte
+
+	// 已解码的报文数
+	count int
+
+	// 无法定界, 不再解码
+	broken bool
+}
+
+// 追加数据并输出其中完整的报文
+func (this *decodeStream) feed(w io.Writer, data []byte, at time.Time) {
+	if this.broken {
+		return
+	}
+	this.buf = append(this.buf, data...)
+
+	for len(this.buf) > 0 {
+		msg, left, err := codec.Decode(this.buf)
+		if err == nil && msg == nil {
+			return
+		}
+
+		this.count++
+		n := len(this.buf) - len(left)
+		if err != nil {
+			// 报文可定界时跳过该报文继续解码
+			if n = frameLen(this.buf); n < 0 {
+				this.header(w, at)
+				fmt.Fprintf(w, "#%d 无法定界: %v\n", this.count, err)
+				fmt.Fprintf(w, "  丢弃剩余 %d 字节: %s\n\n", len(this.buf), preview(this.buf, this.config.preview))
+				this.buf, this.broken = nil, true
+				return
+			}
+			if n > len(this.buf) {
+				this.count--
+				return
+			}
+		}
+
+		this.header(w, at)
+		this.print(w, msg, err, this.buf[:n])
+		this.buf = this.buf[n:]
+	}
+}
+
+// 输出末尾不完整的数据
+func (this *decodeStream) finish(w io.Writer) {
+	if len(this.buf) == 0 || this.broken {
+		return
+	}
+	if this.label != "" {
+		fmt.Fprintf(w, "%s\n", this.label)
+	}
+	fmt.Fprintf(w, "!! 末尾不完整的报文 %d 字节: %s\n\n", len(this.buf), preview(this.buf, this.config.preview))
+	this.buf = nil
+}
+
+func (this *decodeStream) header(w io.Writer, at time.Time) {
+	if this.label == "" {
+		return
+	}
+	fmt.Fprintf(w, "%s %s\n", at.Format("2006-01-02 15:04:05.000000"), this.label)
+}
+
+// 完整报文的长度, remaining length 非法时返回 -1
+func frameLen(buf []byte) int {
+	remainingLen, digits, err := utils.DecodeRemainLength(buf[1:])
+	if err != nil {
+		return -1
+	}
+	if digits == 0 {
+		return len(buf) + 1
+	}
+	return 1 + digits + remainingLen
+}
+
+// 输出单个报文, err 非空时标记违反的规范条目
+func (this *decodeStream) print(w io.Writer, msg *message.MqttMessage, err error, raw []byte) {
+	packetType, flags := raw[0]>>4, raw[0]&0x0f
+	fmt.Fprintf(w, "#%d %s 固定头: 0x%02x 标志: %04b 长度: %d 字节\n", this.count, message.TypeName(packetType), raw[0], flags, len(raw))
+
+	if err != nil {
+		if protocolErr, ok := err.(*message.ProtocolError); ok && protocolErr.Ref != "" {
+			fmt.Fprintf(w, "  !! 违反规范 [%s]: %s\n", protocolErr.Ref, protocolErr.Reason)
+		} else {
+			fmt.Fprintf(w, "  !! 非法报文: %v\n", err)
+		}
+		fmt.Fprintf(w, "  原始字节: %s\n", preview(raw, this.config.preview))
+	} else {
+		describe(w, msg, this.config.preview)
+	}
+
+	if this.config.dump {
+		for _, line := range strings.Split(strings.TrimRight(hex.Dump(raw), "\n"), "\n") {
+			fmt.Fprintf(w, "  %s\n", line)
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+// CONNACK 返回码
+var connAckReasons = map[byte]string{
+	0: "接受连接",
+	1: "不支持的协议版本",
+	2: "clientId 不合格",
+	3: "服务端不可用",
+	4: "用户名或密码错误",
+	5: "未授权",
+}
+
+// 输出报文各字段. MQTT 3.1.1 报文不含属性(properties), 无需输出
+func describe(w io.Writer, msg *message.MqttMessage, n int) {
+	fixed := msg.FixedHeader
+	if fixed.MessageType == message.PUBLISH {
+		fmt.Fprintf(w, "  dup: %v qos: %d retain: %v\n", fixed.Dup, fixed.Qos, fixed.Retain)
+	}
+
+	switch header := msg.VariableHeader.(type) {
+	case *message.MqttConnVariableHeader:
+		fmt.Fprintf(w, "  可变头: 协议 MQTT 3.1.1, cleanSession: %v, keepAlive: %v\n", header.CleanSession, header.KeepAlive)
+		fmt.Fprintf(w, "  标志: will: %v willQos: %d willRetain: %v username: %v password: %v\n",
+			header.WillFlag, header.WillQos, header.WillRetain, header.UsernameFlag, header.PasswordFlag)
+	case *message.MqttConnAckVariableHeader:
+		fmt.Fprintf(w, "  可变头: sessionPresent: %v 返回码: %d (%s)\n", header.SessionPresent, header.Code, connAckReason(header.Code))
+	case *message.MqttPublishVaribleHeader:
+		if fixed.Qos > 0 {
+			fmt.Fprintf(w, "  可变头: topic: %q packetId: %d\n", header.TopicName, header.MessageId)
+		} else {
+			fmt.Fprintf(w, "  可变头: topic: %q\n", header.TopicName)
+		}
+	case *message.MqttMessageIdVariableHeader:
+		fmt.Fprintf(w, "  可变头: packetId: %d\n", header.MessageId)
+	}
+
+	switch payload := msg.Payload.(type) {
+	case *message.MqttConnPayload:
+		fmt.Fprintf(w, "  载荷: clientId: %q\n", payload.ClientId)
+		header := msg.VariableHeader.(*message.MqttConnVariableHeader)
+		if header.WillFlag {
+			fmt.Fprintf(w, "  遗嘱: topic: %q 消息: %s\n", payload.WillTopic, preview(payload.WillMessage, n))
+		}
+		if header.UsernameFlag {
+			fmt.Fprintf(w, "  username: %q\n", payload.Username)
+		}
+		if header.PasswordFlag {
+			fmt.Fprintf(w, "  password: %d 字节\n", len(payload.Password))
+		}
+	case *message.MqttSubscribePayload:
+		for _, topic := range payload.Topics {
+			fmt.Fprintf(w, "  订阅: %q qos: %d\n", topic.Name, topic.Qos)
+		}
+	case []string:
+		for _, topic := range payload {
+			fmt.Fprintf(w, "  取消订阅: %q\n", topic)
+		}
+	case []byte:
+		if fixed.MessageType == message.SUBACK {
+			fmt.Fprintf(w, "  返回码: % x\n", payload)
+		} else {
+			fmt.Fprintf(w, "  载荷: %d 字节 %s\n", len(payload), preview(payload, n))
+		}
+	}
+}
+
+func connAckReason(code byte) string {
+	if reason, ok := connAckReasons[code]; ok {
+		return reason
+	}
+	return "保留"
+}
+
+// 载荷预览, 可打印的 UTF-8 文本加引号输出, 否则输出 hex; 超过 n 字节时截断
+func preview(data []byte, n int) string {
+	if len(data) == 0 {
+		return "(空)"
+	}
+	suffix := ""
+	if len(data) > n {
+		data, suffix = data[:n], fmt.Sprintf("... (共 %d 字节)", len(data))
+	}
+
+	// 截断可能切开多字节字符, 去掉末尾不完整的字符
+	text := data
+	for len(text) > 0 && !utf8.Valid(text) && len(data)-len(text) < utf8.UTFMax {
+		text = text[:len(text)-1]
+	}
+	if len(text) > 0 && utf8.Valid(text) && printable(string(text)) {
+		return fmt.Sprintf("%q%s", text, suffix)
+	}
+	return hex.EncodeToString(data) + suffix
+}
+
+func printable(s string) bool {
+	for _, r := range s {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mqtt-go/src/client"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+const pubUsage = `用法:
+  mqtt-go pub -t <主题> [-m <消息>] [-f <文件>] [-l] [消息...]
+
+载荷依次取自 -m, 位置参数(每个参数一条消息), -f 文件(整个文件一条消息), -l 标准输入(每行一条消息)`
+
+const subUsage = `用法:
+  mqtt-go sub -t <主题> [-t <主题>...] [-format raw|hex|json|<模板>]
+
+-format 为模板时使用 text/template, 可用字段: .Time .Topic .Qos .Retain .Dup .Payload .Hex, 如:
+  mqtt-go sub -t a/b -format '{{.Time}} {{.Topic}} {{.Payload}}'`
+
+// 可重复指定的字符串参数
+type stringsFlag []string
+
+func (this *stringsFlag) String() string {
+	return strings.Join(*this, ",")
+}
+
+func (this *stringsFlag) Set(v string) error {
+	*this = append(*this, v)
+	return nil
+}
+
+// pub 及 sub 共用的连接参数
+type connFlags struct {
+	host     string
+	port     int
+	tls      bool
+	caFile   string
+	insecure bool
+
+	username  string
+	password  string
+	clientId  string
+	clean     bool
+	keepAlive time.Duration
+
+	// 等待发布确认及订阅响应的超时时间
+	timeout time.Duration
+
+	willTopic   string
+	willPayload string
+	willQos     int
+	willRetain  bool
+}
+
+func (this *connFlags) register(fs *flag.FlagSet, prefix string) {
+	fs.StringVar(&this.host, "host", "127.0.0.1", "broker 地址")
+	fs.IntVar(&this.port, "port", 0, "broker 端口, 0 为 1883, 启用 tls 时为 8883")
+	fs.BoolVar(&this.tls, "tls", false, "使用 tls 连接")
+	fs.StringVar(&this.caFile, "cafile", "", "校验服务端证书的 CA 证书文件(PEM), 为空则使用系统证书")
+	fs.BoolVar(&this.insecure, "insecure", false, "不校验服务端证书")
+	fs.StringVar(&this.username, "u", "", "用户名")
+	fs.StringVar(&this.password, "P", "", "密码")
+	fs.StringVar(&this.clientId, "i", fmt.Sprintf("%s-%d", prefix, os.Getpid()), "clientId")
+	fs.BoolVar(&this.clean, "clean", true, "清理会话, 为 false 时服务端保留会话")
+	fs.DurationVar(&this.keepAlive, "k", time.Minute, "心跳周期, 0 为不发送心跳")
+	fs.DurationVar(&this.timeout, "timeout", 10*time.Second, "等待发布确认及订阅响应的超时时间")
+	fs.StringVar(&this.willTopic, "will-topic", "", "遗嘱主题, 为空则不设置遗嘱")
+	fs.StringVar(&this.willPayload, "will-payload", "", "遗嘱消息")
+	fs.IntVar(&this.willQos, "will-qos", 0, "遗嘱 Qos")
+	fs.BoolVar(&this.willRetain, "will-retain", false, "遗嘱作为保留消息发布")
+}
+
+// 由参数构建连接选项
+func (this *connFlags) options() (*client.Options, error) {
+	scheme, port := "tcp", this.port
+	if this.tls {
+		scheme = "tls"
+	}
+	if port == 0 {
+		port = 1883
+		if this.tls {
+			port = 8883
+		}
+	}
+
+	opts := client.NewOptions(fmt.Sprintf("%s://%s", scheme, this.hostPort(port)), this.clientId)
+	opts.Username, opts.Password = this.username, this.password
+	opts.CleanSession = this.clean
+	opts.KeepAlive = this.keepAlive
+
+	if this.tls {
+		config := &tls.Config{ServerName: this.host, InsecureSkipVerify: this.insecure}
+		if this.caFile != "" {
+			pem, err := ioutil.ReadFile(this.caFile)
+			if err != nil {
+				return nil, err
+			}
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, errors.New(fmt.Sprintf("CA 证书文件中无有效证书: %s", this.caFile))
+			}
+		}
+		opts.TLSConfig = config
+	}
+
+	if this.willTopic != "" {
+		if this.willQos < 0 || this.willQos > 2 {
+			return nil, errors.New(fmt.Sprintf("非法的遗嘱 Qos:%d", this.willQos))
+		}
+		opts.Will = &client.Will{
+			Topic:   this.willTopic,
+			Payload: []byte(this.willPayload),
+			Qos:     byte(this.willQos),
+			Retain:  this.willRetain,
+		}
+	}
+	return opts, nil
+}
+
+// host:port, 支持 IPv6 地址
+func (this *connFlags) hostPort(port int) string {
+	if strings.Contains(this.host, ":") {
+		return fmt.Sprintf("[%s]:%d", this.host, port)
+	}
+	return this.host + ":" + strconv.Itoa(port)
+}
+
+// 发布消息, 每条消息等待确认后再发布下一条
+func pubMain(args []string) {
+	var c connFlags
+	fs := flag.NewFlagSet("pub", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), pubUsage)
+		fs.PrintDefaults()
+	}
+	c.register(fs, "mqtt-go-pub")
+	topic := fs.String("t", "", "发布主题")
+	qos := fs.Int("q", 0, "发布 Qos")
+	retain := fs.Bool("r", false, "作为保留消息发布")
+	msg := fs.String("m", "", "消息")
+	file := fs.String("f", "", "以文件内容作为一条消息")
+	lines := fs.Bool("l", false, "从标准输入读取消息, 每行一条")
+	fs.Parse(args)
+
+	if *topic == "" {
+		fs.Usage()
+		log.Fatal("必须指定 -t")
+	}
+	if *qos < 0 || *qos > 2 {
+		log.Fatalf("非法的 Qos:%d\n", *qos)
+	}
+	if !flagSet(fs, "m") && fs.NArg() == 0 && *file == "" && !*lines {
+		fs.Usage()
+		log.Fatal("未指定消息")
+	}
+
+	opts, err := c.options()
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts.AutoReconnect = false
+	cli := client.New(opts)
+	if err := cli.Connect(); err != nil {
+		log.Fatal(err)
+	}
+	defer cli.Disconnect()
+
+	publish := func(payload []byte) {
+		if err := cli.Publish(*topic, byte(*qos), *retain, payload).WaitTimeout(c.timeout); err != nil {
+			cli.Disconnect()
+			log.Fatalf("发布失败: %v\n", err)
+		}
+	}
+
+	if flagSet(fs, "m") {
+		publish([]byte(*msg))
+	}
+	for _, arg := range fs.Args() {
+		publish([]byte(arg))
+	}
+	if *file != "" {
+		payload, err := ioutil.ReadFile(*file)
+		if err != nil {
+			cli.Disconnect()
+			log.Fatal(err)
+		}
+		publish(payload)
+	}
+	if *lines {
+		scanner := bufio.NewScanner(os.Stdin)
+		scanner.Buffer(make([]byte, 64*1024), 256*1024*1024)
+		for scanner.Scan() {
+			publish(scanner.Bytes())
+		}
+		if err := scanner.Err(); err != nil {
+			cli.Disconnect()
+			log.Fatal(err)
+		}
+	}
+}
+
+// 是否在命令行中指定了参数
+func flagSet(fs *flag.FlagSet, name string) bool {
+	found := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			found = true
+		}
+	})
+	return found
+}
+
+// 订阅并按格式输出收到的消息, 收到 SIGINT/SIGTERM 或达到 -count 后退出
+func subMain(args []string) {
+	var c connFlags
+	var topics stringsFlag
+	fs := flag.NewFlagSet("sub", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), subUsage)
+		fs.PrintDefaults()
+	}
+	c.register(fs, "mqtt-go-sub")
+	fs.Var(&topics, "t", "订阅主题, 可指定多次")
+	qos := fs.Int("q", 0, "订阅 Qos")
+	format := fs.String("format", "raw", "输出格式: raw/hex/json, 或 text/template 模板")
+	timeFormat := fs.String("time-format", time.RFC3339Nano, "模板及 json 中时间的格式")
+	count := fs.Int("count", 0, "收到指定条数的消息后退出, 0 为不限制")
+	fs.Parse(args)
+
+	if len(topics) == 0 {
+		fs.Usage()
+		log.Fatal("必须指定 -t")
+	}
+	if *qos < 0 || *qos > 2 {
+		log.Fatalf("非法的 Qos:%d\n", *qos)
+	}
+	printer, err := newPrinter(os.Stdout, *format, *timeFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	opts, err := c.options()
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts.OnConnectionLost = func(cli *client.Client, err error) {
+		log.Printf("连接断开: %v, 重连中\n", err)
+	}
+
+	done := make(chan struct{})
+	received := 0
+	handler := func(cli *client.Client, msg *client.Message) {
+		if err := printer(msg); err != nil {
+			log.Printf("输出失败: %v\n", err)
+		}
+		received++
+		if received == *count {
+			close(done)
+		}
+	}
+
+	cli := client.New(opts)
+	if err := cli.Connect(); err != nil {
+		log.Fatal(err)
+	}
+	defer cli.Disconnect()
+	for _, topic := range topics {
+		token := cli.Subscribe(topic, byte(*qos), handler)
+		if err := token.WaitTimeout(c.timeout); err != nil {
+			cli.Disconnect()
+			log.Fatalf("订阅 %s 失败: %v\n", topic, err)
+		}
+		if granted := token.Granted(); len(granted) == 1 && granted[0] == 0x80 {
+			cli.Disconnect()
+			log.Fatalf("订阅 %s 被拒绝\n", topic)
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case <-signals:
+	case <-done:
+	}
+}
+
+// 消息输出格式
+type printedMessage struct {
+	Time    string `json:"time"`
+	Topic   string `json:"topic"`
+	Qos     byte   `json:"qos"`
+	Retain  bool   `json:"retain"`
+	Dup     bool   `json:"dup,omitempty"`
+	Payload string `json:"payload"`
+
+	// 载荷的十六进制表示, json 中仅在载荷不是合法 UTF-8 时输出, 此时 Payload 为空
+	Hex string `json:"hex,omitempty"`
+}
+
+// 按格式构建消息输出函数
+func newPrinter(w io.Writer, format string, timeFormat string) (func(msg *client.Message) error, error) {
+	switch format {
+	case "raw":
+		return func(msg *client.Message) error {
+			if _, err := w.Write(msg.Payload); err != nil {
+				return err
+			}
+			_, err := io.WriteString(w, "\n")
+			return err
+		}, nil
+	case "hex":
+		return func(msg *client.Message) error {
+			_, err := fmt.Fprintln(w, hex.EncodeToString(msg.Payload))
+			return err
+		}, nil
+	case "json":
+		encoder := json.NewEncoder(w)
+		return func(msg *client.Message) error {
+			m := printed(msg, timeFormat)
+			if !utf8.Valid(msg.Payload) {
+				m.Payload = ""
+			} else {
+				m.Hex = ""
+			}
+			return encoder.Encode(m)
+		}, nil
+	}
+
+	if !strings.HasSuffix(format, "\n") {
+		format += "\n"
+	}
+	tmpl, err := template.New("format").Parse(format)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("非法的输出格式: %v", err))
+	}
+	return func(msg *client.Message) error {
+		return tmpl.Execute(w, printed(msg, timeFormat))
+	}, nil
+}
+
+func printed(msg *client.Message, timeFormat string) *printedMessage {
+	return &printedMessage{
+		Time:    time.Now().Format(timeFormat),
+		Topic:   msg.Topic,
+		Qos:     msg.Qos,
+		Retain:  msg.Retain,
+		Dup:     msg.Dup,
+		Payload: string(msg.Payload),
+		Hex:     hex.EncodeToString(msg.Payload),
+	}
+}
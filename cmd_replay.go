@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mqtt-go/src/codec"
+	"mqtt-go/src/message"
+	"mqtt-go/src/record"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const replayUsage = `用法:
+  mqtt-go replay [-addr host:port] [-speed 1] [-wait 1s] <录制文件>
+
+按录制的时间间隔将客户端发出的报文重新发往 broker, 与录制时 broker 的响应逐个比对.
+录制文件由 broker 的 -record-dir 及 -record-clients/-record-ips 参数生成. 存在差异时退出码为 1`
+
+// 回放时收到的报文
+type replayed struct {
+	offset time.Duration
+	data   []byte
+}
+
+// 回放录制文件并比对 broker 的响应
+func replayMain(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), replayUsage)
+		fs.PrintDefaults()
+	}
+	addr := fs.String("addr", "127.0.0.1:1883", "broker 地址")
+	speed := fs.Float64("speed", 1, "回放倍速, 2 为两倍速, 0 为不等待直接发送")
+	wait := fs.Duration("wait", time.Second, "发送完毕后等待响应的时长, 期间无新报文即结束")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || *speed < 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	entries, err := record.Read(bufio.NewReader(file))
+	file.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	fmt.Fprintf(w, "回放 %s, 录制于 %s 来源 %s\n", fs.Arg(0), entries[0].Time, entries[0].Remote)
+
+	// 接收响应, 新报文到达时通知
+	var lock sync.Mutex
+	var actual []*replayed
+	notify, closed := make(chan struct{}, 1), make(chan struct{})
+	start := time.Now()
+	go func() {
+		defer close(closed)
+		var pending []byte
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			pending = append(pending, buf[:n]...)
+			for len(pending) >= 2 {
+				size := frameLen(pending)
+				if size < 0 {
+					size = len(pending)
+				}
+				if size > len(pending) {
+					break
+				}
+				lock.Lock()
+				actual = append(actual, &replayed{offset: time.Since(start), data: append([]byte(nil), pending[:size]...)})
+				lock.Unlock()
+				pending = pending[size:]
+				select {
+				case notify <- struct{}{}:
+				default:
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// 按录制的时间发送客户端报文
+	var expected []*record.Entry
+	sent := 0
+send:
+	for _, entry := range entries {
+		switch entry.Type {
+		case record.TypeOut:
+			expected = append(expected, entry)
+		case record.TypeIn:
+			if *speed > 0 {
+				time.Sleep(time.Until(start.Add(time.Duration(float64(entry.Offset) / *speed))))
+			}
+			if _, err := conn.Write(entry.Data); err != nil {
+				fmt.Fprintf(w, "发送第 %d 个报文失败: %v\n", sent+1, err)
+				break send
+			}
+			sent++
+		}
+	}
+
+	// 等待剩余响应
+	for done := false; !done; {
+		select {
+		case <-notify:
+		case <-closed:
+			done = true
+		case <-time.After(*wait):
+			done = true
+		}
+	}
+	conn.Close()
+	<-closed
+
+	lock.Lock()
+	defer lock.Unlock()
+	fmt.Fprintf(w, "发送 %d 个报文, 录制响应 %d 个, 回放响应 %d 个\n\n", sent, len(expected), len(actual))
+	if diffReplay(w, expected, actual) > 0 {
+		w.Flush()
+		os.Exit(1)
+	}
+}
+
+// 按最长公共子序列比对录制与回放的响应, 输出差异并返回差异数.
+// = 为一致, - 为仅录制时出现, + 为仅回放时出现
+func diffReplay(w io.Writer, expected []*record.Entry, actual []*replayed) int {
+	a, b := make([]string, len(expected)), make([]string, len(actual))
+	for i, e := range expected {
+		a[i] = summarize(e.Data)
+	}
+	for i, r := range actual {
+		b[i] = summarize(r.data)
+	}
+
+	// lcs[i][j] 为 a[i:] 与 b[j:] 的最长公共子序列长度
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	diffs := 0
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			fmt.Fprintf(w, "= %9.3fs %s\n", actual[j].offset.Seconds(), a[i])
+			i, j = i+1, j+1
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(w, "- %9.3fs %s\n", expected[i].Offset.Seconds(), a[i])
+			i, diffs = i+1, diffs+1
+		default:
+			fmt.Fprintf(w, "+ %9.3fs %s\n", actual[j].offset.Seconds(), b[j])
+			j, diffs = j+1, diffs+1
+		}
+	}
+
+	if diffs == 0 {
+		fmt.Fprintln(w, "\n响应一致")
+	} else {
+		fmt.Fprintf(w, "\n存在 %d 处差异\n", diffs)
+	}
+	return diffs
+}
+
+// 单行描述报文, 用于比对
+func summarize(raw []byte) string {
+	msg, _, err := codec.Decode(raw)
+	if err != nil || msg == nil {
+		return fmt.Sprintf("非法报文 %s", preview(raw, 32))
+	}
+
+	sb := strings.Builder{}
+	fixed := msg.FixedHeader
+	sb.WriteString(message.TypeName(fixed.MessageType))
+	switch header := msg.VariableHeader.(type) {
+	case *message.MqttConnAckVariableHeader:
+		fmt.Fprintf(&sb, " sessionPresent: %v 返回码: %d", header.SessionPresent, header.Code)
+	case *message.MqttPublishVaribleHeader:
+		fmt.Fprintf(&sb, " dup: %v qos: %d retain: %v topic: %q", fixed.Dup, fixed.Qos, fixed.Retain, header.TopicName)
+		if fixed.Qos > 0 {
+			fmt.Fprintf(&sb, " packetId: %d", header.MessageId)
+		}
+	case *message.MqttMessageIdVariableHeader:
+		fmt.Fprintf(&sb, " packetId: %d", header.MessageId)
+	}
+	if payload, ok := msg.Payload.([]byte); ok {
+		if fixed.MessageType == message.SUBACK {
+			fmt.Fprintf(&sb, " 返回码: % x", payload)
+		} else {
+			fmt.Fprintf(&sb, " 载荷: %s", preview(payload, 32))
+		}
+	}
+	return sb.String()
+}
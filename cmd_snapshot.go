@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mqtt-go/src/persist"
+	"mqtt-go/src/snapshot"
+	"os"
+)
+
+const snapshotUsage = `用法:
+  mqtt-go snapshot export -data-dir <目录> [-o <文件>]
+  mqtt-go snapshot import -data-dir <目录> -i <文件> [-dry-run]
+
+导出及导入须在 broker 停止时执行, 导入时目录被运行中的 broker 占用则拒绝; 运行中的 broker 请使用管理接口 /api/snapshot`
+
+// 快照导出及导入, 用于迁移持久化状态
+func snapshotMain(args []string) {
+	if len(args) == 0 {
+		log.Fatal(snapshotUsage)
+	}
+
+	switch args[0] {
+	case "export":
+		snapshotExport(args[1:])
+	case "import":
+		snapshotImport(args[1:])
+	default:
+		log.Fatal(snapshotUsage)
+	}
+}
+
+func snapshotExport(args []string) {
+	fs := flag.NewFlagSet("snapshot export", flag.ExitOnError)
+	dataDir := fs.String("data-dir", "", "持久化目录")
+	out := fs.String("o", "-", "输出文件, - 为标准输出")
+	fs.Parse(args)
+	if *dataDir == "" {
+		log.Fatal("必须指定 -data-dir")
+	}
+
+	m, err := persist.LoadDisk(*dataDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	snap := snapshot.Export(m, nil)
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		file, err := os.Create(*out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+		w = file
+	}
+	if err := snap.Write(w); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("快照已导出, 会话: %d, 保留消息: %d\n", len(snap.Sessions), len(snap.Retained))
+}
+
+func snapshotImport(args []string) {
+	fs := flag.NewFlagSet("snapshot import", flag.ExitOnError)
+	dataDir := fs.String("data-dir", "", "持久化目录")
+	in := fs.String("i", "-", "快照文件, - 为标准输入")
+	dryRun := fs.Bool("dry-run", false, "仅校验快照并统计, 不写入")
+	fs.IntVar(&persist.MaxQueued, "offline-queue", persist.MaxQueued, "单个持久会话最多保存的离线消息数, 须与 broker 一致, 0 为不限制")
+	fs.Parse(args)
+	if *dataDir == "" {
+		log.Fatal("必须指定 -data-dir")
+	}
+
+	var r io.Reader = os.Stdin
+	if *in != "-" {
+		file, err := os.Open(*in)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+		r = file
+	}
+	snap, err := snapshot.Read(r)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var p persist.Persistence
+	var disk *persist.Disk
+	if *dryRun {
+		if p, err = persist.LoadDisk(*dataDir); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		if disk, err = persist.OpenDisk(*dataDir); err != nil {
+			log.Fatal(err)
+		}
+		p = disk
+	}
+
+	summary, err := snap.Apply(p, *dryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if disk != nil {
+		// 以导入后的状态重写日志
+		if err := disk.Compact(true); err != nil {
+			log.Fatal(err)
+		}
+		if err := disk.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	fmt.Printf("会话: %d, 订阅: %d, 待确认消息: %d, 离线消息: %d, 保留消息: %d\n",
+		summary.Sessions, summary.Subscriptions, summary.Inflight, summary.Queued, summary.Retained)
+	if len(summary.Replaced) > 0 {
+		fmt.Printf("替换已存在的会话: %v\n", summary.Replaced)
+	}
+	if summary.DryRun {
+		fmt.Println("dry-run, 未写入")
+	}
+}
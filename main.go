@@ -3,154 +3,184 @@ package main
 import (
 	"flag"
 	"log"
+	"mqtt-go/src/admin"
 	"mqtt-go/src/channel"
 	"mqtt-go/src/codec"
+	"mqtt-go/src/fault"
 	"mqtt-go/src/handler"
+	"mqtt-go/src/limit"
+	"mqtt-go/src/persist"
+	"mqtt-go/src/record"
+	"mqtt-go/src/server"
 	"net"
+	"os"
+	"strings"
 	"time"
 )
 
 var (
-	addr      string
-	heartbeat time.Duration
+	addr string
+
+	// 管理接口
+	httpAddr  string
+	httpToken string
 )
 
 func main() {
-	flag.StringVar(&addr, "addr", ":1883", "监听地址及端口")
+	// 子命令
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "snapshot":
+			snapshotMain(os.Args[2:])
+			return
+		case "bench":
+			benchMain(os.Args[2:])
+			return
+		case "pub":
+			pubMain(os.Args[2:])
+			return
+		case "sub":
+			subMain(os.Args[2:])
+			return
+		case "decode":
+			decodeMain(os.Args[2:])
+			return
+		case "replay":
+			replayMain(os.Args[2:])
+			return
+		}
+	}
+
+	flag.StringVar(&addr, "addr", ":1883", "监听地址及端口, 多个地址以逗号分隔")
 	arg1 := flag.String("heartbeat", "1m", "心跳周期")
+	flag.DurationVar(&server.ConnectTimeout, "connect-timeout", server.ConnectTimeout, "连接建立后等待 CONNECT 报文的超时时间")
+	flag.DurationVar(&channel.RetryInterval, "retry-interval", channel.RetryInterval, "qos1/qos2 报文未确认时的重发间隔, 0 为不重发")
+	flag.DurationVar(&handler.SessionExpiry, "session-expiry", handler.SessionExpiry, "持久会话断开后的保留时长, 0 为永不过期")
+	flag.StringVar(&server.Mode, "mode", server.Mode, "网络模式: goroutine/epoll, epoll 仅支持 linux")
+	flag.IntVar(&server.PollLoops, "poll-loops", server.PollLoops, "epoll 模式下的事件循环数")
+	flag.IntVar(&server.MaxConns, "max-conns", 0, "全局最大连接数, 0 为不限制")
+	flag.IntVar(&server.ListenerMaxConns, "listener-max-conns", 0, "单个监听地址最大连接数, 0 为不限制")
+	flag.Float64Var(&server.IpConnRate, "ip-conn-rate", 0, "单个来源 IP 每秒新建连接数上限, 0 为不限制")
+	flag.IntVar(&server.IpConnBurst, "ip-conn-burst", server.IpConnBurst, "单个来源 IP 新建连接的突发上限")
+	flag.DurationVar(&server.WriteTimeout, "write-timeout", server.WriteTimeout, "写超时, 超时即断开连接, 0 为不限制")
+	flag.IntVar(&server.WriteBatch, "write-batch", server.WriteBatch, "单次写出最多合并的报文数")
+	flag.IntVar(&channel.QueueMaxMsgs, "out-queue-msgs", channel.QueueMaxMsgs, "单个连接写出队列最大报文数, 0 为不限制")
+	flag.IntVar(&channel.QueueMaxBytes, "out-queue-bytes", channel.QueueMaxBytes, "单个连接写出队列最大字节数, 0 为不限制")
+	arg5 := flag.String("out-queue-policy", "drop-newest", "写出队列溢出策略: drop-newest/drop-oldest-qos0/disconnect")
+	flag.StringVar(&httpAddr, "http", "", "管理接口监听地址, 为空则不启用")
+	flag.StringVar(&httpToken, "http-token", "", "管理接口访问令牌")
+	flag.Float64Var(&limit.Default.Msgs, "rate-msgs", 0, "单客户端每秒发布消息数上限, 0 为不限制")
+	flag.Float64Var(&limit.Default.Bytes, "rate-bytes", 0, "单客户端每秒发布字节数上限, 0 为不限制")
+	arg2 := flag.String("rate-msgs-action", "pause", "消息数超限动作: pause/drop/disconnect")
+	arg3 := flag.String("rate-bytes-action", "pause", "字节数超限动作: pause/drop/disconnect")
+	arg4 := flag.String("rate-users", "", "按用户名限流, 格式: user=msgs[/action][:bytes[/action]],...")
+	flag.IntVar(&codec.DecodeLimits.MaxPacketSize, "max-packet-size", codec.DecodeLimits.MaxPacketSize, "单个报文最大字节数, 0 为不限制")
+	flag.IntVar(&codec.DecodeLimits.MaxTopicLength, "max-topic-length", codec.DecodeLimits.MaxTopicLength, "主题最大字节数, 0 为不限制")
+	flag.IntVar(&codec.DecodeLimits.MaxTopicLevels, "max-topic-levels", codec.DecodeLimits.MaxTopicLevels, "主题最大层级数, 0 为不限制")
+	flag.IntVar(&codec.DecodeLimits.MaxClientIdLength, "max-client-id-length", codec.DecodeLimits.MaxClientIdLength, "clientId 最大字节数, 0 为不限制")
+	flag.IntVar(&codec.DecodeLimits.MaxSubscriptions, "max-subscriptions", codec.DecodeLimits.MaxSubscriptions, "单个 SUBSCRIBE 报文最多包含的订阅数, 0 为不限制")
+	dataDir := flag.String("data-dir", "", "持久化目录, 保存持久会话、待确认及离线消息、保留消息, 为空则重启后丢失")
+	arg6 := flag.String("fsync", "always", "持久化落盘策略: always(预写日志、订阅变更及会话删除返回前落盘, 其余记录随后续落盘写入)/batch/never")
+	flag.DurationVar(&persist.SyncInterval, "fsync-interval", persist.SyncInterval, "batch 落盘策略的落盘间隔")
+	flag.IntVar(&persist.MaxQueued, "offline-queue", persist.MaxQueued, "单个持久会话最多保存的离线消息数, 0 为不限制")
+	flag.StringVar(&record.Dir, "record-dir", "", "报文录制目录, 为空则不录制")
+	recordClients := flag.String("record-clients", "", "录制报文的 clientId, 多个以逗号分隔")
+	recordIps := flag.String("record-ips", "", "录制报文的来源 IP, 多个以逗号分隔")
+	faultAddr := flag.String("fault-addr", "", "故障注入调试监听地址, 该地址上的连接按 -fault 注入网络故障, 为空则不启用")
+	arg7 := flag.String("fault", "", "故障注入配置, 格式: seed=1,latency=50ms,jitter=20ms,bandwidth=10240,read-chunk=3,write-chunk=3,disconnect=0.001,stall=0.01,stall-time=2s")
 	flag.Parse()
 	if v, err := time.ParseDuration(*arg1); err != nil {
 		log.Fatalf("非法的心跳格式:%s\n", v)
 	} else {
-		heartbeat = v
+		server.Heartbeat = v
+	}
+
+	// 限流配置
+	var err error
+	if limit.Default.MsgsAction, err = limit.ParseAction(*arg2); err != nil {
+		log.Fatal(err)
+	}
+	if limit.Default.BytesAction, err = limit.ParseAction(*arg3); err != nil {
+		log.Fatal(err)
+	}
+	if limit.Users, err = limit.ParseUsers(*arg4, limit.Default); err != nil {
+		log.Fatal(err)
 	}
 
-	l, err := net.Listen("tcp", addr)
-	if err != nil {
+	// 写出队列
+	if channel.QueuePolicy, err = channel.ParsePolicy(*arg5); err != nil {
 		log.Fatal(err)
 	}
 
-	log.Printf("监听: %s", l.Addr().String())
+	// 报文录制
+	record.Clients, record.IPs = record.ParseList(*recordClients), record.ParseList(*recordIps)
 
-	for {
-		conn, err := l.Accept()
+	// 恢复持久会话
+	if persist.Sync, err = persist.ParseSyncPolicy(*arg6); err != nil {
+		log.Fatal(err)
+	}
+	// 记录须容纳最大报文的 base64 编码, 不限制报文大小时取协议上限 256MB
+	maxPacketSize := codec.DecodeLimits.MaxPacketSize
+	if maxPacketSize <= 0 {
+		maxPacketSize = 256 << 20
+	}
+	persist.MaxRecordSize = maxPacketSize/3*4 + 64*1024
+	if *dataDir != "" {
+		disk, err := persist.OpenDisk(*dataDir)
 		if err != nil {
-			log.Printf("连接建立失败: %s", err.Error())
-			continue
+			log.Fatal(err)
 		}
-
-		go handleNewConn(conn)
+		handler.Persistence = disk
 	}
-}
 
-func handleNewConn(conn net.Conn) {
-	defer func() {
-		if err := recover(); err != nil {
-			log.Printf("panic info:%v\n", err)
-		}
-	}()
+	// 恢复延迟消息, 须在重放预写日志之前, 重放的延迟消息才能取得不冲突的 id
+	if err := handler.Delayed.Load(handler.Persistence); err != nil {
+		log.Fatal(err)
+	}
+	handler.Restore()
 
-	log.Printf("remote: [%s]", conn.RemoteAddr().String())
-	wrapConn := channel.NewChannel(conn, heartbeat)
-	handler.ChannelActive(wrapConn)
+	// 网络模式, 处理报文需等待落盘时 epoll 模式的报文处理移出事件循环
+	server.PollOffload = *dataDir != "" && persist.Sync == persist.SyncAlways
+	if err := server.Init(); err != nil {
+		log.Fatal(err)
+	}
 
-	// 释放资源并广播连接断开事件
-	defer func() {
-		err := wrapConn.Close()
+	listeners := make([]net.Listener, 0, 1)
+	for _, a := range strings.Split(addr, ",") {
+		l, err := net.Listen("tcp", strings.TrimSpace(a))
 		if err != nil {
-			log.Printf("连接关闭异常：%v", err)
+			log.Fatal(err)
 		}
-		log.Printf("客户端[%s]连接断开", wrapConn.Id)
-		handler.ChannelInactive(wrapConn)
-	}()
-
-	// 心跳
-	go startHandleIdle(wrapConn)
-
-	// 启动写入 goroutine
-	go startWriter(wrapConn)
-
-	// 开始处理数据流
-	startReader(wrapConn)
-}
-
-func startReader(channel *channel.Channel) {
-	// 开始解码
-	var cumulation []byte
-	for {
-		// 读 buf
-		buf := channel.Get()
+		listeners = append(listeners, l)
+	}
 
-		n, err := channel.Read(buf)
+	// 故障注入调试监听
+	if *faultAddr != "" {
+		config, err := fault.ParseConfig(*arg7)
 		if err != nil {
-			log.Printf("连接断开: %s\n", err.Error())
-			return
-		}
-		if n == 0 {
-			// 回收 buf
-			channel.Put(buf)
-			continue
+			log.Fatal(err)
 		}
-
-		// 可用 slice
-		cumulation = append(cumulation, buf[:n]...)
-
-		// 回收 buf
-		channel.Put(buf)
-
-		// 新的报文读取通知
-		channel.InputNotify <- channel.Heartbeat
-
-		// 开始解码
-		for {
-			if mqttMessage, left, err := codec.Decode(cumulation); err != nil {
-				log.Printf("解码错误: %s\n", err.Error())
-				return
-			} else {
-				if mqttMessage != nil {
-					handler.ChannelRead(channel, mqttMessage)
-					cumulation = left
-					continue
-				}
-
-				if left != nil && len(left) > 0 {
-					cumulation = left
-				} else {
-					cumulation = make([]byte, 0)
-				}
-				break
-			}
+		l, err := net.Listen("tcp", *faultAddr)
+		if err != nil {
+			log.Fatal(err)
 		}
+		listeners = append(listeners, fault.NewListener(l, config))
 	}
-}
 
-func startWriter(channel *channel.Channel) {
-	for {
-		select {
-		case buf := <-channel.Out:
-			if _, err := channel.Write0(buf); err != nil {
-				log.Printf("写入失败: %s\n", err)
-			}
-		case <-channel.Stop:
-			return
+	// 管理接口
+	if httpAddr != "" {
+		if httpToken == "" {
+			log.Fatal("启用管理接口必须指定 -http-token")
 		}
+		go func() {
+			log.Fatal(admin.NewServer(httpAddr, httpToken).ListenAndServe())
+		}()
 	}
-}
-
-// 心跳处理
-func startHandleIdle(channel *channel.Channel) {
-	interval := channel.Heartbeat
-	for {
-		select {
-		case <-time.After(interval):
-			log.Printf("心跳超时: %v\n", time.Now())
-			if channel.Closed {
-				return
-			}
 
-			channel.Close()
-			return
-		case interval = <-channel.InputNotify:
-		}
+	for _, l := range listeners[1:] {
+		go func(l net.Listener) {
+			log.Fatal(server.Serve(l))
+		}(l)
 	}
+	log.Fatal(server.Serve(listeners[0]))
 }
@@ -0,0 +1,72 @@
+// 管理接口, 基于 HTTP 提供给后端服务使用
+
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// 管理接口服务
+type Server struct {
+	// 监听地址
+	addr string
+
+	// 访问令牌, 请求需携带 Authorization: Bearer <token>
+	token string
+
+	mux *http.ServeMux
+}
+
+// 构建管理接口服务
+func NewServer(addr string, token string) *Server {
+	s := &Server{
+		addr:  addr,
+		token: token,
+		mux:   http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("/api/publish", s.auth(handlePublish))
+	s.mux.HandleFunc("/api/publish/batch", s.auth(handlePublishBatch))
+	s.mux.HandleFunc("/api/clients", s.auth(handleClients))
+	s.mux.HandleFunc("/api/delayed", s.auth(handleDelayed))
+	s.mux.HandleFunc("/api/delayed/", s.auth(handleDelayedCancel))
+	s.mux.HandleFunc("/api/snapshot", s.auth(handleSnapshot))
+
+	return s
+}
+
+// 启动监听, 阻塞直至服务退出
+func (this *Server) ListenAndServe() error {
+	log.Printf("管理接口监听: %s", this.addr)
+	return http.ListenAndServe(this.addr, this.mux)
+}
+
+// 令牌校验
+func (this *Server) auth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(this.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "认证失败")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// 以 json 格式响应
+func writeJson(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("响应写入失败: %v\n", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJson(w, code, map[string]string{"error": msg})
+}
@@ -0,0 +1,133 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mqtt-go/src/delay"
+	"mqtt-go/src/handler"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testToken = "secret"
+
+// 启动管理接口, 返回其地址
+func startAdmin(t *testing.T) string {
+	log.SetOutput(ioutil.Discard)
+	s := httptest.NewServer(NewServer("", testToken).mux)
+	t.Cleanup(s.Close)
+	return s.URL
+}
+
+// 发送请求, 返回状态码及响应体
+func request(t *testing.T, method string, url string, token string, contentType string, body string) (int, map[string]interface{}) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var v map[string]interface{}
+	data, _ := ioutil.ReadAll(resp.Body)
+	json.Unmarshal(data, &v)
+	return resp.StatusCode, v
+}
+
+func TestAuth(t *testing.T) {
+	url := startAdmin(t) + "/api/clients"
+	for _, token := range []string{"", "wrong", testToken + "x"} {
+		if code, _ := request(t, http.MethodGet, url, token, "", ""); code != http.StatusUnauthorized {
+			t.Fatalf("令牌 %q 的状态码: %d", token, code)
+		}
+	}
+	if code, _ := request(t, http.MethodGet, url, testToken, "", ""); code != http.StatusOK {
+		t.Fatalf("状态码: %d", code)
+	}
+}
+
+func TestPublishValidation(t *testing.T) {
+	url := startAdmin(t) + "/api/publish"
+	topics := []string{
+		"",
+		"a/+",
+		"a/#",
+		"a\x00b",
+		"\xc3\x28",
+		strings.Repeat("a/", 32) + "a",
+		strings.Repeat("a", 1025),
+		"$delayed/x/a",
+	}
+	for _, topic := range topics {
+		body := fmt.Sprintf(`{"topic": %q, "payload": "m"}`, topic)
+		if code, resp := request(t, http.MethodPost, url, testToken, "application/json", body); code != http.StatusBadRequest {
+			t.Fatalf("主题 %q 的状态码: %d %v", topic, code, resp)
+		}
+	}
+	if code, _ := request(t, http.MethodPost, url+"?topic=a/b&qos=3", testToken, "text/plain", "m"); code != http.StatusBadRequest {
+		t.Fatalf("qos3 的状态码: %d", code)
+	}
+}
+
+func TestPublishRetained(t *testing.T) {
+	url := startAdmin(t) + "/api/publish"
+	topic := "admin-test/retained"
+
+	body := fmt.Sprintf(`{"topic": %q, "qos": 1, "retain": true, "encoding": "base64", "payload": "AAEC"}`, topic)
+	if code, resp := request(t, http.MethodPost, url, testToken, "application/json", body); code != http.StatusOK {
+		t.Fatalf("状态码: %d %v", code, resp)
+	}
+	retained := handler.Persistence.Retained(topic)
+	if len(retained) != 1 || string(retained[0].Payload) != "\x00\x01\x02" || retained[0].Qos != 1 {
+		t.Fatalf("保留消息: %+v", retained)
+	}
+
+	// 空载荷清除保留消息
+	if code, _ := request(t, http.MethodPost, url+"?retain=true&topic="+topic, testToken, "text/plain", ""); code != http.StatusOK {
+		t.Fatalf("状态码: %d", code)
+	}
+	if retained = handler.Persistence.Retained(topic); len(retained) != 0 {
+		t.Fatalf("保留消息未清除: %+v", retained)
+	}
+}
+
+func TestDelayed(t *testing.T) {
+	base := startAdmin(t)
+	topic := "admin-test/delayed"
+
+	body := fmt.Sprintf(`{"topic": %q, "qos": 1, "payload": "later"}`, delay.Prefix+"3600/"+topic)
+	if code, resp := request(t, http.MethodPost, base+"/api/publish", testToken, "application/json", body); code != http.StatusOK {
+		t.Fatalf("状态码: %d %v", code, resp)
+	}
+
+	var id uint64
+	for _, msg := range handler.Delayed.List() {
+		if msg.Topic == topic && string(msg.Payload) == "later" {
+			id = msg.Id
+		}
+	}
+	if id == 0 {
+		t.Fatal("未找到延迟消息")
+	}
+
+	cancel := fmt.Sprintf("%s/api/delayed/%d", base, id)
+	if code, _ := request(t, http.MethodDelete, cancel, testToken, "", ""); code != http.StatusOK {
+		t.Fatalf("取消的状态码: %d", code)
+	}
+	if code, _ := request(t, http.MethodDelete, cancel, testToken, "", ""); code != http.StatusNotFound {
+		t.Fatalf("重复取消的状态码: %d", code)
+	}
+}
@@ -0,0 +1,50 @@
+package admin
+
+import (
+	"mqtt-go/src/channel"
+	"mqtt-go/src/handler"
+	"mqtt-go/src/limit"
+	"net/http"
+)
+
+// 客户端连接信息
+type clientView struct {
+	Id       string `json:"id"`
+	ClientId string `json:"clientId"`
+	Username string `json:"username"`
+	Remote   string `json:"remote"`
+
+	// 发布限流计数, 未限流时为空
+	Rate *limit.Stats `json:"rate,omitempty"`
+
+	// 写出队列深度
+	Queue channel.QueueStats `json:"queue"`
+}
+
+// GET /api/clients
+func handleClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "仅支持 GET")
+		return
+	}
+
+	clients := make([]*clientView, 0)
+	handler.ChannelGroup.Range(func(key, value interface{}) bool {
+		c := value.(*channel.Channel)
+		view := &clientView{
+			Id:       c.Id,
+			Username: c.Username(),
+			Remote:   c.RemoteAddr(),
+			Queue:    c.Out.Stats(),
+		}
+		view.ClientId, _ = c.HGet(channel.CLIENT_ID).(string)
+		if limiter := c.Limiter(); limiter != nil {
+			stats := limiter.Stats()
+			view.Rate = &stats
+		}
+		clients = append(clients, view)
+		return true
+	})
+
+	writeJson(w, http.StatusOK, clients)
+}
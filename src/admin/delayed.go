@@ -0,0 +1,38 @@
+package admin
+
+import (
+	"mqtt-go/src/handler"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// GET /api/delayed 列出待投递的延迟消息
+func handleDelayed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "仅支持 GET")
+		return
+	}
+
+	writeJson(w, http.StatusOK, handler.Delayed.List())
+}
+
+// DELETE /api/delayed/{id} 取消延迟消息
+func handleDelayedCancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, "仅支持 DELETE")
+		return
+	}
+
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/api/delayed/"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "非法的消息 id")
+		return
+	}
+	if !handler.Delayed.Cancel(id) {
+		writeError(w, http.StatusNotFound, "消息不存在或已投递")
+		return
+	}
+
+	writeJson(w, http.StatusOK, map[string]bool{"ok": true})
+}
@@ -0,0 +1,181 @@
+package admin
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mqtt-go/src/codec"
+	"mqtt-go/src/delay"
+	"mqtt-go/src/handler"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 请求体上限
+const maxBodySize = 1 << 20
+
+// 单条发布请求
+//
+//	encoding 指定 payload 的解释方式:
+//		plain(默认): payload 为字符串, 按 utf-8 字节发送
+//		base64: payload 为 base64 编码的字符串
+//		json: payload 为任意 json 值, 原样发送其 json 文本
+type publishReq struct {
+	Topic    string          `json:"topic"`
+	Qos      byte            `json:"qos"`
+	Retain   bool            `json:"retain"`
+	Encoding string          `json:"encoding"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// 批量发布中单条消息的结果
+type publishResult struct {
+	Index int    `json:"index"`
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// POST /api/publish
+//
+//	Content-Type 为 application/json 时请求体为 publishReq;
+//	其它类型时请求体即原始 payload, topic/qos/retain 由 query 参数指定
+func handlePublish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "仅支持 POST")
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+
+	var topic string
+	var qos byte
+	var retain bool
+	var payload []byte
+	if isJson(r) {
+		req := new(publishReq)
+		if err := json.Unmarshal(body, req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("非法的请求体: %v", err))
+			return
+		}
+		if payload, err = req.decodePayload(); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		topic, qos, retain = req.Topic, req.Qos, req.Retain
+	} else {
+		query := r.URL.Query()
+		topic, payload = query.Get("topic"), body
+		if v := query.Get("qos"); v != "" {
+			n, err := strconv.ParseUint(v, 10, 8)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("非法的 qos: %s", v))
+				return
+			}
+			qos = byte(n)
+		}
+		if v := query.Get("retain"); v != "" {
+			if retain, err = strconv.ParseBool(v); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("非法的 retain: %s", v))
+				return
+			}
+		}
+	}
+
+	if err := publish(topic, qos, retain, payload); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJson(w, http.StatusOK, publishResult{Ok: true})
+}
+
+// POST /api/publish/batch
+//
+//	请求体为 publishReq 数组, 逐条发布, 单条失败不影响其它消息
+func handlePublishBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "仅支持 POST")
+		return
+	}
+
+	var reqs []*publishReq
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&reqs); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("非法的请求体: %v", err))
+		return
+	}
+
+	results := make([]publishResult, 0, len(reqs))
+	for i, req := range reqs {
+		result := publishResult{Index: i, Ok: true}
+		payload, err := req.decodePayload()
+		if err == nil {
+			err = publish(req.Topic, req.Qos, req.Retain, payload)
+		}
+		if err != nil {
+			result.Ok, result.Error = false, err.Error()
+		}
+		results = append(results, result)
+	}
+
+	writeJson(w, http.StatusOK, map[string]interface{}{"results": results})
+}
+
+// 按 encoding 解析 payload
+func (this *publishReq) decodePayload() ([]byte, error) {
+	if len(this.Payload) == 0 {
+		return []byte{}, nil
+	}
+
+	switch this.Encoding {
+	case "", "plain":
+		var s string
+		if err := json.Unmarshal(this.Payload, &s); err != nil {
+			return nil, errors.New("plain 编码的 payload 必须为字符串")
+		}
+		return []byte(s), nil
+	case "base64":
+		var s string
+		if err := json.Unmarshal(this.Payload, &s); err != nil {
+			return nil, errors.New("base64 编码的 payload 必须为字符串")
+		}
+		return base64.StdEncoding.DecodeString(s)
+	case "json":
+		return []byte(this.Payload), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("不支持的 encoding: %s", this.Encoding))
+	}
+}
+
+// 校验后进入与 PUBLISH 报文相同的投递流程
+func publish(topic string, qos byte, retain bool, payload []byte) error {
+	// 与客户端 PUBLISH 相同的主题校验及限制
+	if err := codec.ValidateTopicName(topic); err != nil {
+		return err
+	}
+	if qos > 2 {
+		return errors.New(fmt.Sprintf("非法的 qos: %d", qos))
+	}
+	if strings.HasPrefix(topic, delay.Prefix) {
+		if _, _, err := delay.Parse(topic); err != nil {
+			return err
+		}
+	}
+
+	// qos1/qos2 消息与客户端发布相同, 写入预写日志后才返回成功
+	if qos == 0 {
+		return handler.Publish(topic, qos, retain, payload)
+	}
+	return handler.PublishDurable(topic, qos, retain, payload)
+}
+
+func isJson(r *http.Request) bool {
+	t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && t == "application/json"
+}
@@ -0,0 +1,35 @@
+package admin
+
+import (
+	"mqtt-go/src/handler"
+	"mqtt-go/src/snapshot"
+	"mqtt-go/src/store"
+	"net/http"
+)
+
+// 导入快照的请求体上限
+const maxSnapshotSize = 64 << 20
+
+// GET /api/snapshot 导出当前状态快照
+// POST /api/snapshot[?dryRun=true] 导入快照, dryRun 时仅校验
+func handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Disposition", "attachment; filename=snapshot.json")
+		writeJson(w, http.StatusOK, snapshot.Export(handler.Persistence, store.Store.Topics))
+	case http.MethodPost:
+		snap, err := snapshot.Read(http.MaxBytesReader(w, r.Body, maxSnapshotSize))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		summary, err := handler.Import(snap, r.URL.Query().Get("dryRun") == "true")
+		if err != nil {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		writeJson(w, http.StatusOK, summary)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "仅支持 GET/POST")
+	}
+}
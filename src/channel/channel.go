@@ -6,7 +6,9 @@ import (
 	"math"
 	"math/rand"
 	"mqtt-go/src/codec"
+	"mqtt-go/src/limit"
 	"mqtt-go/src/message"
+	"mqtt-go/src/timewheel"
 	"net"
 	"os"
 	"strconv"
@@ -16,7 +18,31 @@ import (
 	"time"
 )
 
-const CLIENT_ID = "CLIENT_ID"
+const (
+	CLIENT_ID = "CLIENT_ID"
+	USERNAME  = "USERNAME"
+	LIMITER   = "LIMITER"
+
+	CLEAN_SESSION = "CLEAN_SESSION"
+
+	WILL = "WILL"
+)
+
+// 待确认报文重发间隔, 0 为不重发
+var RetryInterval = 20 * time.Second
+
+// 待确认报文及其重发定时器
+type inflight struct {
+	frame *codec.Frame
+	timer *timewheel.Timer
+}
+
+func (this *inflight) release() {
+	if this.timer != nil {
+		this.timer.Stop()
+	}
+	this.frame.Release()
+}
 
 // 字节池
 var bytesPool = &sync.Pool{New: func() interface{} {
@@ -31,9 +57,6 @@ type Channel struct {
 	// 原始连接
 	origin net.Conn
 
-	// 是否已被关闭
-	Closed bool
-
 	// 与连接相关联的 kv
 	attr map[string]interface{}
 
@@ -44,23 +67,51 @@ type Channel struct {
 	packageId uint16
 
 	// 输出流
-	Out chan []byte
+	Out *OutQueue
 
-	// 关闭信号
+	// 关闭信号, 连接关闭时 close
 	Stop chan struct{}
 
-	// 心跳周期
-	Heartbeat time.Duration
+	closeOnce sync.Once
+
+	// 关闭回调, 在原始连接关闭之前执行
+	closeHooks []func()
+
+	// 心跳周期, 单位纳秒
+	heartbeat int64
 
-	// 两个功能
-	// 1: 通知心跳处理 goroutine 目前有新的消息送达
-	// 2: 通知 main.startHandleIdle() 方法心跳时间变化
-	InputNotify chan time.Duration
+	// 连接建立时间
+	created time.Time
+
+	// 最近一次收到报文的时间, 单位纳秒
+	lastRead int64
 
 	// 读写锁
 	lock sync.RWMutex
 
-	pubMsgStore map[uint16]*message.PubMsg
+	// 已发出待确认的 qos1/qos2 报文(PUBLISH 或 PUBREL)
+	pubMsgStore map[uint16]*inflight
+
+	// 已收到 qos2 PUBLISH, 等待 PUBREL 的 messageId
+	pubRelStore map[uint16]bool
+
+	// 报文录制, 未录制时为 nil
+	recorder Recorder
+}
+
+// 报文录制, 在读写边界记录收发的原始数据
+type Recorder interface {
+	// 收到的数据
+	Inbound(data []byte)
+
+	// 写出的数据
+	Outbound(bufs net.Buffers)
+
+	// 收到 CONNECT
+	Identify(clientId string)
+
+	// 连接关闭
+	Close()
 }
 
 // 构建一个新的 Channel
@@ -68,56 +119,152 @@ func NewChannel(conn net.Conn, heartbeat time.Duration) *Channel {
 	c := &Channel{
 		Id:        newChannelId(),
 		origin:    conn,
-		Closed:    false,
 		attr:      make(map[string]interface{}, 8),
-		Out:       make(chan []byte, 10),
+		Out:       NewOutQueue(QueueMaxMsgs, QueueMaxBytes, QueuePolicy),
 		pool:      bytesPool,
 		packageId: 0,
 		Stop:      make(chan struct{}),
 
-		// 消息写入通知
-		InputNotify: make(chan time.Duration),
+		pubMsgStore: make(map[uint16]*inflight),
+		pubRelStore: make(map[uint16]bool),
 
 		// 默认六十秒
-		Heartbeat: heartbeat,
+		heartbeat: int64(heartbeat),
+		created:   time.Now(),
 	}
+	c.lastRead = c.created.UnixNano()
 
 	return c
 }
 
-// 返回下一个 packageId
+// 心跳周期
+func (this *Channel) Heartbeat() time.Duration {
+	return time.Duration(atomic.LoadInt64(&this.heartbeat))
+}
+
+// 更新心跳周期
+func (this *Channel) SetHeartbeat(heartbeat time.Duration) {
+	atomic.StoreInt64(&this.heartbeat, int64(heartbeat))
+}
+
+// 连接建立时间
+func (this *Channel) Created() time.Time {
+	return this.created
+}
+
+// 记录收到报文, 每个报文调用一次, 仅为一次原子写
+func (this *Channel) Touch() {
+	atomic.StoreInt64(&this.lastRead, time.Now().UnixNano())
+}
+
+// 最近一次收到报文的时间
+func (this *Channel) LastRead() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&this.lastRead))
+}
+
+// 返回下一个 packageId, 跳过仍待确认的 id
 func (this *Channel) NextMessageId() uint16 {
-	if this.packageId == 0 {
-		this.packageId++
-	} else if math.MaxUint16 == this.packageId {
-		this.packageId = 1
-		return math.MaxUint16
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for i := 0; i < math.MaxUint16; i++ {
+		if math.MaxUint16 == this.packageId {
+			this.packageId = 1
+		} else {
+			this.packageId++
+		}
+		if _, ok := this.pubMsgStore[this.packageId]; !ok {
+			break
+		}
 	}
 	return this.packageId
 }
 
 // 写入数据
 func (this *Channel) Write(msg *message.MqttMessage) {
-	this.Out <- codec.Encode(msg)
+	this.WriteFrame(codec.EncodeFrame(msg))
 }
 
-// 直接写入数据
-func (this *Channel) Write0(buf []byte) (int, error) {
-	return this.origin.Write(buf)
+// 写入已编码的报文, 写出后由写入 goroutine 释放 frame.
+// 不会阻塞调用方, 写出队列溢出时按策略丢弃报文或断开连接
+func (this *Channel) WriteFrame(frame *codec.Frame) {
+	if !this.Out.Push(frame) {
+		log.Printf("客户端[%s]写出队列已满, 断开慢消费者\n", this.Id)
+		if err := this.Close(); err != nil {
+			log.Printf("连接关闭异常: %v\n", err)
+		}
+	}
+}
+
+// 直接写入数据, timeout 大于 0 时设置写超时
+func (this *Channel) Write0(bufs net.Buffers, timeout time.Duration) (int64, error) {
+	if timeout > 0 {
+		if err := this.origin.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+			return 0, err
+		}
+	}
+	if this.recorder != nil {
+		this.recorder.Outbound(bufs)
+	}
+	return bufs.WriteTo(this.origin)
+}
+
+// 是否已被关闭, 可在任意 goroutine 调用
+func (this *Channel) IsClosed() bool {
+	select {
+	case <-this.Stop:
+		return true
+	default:
+		return false
+	}
 }
 
 // 关闭连接，释放资源
 func (this *Channel) Close() error {
-	if !this.Closed {
-		this.Closed = true
+	var err error
+	this.closeOnce.Do(func() {
+		// 广播停止信号
+		close(this.Stop)
+		this.Out.Close()
+
+		// 释放待确认报文
+		this.lock.Lock()
+		for msgId, e := range this.pubMsgStore {
+			e.release()
+			delete(this.pubMsgStore, msgId)
+		}
+		this.lock.Unlock()
 
-		// 发送停止信号
-		this.Stop <- struct{}{}
+		for _, hook := range this.closeHooks {
+			hook()
+		}
+		err = this.origin.Close()
+		if this.recorder != nil {
+			this.recorder.Close()
+		}
+	})
 
-		return this.origin.Close()
-	}
+	return err
+}
+
+// 注册关闭回调, 须在连接开始处理之前调用
+func (this *Channel) OnClose(hook func()) {
+	this.closeHooks = append(this.closeHooks, hook)
+}
+
+// 设置报文录制, 须在连接开始处理之前调用
+func (this *Channel) SetRecorder(recorder Recorder) {
+	this.recorder = recorder
+}
+
+// 报文录制, 未录制时为 nil
+func (this *Channel) Recorder() Recorder {
+	return this.recorder
+}
 
-	return nil
+// 原始连接
+func (this *Channel) Conn() net.Conn {
+	return this.origin
 }
 
 func (this *Channel) Get() []byte {
@@ -129,24 +276,89 @@ func (this *Channel) Put(buf []byte) {
 }
 
 func (this *Channel) HGet(k string) interface{} {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
 	return this.attr[k]
 }
 
 func (this *Channel) HPut(k string, v interface{}) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
 	this.attr[k] = v
 }
 
 // 读取数据
 func (this *Channel) Read(buf []byte) (int, error) {
-	return this.origin.Read(buf)
+	n, err := this.origin.Read(buf)
+	if n > 0 && this.recorder != nil {
+		this.recorder.Inbound(buf[:n])
+	}
+	return n, err
+}
+
+// 保存待确认报文, Channel 持有 frame 的一份引用直至移除.
+// 超过 RetryInterval 未确认的报文将被重发, PUBLISH 重发时置 dup 标志
+func (c *Channel) SavePubMsg(msgId uint16, frame *codec.Frame) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if old, ok := c.pubMsgStore[msgId]; ok {
+		old.release()
+	}
+	e := &inflight{frame: frame}
+	if RetryInterval > 0 {
+		// 重发需获取连接锁并写出报文, 不在时间轮 goroutine 中执行
+		e.timer = timewheel.Default.AfterFunc(RetryInterval, func() { go c.retry(msgId, e) })
+	}
+	c.pubMsgStore[msgId] = e
+}
+
+// 移除待确认报文, 返回是否存在
+func (c *Channel) RemovePubMsg(msgId uint16) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.pubMsgStore[msgId]
+	if ok {
+		e.release()
+		delete(c.pubMsgStore, msgId)
+	}
+	return ok
+}
+
+// 重发未确认的报文
+func (c *Channel) retry(msgId uint16, e *inflight) {
+	c.lock.Lock()
+	if c.IsClosed() || c.pubMsgStore[msgId] != e {
+		c.lock.Unlock()
+		return
+	}
+	frame := e.frame.Dup()
+	e.timer.Reset(RetryInterval)
+	c.lock.Unlock()
+
+	c.WriteFrame(frame)
 }
 
-func (c *Channel) SavePubMsg(msgId uint16, pubMsg *message.PubMsg) {
-	c.pubMsgStore[msgId] = pubMsg
+// 记录等待 PUBREL 的 qos2 消息, 返回是否为重复的 PUBLISH
+func (c *Channel) SavePubRel(msgId uint16) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.pubRelStore[msgId] {
+		return true
+	}
+	c.pubRelStore[msgId] = true
+	return false
 }
 
-func (c *Channel) RemovePubMsg(msgId uint16) {
-	delete(c.pubMsgStore, msgId)
+func (c *Channel) RemovePubRel(msgId uint16) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.pubRelStore, msgId)
 }
 
 var (
@@ -206,12 +418,62 @@ func getMachineId() (string, error) {
 	return "", nil
 }
 
+// 是否已完成 CONNECT
+func (this *Channel) Connected() bool {
+	return this.HGet(CLIENT_ID) != nil
+}
+
 // 返回与 Channel 关联的 clientId
 func (this *Channel) ClientId() string {
-	return this.attr[CLIENT_ID].(string)
+	return this.HGet(CLIENT_ID).(string)
 }
 
 // 返回与 Channel 关联的 clientId
 func (this *Channel) SaveClientId(clientId string) {
-	this.attr[CLIENT_ID] = clientId
+	this.HPut(CLIENT_ID, clientId)
+}
+
+// 返回与 Channel 关联的用户名, 未认证时为空
+func (this *Channel) Username() string {
+	username, _ := this.HGet(USERNAME).(string)
+	return username
+}
+
+func (this *Channel) SaveUsername(username string) {
+	this.HPut(USERNAME, username)
+}
+
+// 返回与 Channel 关联的发布限流器, 不限流时为 nil
+func (this *Channel) Limiter() *limit.Limiter {
+	limiter, _ := this.HGet(LIMITER).(*limit.Limiter)
+	return limiter
+}
+
+func (this *Channel) SaveLimiter(limiter *limit.Limiter) {
+	this.HPut(LIMITER, limiter)
+}
+
+// 是否为清理会话, 未连接时为 false
+func (this *Channel) CleanSession() bool {
+	clean, _ := this.HGet(CLEAN_SESSION).(bool)
+	return clean
+}
+
+func (this *Channel) SaveCleanSession(clean bool) {
+	this.HPut(CLEAN_SESSION, clean)
+}
+
+// 返回与 Channel 关联的遗嘱消息, 未设置遗嘱或已收到 DISCONNECT 时为 nil
+func (this *Channel) Will() *message.MqttMessage {
+	will, _ := this.HGet(WILL).(*message.MqttMessage)
+	return will
+}
+
+func (this *Channel) SaveWill(will *message.MqttMessage) {
+	this.HPut(WILL, will)
+}
+
+// 客户端地址
+func (this *Channel) RemoteAddr() string {
+	return this.origin.RemoteAddr().String()
 }
@@ -0,0 +1,257 @@
+package channel
+
+import (
+	"errors"
+	"fmt"
+	"mqtt-go/src/codec"
+	"sync"
+)
+
+// 写出队列溢出策略
+type Policy byte
+
+const (
+	// 丢弃新到达的报文
+	DropNewest Policy = iota
+
+	// 优先丢弃队列中最早的 qos0 报文, 仍无空间时丢弃新到达的报文
+	DropOldestQos0
+
+	// 断开慢消费者
+	DisconnectSlow
+)
+
+func (this Policy) String() string {
+	switch this {
+	case DropNewest:
+		return "drop-newest"
+	case DropOldestQos0:
+		return "drop-oldest-qos0"
+	case DisconnectSlow:
+		return "disconnect"
+	default:
+		return fmt.Sprintf("Policy(%d)", byte(this))
+	}
+}
+
+func ParsePolicy(s string) (Policy, error) {
+	switch s {
+	case "drop-newest":
+		return DropNewest, nil
+	case "drop-oldest-qos0":
+		return DropOldestQos0, nil
+	case "disconnect":
+		return DisconnectSlow, nil
+	default:
+		return 0, errors.New(fmt.Sprintf("非法的队列溢出策略: %s", s))
+	}
+}
+
+var (
+	// 单个连接写出队列的最大报文数, 0 为不限制
+	QueueMaxMsgs = 1000
+
+	// 单个连接写出队列的最大字节数, 0 为不限制
+	QueueMaxBytes = 0
+
+	// 写出队列溢出策略
+	QueuePolicy = DropNewest
+)
+
+// 有界写出队列, 写入方永不阻塞.
+// 容量限制仅作用于 PUBLISH 报文, 协议响应报文总是入队.
+// 被丢弃的 qos1/qos2 报文仍保存在待确认集合中, 可由重发逻辑补发
+type OutQueue struct {
+	lock sync.Mutex
+
+	frames []*codec.Frame
+	bytes  int
+
+	maxMsgs  int
+	maxBytes int
+	policy   Policy
+
+	// 队列由空变为非空时通知写入 goroutine
+	notify chan struct{}
+
+	// 设置后取代 notify: 无写出方时由 Push 调用, 用于按需启动写出 goroutine
+	ready func()
+
+	// 是否已有写出方在处理队列, 仅在设置 ready 时使用
+	draining bool
+
+	// 关闭后入队的报文直接释放
+	closed bool
+
+	// 丢弃计数
+	dropped uint64
+}
+
+// 写出队列统计
+type QueueStats struct {
+	Msgs    int    `json:"msgs"`
+	Bytes   int    `json:"bytes"`
+	Dropped uint64 `json:"dropped"`
+	Policy  string `json:"policy"`
+}
+
+func NewOutQueue(maxMsgs int, maxBytes int, policy Policy) *OutQueue {
+	return &OutQueue{
+		maxMsgs:  maxMsgs,
+		maxBytes: maxBytes,
+		policy:   policy,
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+// 报文入队, 返回 false 表示队列已满且策略为断开连接
+func (this *OutQueue) Push(frame *codec.Frame) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.closed {
+		frame.Release()
+		return true
+	}
+
+	if frame.IsPublish() && this.full(frame.Len()) {
+		switch this.policy {
+		case DisconnectSlow:
+			this.dropped++
+			frame.Release()
+			return false
+		case DropOldestQos0:
+			for this.full(frame.Len()) && this.dropOldestQos0() {
+			}
+			if this.full(frame.Len()) {
+				this.dropped++
+				frame.Release()
+				return true
+			}
+		default:
+			this.dropped++
+			frame.Release()
+			return true
+		}
+	}
+
+	this.frames = append(this.frames, frame)
+	this.bytes += frame.Len()
+
+	if this.ready != nil {
+		if !this.draining {
+			this.draining = true
+			this.ready()
+		}
+		return true
+	}
+	select {
+	case this.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// 取出至多 max 个报文追加到 dst
+func (this *OutQueue) Pop(dst []*codec.Frame, max int) []*codec.Frame {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	n := len(this.frames)
+	if n > max {
+		n = max
+	}
+	for i := 0; i < n; i++ {
+		dst = append(dst, this.frames[i])
+		this.bytes -= this.frames[i].Len()
+	}
+
+	// 剩余报文前移, 复用底层数组
+	left := copy(this.frames, this.frames[n:])
+	for i := left; i < len(this.frames); i++ {
+		this.frames[i] = nil
+	}
+	this.frames = this.frames[:left]
+
+	// 队列已空, 写出方退出, 后续 Push 重新调用 ready
+	if n == 0 && this.ready != nil {
+		this.draining = false
+	}
+
+	// 仍有积压, 保持通知
+	if left > 0 {
+		select {
+		case this.notify <- struct{}{}:
+		default:
+		}
+	}
+	return dst
+}
+
+// 设置按需写出回调, 须在首次 Push 之前调用.
+// 队列中有报文且无写出方时调用 ready, 写出方须持续 Pop 直至取不到报文后退出.
+// ready 在队列锁内调用, 不得阻塞
+func (this *OutQueue) SetReady(ready func()) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.ready = ready
+}
+
+// 队列非空通知
+func (this *OutQueue) Notify() <-chan struct{} {
+	return this.notify
+}
+
+// 关闭队列并释放积压的报文
+func (this *OutQueue) Close() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.closed = true
+	for i, frame := range this.frames {
+		frame.Release()
+		this.frames[i] = nil
+	}
+	this.frames = nil
+	this.bytes = 0
+}
+
+func (this *OutQueue) Stats() QueueStats {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return QueueStats{
+		Msgs:    len(this.frames),
+		Bytes:   this.bytes,
+		Dropped: this.dropped,
+		Policy:  this.policy.String(),
+	}
+}
+
+// 加入 n 字节的报文后是否超限
+func (this *OutQueue) full(n int) bool {
+	if this.maxMsgs > 0 && len(this.frames)+1 > this.maxMsgs {
+		return true
+	}
+	if this.maxBytes > 0 && this.bytes+n > this.maxBytes {
+		return true
+	}
+	return false
+}
+
+// 丢弃最早的 qos0 报文, 无 qos0 报文时返回 false
+func (this *OutQueue) dropOldestQos0() bool {
+	for i, frame := range this.frames {
+		if frame.IsPublish() && frame.Qos() == 0 {
+			this.bytes -= frame.Len()
+			frame.Release()
+			copy(this.frames[i:], this.frames[i+1:])
+			this.frames[len(this.frames)-1] = nil
+			this.frames = this.frames[:len(this.frames)-1]
+			this.dropped++
+			return true
+		}
+	}
+	return false
+}
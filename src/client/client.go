@@ -0,0 +1,445 @@
+// MQTT 3.1.1 客户端, 基于 codec 及 message 实现.
+// 支持 tcp/tls/ws/wss 连接, qos0/1/2 发布及订阅, 断线自动重连并恢复订阅
+
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mqtt-go/src/message"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// 未连接
+	ErrNotConnected = errors.New("未连接")
+
+	// 客户端已关闭
+	ErrClosed = errors.New("客户端已关闭")
+
+	// 连接断开, 订阅及取消订阅以此结束; qos1/qos2 发布保留在 Store 中待重连后重发
+	ErrConnectionLost = errors.New("连接断开")
+)
+
+// CONNACK 返回码
+var connAckCodes = map[byte]string{
+	1: "不支持的协议版本",
+	2: "clientId 不合格",
+	3: "服务端不可用",
+	4: "用户名或密码错误",
+	5: "未授权",
+}
+
+// 服务端拒绝连接
+type ConnectError struct {
+	Code byte
+}
+
+func (this *ConnectError) Error() string {
+	if reason, ok := connAckCodes[this.Code]; ok {
+		return fmt.Sprintf("连接被拒绝: %s", reason)
+	}
+	return fmt.Sprintf("连接被拒绝, 返回码: %d", this.Code)
+}
+
+// 收到的消息
+type Message struct {
+	Topic   string
+	Qos     byte
+	Retain  bool
+	Dup     bool
+	Payload []byte
+}
+
+// 消息处理函数, 在读取 goroutine 中按到达顺序调用, 不能在其中等待 Token
+type Handler func(client *Client, msg *Message)
+
+// 遗嘱消息
+type Will struct {
+	Topic   string
+	Payload []byte
+	Qos     byte
+	Retain  bool
+}
+
+// 连接选项
+type Options struct {
+	// 服务端地址, 支持 tcp://host:port, tls://host:port, ws://host:port/path, wss://host:port/path,
+	// 省略协议时为 tcp
+	Addr string
+
+	ClientId string
+
+	Username string
+	Password string
+
+	// 为 false 时服务端保留会话, 重连后补发离线消息
+	CleanSession bool
+
+	// 心跳周期, 0 为不发送心跳
+	KeepAlive time.Duration
+
+	Will *Will
+
+	// tls/wss 使用的配置, 为空时使用默认配置
+	TLSConfig *tls.Config
+
+	// 建立连接及等待 CONNACK 的超时时间
+	ConnectTimeout time.Duration
+
+	// 写超时, 0 为不限制
+	WriteTimeout time.Duration
+
+	// 连接断开后自动重连, 重连间隔自 MinReconnectDelay 起倍增至 MaxReconnectDelay
+	AutoReconnect     bool
+	MinReconnectDelay time.Duration
+	MaxReconnectDelay time.Duration
+
+	// qos1/qos2 报文未确认时的重发间隔, 0 为仅在重连后重发
+	RetryInterval time.Duration
+
+	// 待确认报文存储, 为空时使用内存实现
+	Store Store
+
+	// 未匹配任何订阅的消息的处理函数
+	DefaultHandler Handler
+
+	// 连接建立(含重连)后调用, sessionPresent 为服务端是否保留了会话
+	OnConnect func(client *Client, sessionPresent bool)
+
+	// 连接断开后调用
+	OnConnectionLost func(client *Client, err error)
+}
+
+// 默认选项
+func NewOptions(addr string, clientId string) *Options {
+	return &Options{
+		Addr:              addr,
+		ClientId:          clientId,
+		CleanSession:      true,
+		KeepAlive:         time.Minute,
+		ConnectTimeout:    10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		AutoReconnect:     true,
+		MinReconnectDelay: time.Second,
+		MaxReconnectDelay: 2 * time.Minute,
+		RetryInterval:     20 * time.Second,
+	}
+}
+
+// 客户端
+type Client struct {
+	opts *Options
+
+	store Store
+
+	// 保护以下字段
+	lock sync.Mutex
+
+	// 当前连接, 断开时为 nil
+	conn *conn
+
+	// 已调用 Disconnect
+	closed  bool
+	closing chan struct{}
+
+	// 正在重连
+	reconnecting bool
+
+	// 等待确认的操作, packetId -> Token
+	tokens map[uint16]*Token
+
+	// 订阅, topic filter -> 订阅
+	subs map[string]*subscription
+
+	// 已收到 PUBLISH 未收到 PUBREL 的 qos2 消息
+	received map[uint16]bool
+
+	nextId uint16
+}
+
+type subscription struct {
+	filter  string
+	qos     byte
+	handler Handler
+}
+
+// 构建客户端, 须调用 Connect 建立连接
+func New(opts *Options) *Client {
+	store := opts.Store
+	if store == nil {
+		store = NewMemoryStore()
+	}
+
+	return &Client{
+		opts:     opts,
+		store:    store,
+		closing:  make(chan struct{}),
+		tokens:   make(map[uint16]*Token),
+		subs:     make(map[string]*subscription),
+		received: make(map[uint16]bool),
+	}
+}
+
+// 建立连接, 首次连接失败不自动重连
+func (this *Client) Connect() error {
+	this.lock.Lock()
+	closed, connected := this.closed, this.conn != nil
+	this.lock.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	if connected {
+		return errors.New("已连接")
+	}
+
+	return this.connect()
+}
+
+// 是否已连接
+func (this *Client) IsConnected() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.conn != nil
+}
+
+// 发布消息.
+// qos1/qos2 消息在未连接且启用自动重连时保存在 Store 中, 重连后发出
+func (this *Client) Publish(topic string, qos byte, retain bool, payload []byte) *Token {
+	if qos > 2 {
+		return failed(errors.New(fmt.Sprintf("非法的 Qos:%d", qos)))
+	}
+	if topic == "" || strings.ContainsAny(topic, "+#") {
+		return failed(errors.New(fmt.Sprintf("非法的发布主题: %s", topic)))
+	}
+	payload = append([]byte(nil), payload...)
+
+	if qos == 0 {
+		c := this.current()
+		if c == nil {
+			return failed(ErrNotConnected)
+		}
+		return failed(c.write(message.BuildPublish(false, retain, 0, topic, 0, payload)))
+	}
+
+	this.lock.Lock()
+	if this.closed {
+		this.lock.Unlock()
+		return failed(ErrClosed)
+	}
+	c := this.conn
+	if c == nil && !this.opts.AutoReconnect {
+		this.lock.Unlock()
+		return failed(ErrNotConnected)
+	}
+	id, err := this.allocId()
+	if err != nil {
+		this.lock.Unlock()
+		return failed(err)
+	}
+	msg := message.BuildPublish(false, retain, qos, topic, id, payload)
+	token := newToken()
+	this.tokens[id] = token
+	this.store.Put(id, msg)
+	this.lock.Unlock()
+
+	// 写出失败时连接断开, 消息保留在 Store 中
+	if c != nil {
+		c.write(msg)
+	}
+	return token
+}
+
+// 订阅, 匹配 filter 的消息交由 handler 处理; handler 为空时交由 DefaultHandler.
+// 订阅在重连后自动恢复
+func (this *Client) Subscribe(filter string, qos byte, handler Handler) *Token {
+	if qos > 2 {
+		return failed(errors.New(fmt.Sprintf("非法的 Qos:%d", qos)))
+	}
+	if !validFilter(filter) {
+		return failed(errors.New(fmt.Sprintf("非法的主题过滤器: %s", filter)))
+	}
+
+	this.lock.Lock()
+	c, err := this.connected()
+	if err != nil {
+		this.lock.Unlock()
+		return failed(err)
+	}
+	id, err := this.allocId()
+	if err != nil {
+		this.lock.Unlock()
+		return failed(err)
+	}
+	sub := &subscription{filter: filter, qos: qos, handler: handler}
+	token := newToken()
+	token.subs = []*subscription{sub}
+	this.tokens[id] = token
+	this.subs[filter] = sub
+	this.lock.Unlock()
+
+	c.write(message.BuildSubscribe(id, &message.Topic{Name: filter, Qos: qos}))
+	return token
+}
+
+// 取消订阅
+func (this *Client) Unsubscribe(filters ...string) *Token {
+	if len(filters) == 0 {
+		return failed(errors.New("至少取消一个订阅"))
+	}
+
+	this.lock.Lock()
+	c, err := this.connected()
+	if err != nil {
+		this.lock.Unlock()
+		return failed(err)
+	}
+	id, err := this.allocId()
+	if err != nil {
+		this.lock.Unlock()
+		return failed(err)
+	}
+	token := newToken()
+	this.tokens[id] = token
+	for _, filter := range filters {
+		delete(this.subs, filter)
+	}
+	this.lock.Unlock()
+
+	c.write(message.BuildUnsubscribe(id, filters...))
+	return token
+}
+
+// 发送 DISCONNECT 并关闭连接, 未完成的操作以 ErrClosed 结束
+func (this *Client) Disconnect() {
+	this.lock.Lock()
+	if this.closed {
+		this.lock.Unlock()
+		return
+	}
+	this.closed = true
+	close(this.closing)
+	c := this.conn
+	this.conn = nil
+	tokens := this.tokens
+	this.tokens = make(map[uint16]*Token)
+	this.lock.Unlock()
+
+	if c != nil {
+		c.write(message.BuildDisconnect())
+		c.close()
+	}
+	for _, token := range tokens {
+		token.complete(ErrClosed)
+	}
+}
+
+// 当前连接
+func (this *Client) current() *conn {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.conn
+}
+
+// 返回当前连接, 调用时持有锁
+func (this *Client) connected() (*conn, error) {
+	if this.closed {
+		return nil, ErrClosed
+	}
+	if this.conn == nil {
+		return nil, ErrNotConnected
+	}
+	return this.conn, nil
+}
+
+// 分配未使用的 packetId, 调用时持有锁
+func (this *Client) allocId() (uint16, error) {
+	for i := 0; i < 0xffff; i++ {
+		this.nextId++
+		if this.nextId == 0 {
+			this.nextId = 1
+		}
+		if _, ok := this.tokens[this.nextId]; !ok && this.store.Get(this.nextId) == nil {
+			return this.nextId, nil
+		}
+	}
+	return 0, errors.New("packetId 已耗尽")
+}
+
+// 结束等待确认的操作
+func (this *Client) complete(id uint16, err error) *Token {
+	this.lock.Lock()
+	token := this.tokens[id]
+	delete(this.tokens, id)
+	this.lock.Unlock()
+
+	if token != nil {
+		token.complete(err)
+	}
+	return token
+}
+
+// 将消息交由匹配的订阅处理
+func (this *Client) route(msg *Message) {
+	this.lock.Lock()
+	handlers := make([]Handler, 0, 1)
+	for filter, sub := range this.subs {
+		if sub.handler != nil && match(filter, msg.Topic) {
+			handlers = append(handlers, sub.handler)
+		}
+	}
+	this.lock.Unlock()
+
+	if len(handlers) == 0 && this.opts.DefaultHandler != nil {
+		handlers = append(handlers, this.opts.DefaultHandler)
+	}
+	for _, handler := range handlers {
+		handler(this, msg)
+	}
+}
+
+// 主题过滤器是否合法: '#' 仅能为最后一级, 通配符须独占一级
+func validFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+	return true
+}
+
+// 主题是否匹配过滤器, 以 '$' 开头的主题不匹配首级通配符 [MQTT-4.7.2-1]
+func match(filter string, topic string) bool {
+	if filter == topic {
+		return true
+	}
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	filters, topics := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, f := range filters {
+		if f == "#" {
+			return true
+		}
+		if i >= len(topics) {
+			return false
+		}
+		if f != "+" && f != topics[i] {
+			return false
+		}
+	}
+	return len(filters) == len(topics)
+}
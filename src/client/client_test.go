@@ -0,0 +1,328 @@
+package client
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"log"
+	"mqtt-go/src/message"
+	"mqtt-go/src/server"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 启动进程内 broker, 返回监听地址
+func startBroker(t *testing.T) string {
+	log.SetOutput(ioutil.Discard)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+	t.Cleanup(func() { l.Close() })
+	return l.Addr().String()
+}
+
+func testOptions(addr string, clientId string) *Options {
+	opts := NewOptions(addr, clientId)
+	opts.ConnectTimeout = time.Second
+	opts.MinReconnectDelay = 20 * time.Millisecond
+	return opts
+}
+
+func connect(t *testing.T, opts *Options) *Client {
+	c := New(opts)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Disconnect)
+	return c
+}
+
+func receive(t *testing.T, ch chan *Message) *Message {
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("等待消息超时")
+		return nil
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	addr := startBroker(t)
+	sub := connect(t, testOptions(addr, "sub"))
+	pub := connect(t, testOptions(addr, "pub"))
+
+	ch := make(chan *Message, 8)
+	token := sub.Subscribe("a/b", 2, func(client *Client, msg *Message) { ch <- msg })
+	if err := token.WaitTimeout(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if granted := token.Granted(); len(granted) != 1 || granted[0] != 2 {
+		t.Fatalf("SUBACK 返回码: %v", granted)
+	}
+
+	for qos := byte(0); qos <= 2; qos++ {
+		payload := []byte{'m', '0' + qos}
+		if err := pub.Publish("a/b", qos, false, payload).WaitTimeout(time.Second); err != nil {
+			t.Fatalf("qos%d 发布失败: %v", qos, err)
+		}
+		if msg := receive(t, ch); string(msg.Payload) != string(payload) || msg.Qos != qos {
+			t.Fatalf("qos%d 收到: %+v", qos, msg)
+		}
+	}
+
+	if err := sub.Unsubscribe("a/b").WaitTimeout(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	pub.Publish("a/b", 1, false, []byte("after")).WaitTimeout(time.Second)
+	select {
+	case msg := <-ch:
+		t.Fatalf("取消订阅后收到: %+v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	addr := startBroker(t)
+
+	var connects int32
+	opts := testOptions(addr, "re")
+	opts.OnConnect = func(client *Client, sessionPresent bool) { atomic.AddInt32(&connects, 1) }
+	sub := connect(t, opts)
+	pub := connect(t, testOptions(addr, "pub"))
+
+	ch := make(chan *Message, 8)
+	if err := sub.Subscribe("r/t", 1, func(client *Client, msg *Message) { ch <- msg }).WaitTimeout(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// 断开底层连接, 等待重连并恢复订阅
+	sub.current().Conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&connects) < 2 || !sub.IsConnected() {
+		if time.Now().After(deadline) {
+			t.Fatal("等待重连超时")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if err := pub.Publish("r/t", 1, false, []byte("again")).WaitTimeout(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(t, ch); string(msg.Payload) != "again" {
+		t.Fatalf("收到: %+v", msg)
+	}
+}
+
+// 不自动重连时, 连接断开即以 ErrConnectionLost 结束未确认的发布
+func TestConnectionLost(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// 响应 CONNECT, 收到 PUBLISH 后不确认直接断开
+		buf := make([]byte, 256)
+		conn.Read(buf)
+		conn.Write([]byte{0x20, 0x02, 0x00, 0x00})
+		conn.Read(buf)
+	}()
+
+	opts := testOptions(l.Addr().String(), "lost")
+	opts.AutoReconnect = false
+	c := connect(t, opts)
+	if err := c.Publish("l/t", 1, false, []byte("m")).WaitTimeout(2 * time.Second); err != ErrConnectionLost {
+		t.Fatalf("发布结果: %v", err)
+	}
+}
+
+// 首个报文不是 CONNACK 时返回协议错误
+func TestConnectNotConnAck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// 以 PINGRESP 响应 CONNECT
+		buf := make([]byte, 256)
+		conn.Read(buf)
+		conn.Write([]byte{0xd0, 0x00})
+		conn.Read(buf)
+	}()
+
+	opts := testOptions(l.Addr().String(), "notack")
+	opts.AutoReconnect = false
+	err = New(opts).Connect()
+	if e, ok := err.(*message.ProtocolError); !ok || e.Ref != "MQTT-3.2.0-1" {
+		t.Fatalf("连接结果: %v", err)
+	}
+}
+
+// SUBACK 拒绝的订阅被移除, 重连时不再恢复
+func TestSubscribeRejected(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buf := make([]byte, 256)
+		conn.Read(buf)
+		conn.Write([]byte{0x20, 0x02, 0x00, 0x00})
+
+		// SUBSCRIBE: 固定头 2 字节, 随后为 packetId
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			if n >= 4 && buf[0] == 0x82 {
+				conn.Write([]byte{0x90, 0x03, buf[2], buf[3], 0x80})
+			}
+		}
+	}()
+
+	opts := testOptions(l.Addr().String(), "rejected")
+	opts.AutoReconnect = false
+	c := connect(t, opts)
+	token := c.Subscribe("s/t", 1, func(client *Client, msg *Message) {})
+	if err := token.WaitTimeout(2 * time.Second); err == nil {
+		t.Fatal("订阅应被拒绝")
+	}
+	if granted := token.Granted(); len(granted) != 1 || granted[0] != 0x80 {
+		t.Fatalf("SUBACK 返回码: %v", granted)
+	}
+
+	c.lock.Lock()
+	_, ok := c.subs["s/t"]
+	c.lock.Unlock()
+	if ok {
+		t.Fatal("被拒绝的订阅未移除")
+	}
+}
+
+func TestWebsocket(t *testing.T) {
+	addr := startBroker(t)
+
+	// websocket 至 tcp 的转发
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Sec-WebSocket-Protocol") != "mqtt" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		sum := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + websocketGuid))
+		nc, rw, _ := w.(http.Hijacker).Hijack()
+		defer nc.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Protocol: mqtt\r\nSec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+		rw.Flush()
+
+		broker, err := net.Dial("tcp", addr)
+		if err != nil {
+			return
+		}
+		defer broker.Close()
+		go func() {
+			// broker -> 客户端, 服务端帧不掩码, 每帧至多 125 字节
+			buf := make([]byte, 125)
+			for {
+				n, err := broker.Read(buf)
+				if err != nil {
+					nc.Close()
+					return
+				}
+				nc.Write(append([]byte{0x82, byte(n)}, buf[:n]...))
+			}
+		}()
+		unmask(rw.Reader, broker)
+	}))
+
+	opts := testOptions("ws://"+l.Addr().String()+"/mqtt", "ws")
+	c := connect(t, opts)
+	ch := make(chan *Message, 1)
+	if err := c.Subscribe("w/s", 1, func(client *Client, msg *Message) { ch <- msg }).WaitTimeout(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Publish("w/s", 1, false, []byte("ws")).WaitTimeout(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(t, ch); string(msg.Payload) != "ws" {
+		t.Fatalf("收到: %+v", msg)
+	}
+}
+
+// 解码客户端的掩码帧并写出载荷, 仅支持短帧
+func unmask(r *bufio.Reader, w io.Writer) {
+	for {
+		var header [6]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return
+		}
+		length, mask := int(header[1]&0x7f), header[2:]
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+		w.Write(payload)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"+/+", "a/b", true},
+		{"#", "a/b", true},
+		{"#", "$SYS/a", false},
+		{"+/a", "$SYS/a", false},
+		{"a/b", "a/c", false},
+	}
+	for _, c := range cases {
+		if match(c.filter, c.topic) != c.match {
+			t.Errorf("match(%q, %q) != %v", c.filter, c.topic, c.match)
+		}
+	}
+}
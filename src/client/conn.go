@@ -0,0 +1,478 @@
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"mqtt-go/src/codec"
+	"mqtt-go/src/message"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 读缓冲大小
+const readBufferSize = 4096
+
+// 单次连接
+type conn struct {
+	client *Client
+
+	net.Conn
+
+	// 写锁, 报文须整体写出
+	lock sync.Mutex
+
+	// 最近一次写出时间(纳秒)
+	lastWrite int64
+
+	// 已发出 PINGREQ 未收到 PINGRESP
+	pinging int32
+
+	// 连接结束时关闭, 通知心跳及重发 goroutine 退出
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// 写出报文, 失败时断开连接
+func (this *conn) write(msg *message.MqttMessage) error {
+	buf := codec.Encode(msg)
+
+	this.lock.Lock()
+	if timeout := this.client.opts.WriteTimeout; timeout > 0 {
+		this.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	_, err := this.Write(buf)
+	this.lock.Unlock()
+
+	if err != nil {
+		this.client.lost(this, err)
+		return err
+	}
+	atomic.StoreInt64(&this.lastWrite, time.Now().UnixNano())
+	return nil
+}
+
+func (this *conn) close() {
+	this.closeOnce.Do(func() {
+		close(this.done)
+		this.Close()
+	})
+}
+
+// 按地址协议建立底层连接
+func dial(opts *Options) (net.Conn, error) {
+	addr := opts.Addr
+	if !strings.Contains(addr, "://") {
+		addr = "tcp://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("非法的服务端地址: %s", opts.Addr))
+	}
+
+	dialer := &net.Dialer{Timeout: opts.ConnectTimeout}
+	tlsConfig := opts.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = u.Hostname()
+	}
+
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		return dialer.Dial("tcp", u.Host)
+	case "tls", "ssl", "mqtts":
+		return tls.DialWithDialer(dialer, "tcp", u.Host, tlsConfig)
+	case "ws", "wss":
+		host := u.Host
+		if u.Port() == "" {
+			if u.Scheme == "ws" {
+				host += ":80"
+			} else {
+				host += ":443"
+			}
+		}
+		var c net.Conn
+		if u.Scheme == "ws" {
+			c, err = dialer.Dial("tcp", host)
+		} else {
+			c, err = tls.DialWithDialer(dialer, "tcp", host, tlsConfig)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if opts.ConnectTimeout > 0 {
+			c.SetDeadline(time.Now().Add(opts.ConnectTimeout))
+		}
+		ws, err := websocketHandshake(c, u)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.SetDeadline(time.Time{})
+		return ws, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("不支持的协议: %s", u.Scheme))
+	}
+}
+
+// 建立连接并等待 CONNACK, 成功后恢复订阅并重发待确认报文
+func (this *Client) connect() error {
+	opts := this.opts
+	nc, err := dial(opts)
+	if err != nil {
+		return err
+	}
+
+	// CONNECT
+	header := &message.MqttConnVariableHeader{
+		CleanSession: opts.CleanSession,
+		UsernameFlag: opts.Username != "",
+		PasswordFlag: opts.Password != "",
+		KeepAlive:    opts.KeepAlive,
+	}
+	payload := &message.MqttConnPayload{
+		ClientId: opts.ClientId,
+		Username: opts.Username,
+		Password: opts.Password,
+	}
+	if will := opts.Will; will != nil {
+		header.WillFlag = true
+		header.WillQos = will.Qos
+		header.WillRetain = will.Retain
+		payload.WillTopic = will.Topic
+		payload.WillMessage = will.Payload
+	}
+	if opts.ConnectTimeout > 0 {
+		nc.SetDeadline(time.Now().Add(opts.ConnectTimeout))
+	}
+	if _, err := nc.Write(codec.Encode(message.BuildConnect(header, payload))); err != nil {
+		nc.Close()
+		return err
+	}
+
+	// CONNACK
+	decoder := codec.NewClientDecoder(nc, readBufferSize)
+	msg, err := decoder.ReadMessage()
+	if err != nil {
+		nc.Close()
+		return err
+	}
+	// 客户端解码器已校验首个报文, 类型断言前仍须确认
+	if msg.FixedHeader.MessageType != message.CONNACK {
+		msg.Release()
+		nc.Close()
+		return message.NewProtocolError(msg.FixedHeader.MessageType, "MQTT-3.2.0-1", "首个报文必须为 CONNACK")
+	}
+	connAck := msg.VariableHeader.(*message.MqttConnAckVariableHeader)
+	msg.Release()
+	if connAck.Code != 0 {
+		nc.Close()
+		return &ConnectError{Code: connAck.Code}
+	}
+	nc.SetDeadline(time.Time{})
+
+	c := &conn{
+		client:    this,
+		Conn:      nc,
+		lastWrite: time.Now().UnixNano(),
+		done:      make(chan struct{}),
+	}
+
+	this.lock.Lock()
+	if this.closed {
+		this.lock.Unlock()
+		nc.Close()
+		return ErrClosed
+	}
+	this.conn = c
+	this.reconnecting = false
+	if opts.CleanSession || !connAck.SessionPresent {
+		this.received = make(map[uint16]bool)
+	}
+
+	// 服务端未保留会话时恢复订阅
+	var topics []*message.Topic
+	var resubId uint16
+	if !connAck.SessionPresent && len(this.subs) > 0 {
+		token := newToken()
+		for filter, sub := range this.subs {
+			topics = append(topics, &message.Topic{Name: filter, Qos: sub.qos})
+			token.subs = append(token.subs, sub)
+		}
+		if resubId, err = this.allocId(); err != nil {
+			topics = nil
+		} else {
+			this.tokens[resubId] = token
+		}
+	}
+	this.lock.Unlock()
+
+	go this.readLoop(c, decoder)
+	if opts.KeepAlive > 0 {
+		go this.pingLoop(c)
+	}
+	if opts.RetryInterval > 0 {
+		go this.retryLoop(c)
+	}
+
+	if len(topics) > 0 {
+		c.write(message.BuildSubscribe(resubId, topics...))
+	}
+	this.resend(c)
+
+	if opts.OnConnect != nil {
+		opts.OnConnect(this, connAck.SessionPresent)
+	}
+	return nil
+}
+
+// 重发待确认的报文, PUBLISH 置 dup 标志
+func (this *Client) resend(c *conn) {
+	for _, msg := range this.store.All() {
+		if msg.FixedHeader.MessageType == message.PUBLISH {
+			msg = dup(msg)
+		}
+		if c.write(msg) != nil {
+			return
+		}
+	}
+}
+
+func dup(msg *message.MqttMessage) *message.MqttMessage {
+	header := *msg.FixedHeader
+	header.Dup = true
+	return &message.MqttMessage{
+		FixedHeader:    &header,
+		VariableHeader: msg.VariableHeader,
+		Payload:        msg.Payload,
+	}
+}
+
+// 连接断开, 结束订阅等待并按配置重连
+func (this *Client) lost(c *conn, err error) {
+	this.lock.Lock()
+	if this.conn != c {
+		this.lock.Unlock()
+		return
+	}
+	this.conn = nil
+
+	// 已保存的发布待重连后重发, 其余操作结束; 不自动重连时全部结束, 消息仍保留在 Store 中
+	failed := make([]*Token, 0)
+	retry := this.opts.AutoReconnect && !this.closed
+	for id, token := range this.tokens {
+		if !retry || this.store.Get(id) == nil {
+			failed = append(failed, token)
+			delete(this.tokens, id)
+		}
+	}
+	reconnect := this.opts.AutoReconnect && !this.closed && !this.reconnecting
+	if reconnect {
+		this.reconnecting = true
+	}
+	this.lock.Unlock()
+
+	c.close()
+	for _, token := range failed {
+		token.complete(ErrConnectionLost)
+	}
+	if this.opts.OnConnectionLost != nil {
+		this.opts.OnConnectionLost(this, err)
+	}
+	if reconnect {
+		go this.reconnect()
+	}
+}
+
+// 按退避间隔重连直至成功或客户端关闭
+func (this *Client) reconnect() {
+	delay := this.opts.MinReconnectDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+	for {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-this.closing:
+			timer.Stop()
+			return
+		}
+
+		err := this.connect()
+		if err == nil || err == ErrClosed {
+			return
+		}
+		log.Printf("重连 %s 失败: %v\n", this.opts.Addr, err)
+
+		delay *= 2
+		if max := this.opts.MaxReconnectDelay; max > 0 && delay > max {
+			delay = max
+		}
+	}
+}
+
+// 读取并处理报文直至连接断开
+func (this *Client) readLoop(c *conn, decoder *codec.Decoder) {
+	for {
+		msg, err := decoder.ReadMessage()
+		if err != nil {
+			this.lost(c, err)
+			return
+		}
+		this.handle(c, msg)
+		msg.Release()
+	}
+}
+
+func (this *Client) handle(c *conn, msg *message.MqttMessage) {
+	switch msg.FixedHeader.MessageType {
+	case message.PUBLISH:
+		this.handlePublish(c, msg)
+	case message.PUBACK:
+		fallthrough
+	case message.PUBCOMP:
+		id := msg.VariableHeader.(*message.MqttMessageIdVariableHeader).MessageId
+		this.store.Delete(id)
+		this.complete(id, nil)
+	case message.PUBREC:
+		id := msg.VariableHeader.(*message.MqttMessageIdVariableHeader).MessageId
+		rel := message.BuildPubRel(id)
+		if this.store.Get(id) != nil {
+			this.store.Put(id, rel)
+		}
+		c.write(rel)
+	case message.PUBREL:
+		id := msg.VariableHeader.(*message.MqttMessageIdVariableHeader).MessageId
+		this.lock.Lock()
+		delete(this.received, id)
+		this.lock.Unlock()
+		c.write(message.BuildPubComp(id))
+	case message.SUBACK:
+		id := msg.VariableHeader.(*message.MqttMessageIdVariableHeader).MessageId
+		granted := msg.Payload.([]byte)
+		var err error
+		for _, code := range granted {
+			if code == 0x80 {
+				err = errors.New("订阅被拒绝")
+			}
+		}
+
+		this.lock.Lock()
+		token := this.tokens[id]
+		delete(this.tokens, id)
+
+		// 移除被拒绝的订阅, 期间已被重新订阅的除外
+		if token != nil {
+			for i, code := range granted {
+				if code != 0x80 || i >= len(token.subs) {
+					continue
+				}
+				if sub := token.subs[i]; this.subs[sub.filter] == sub {
+					delete(this.subs, sub.filter)
+				}
+			}
+		}
+		this.lock.Unlock()
+		if token != nil {
+			token.granted = granted
+			token.complete(err)
+		}
+	case message.UNSUBACK:
+		this.complete(msg.VariableHeader.(*message.MqttMessageIdVariableHeader).MessageId, nil)
+	case message.PINGRESP:
+		atomic.StoreInt32(&c.pinging, 0)
+	}
+}
+
+func (this *Client) handlePublish(c *conn, msg *message.MqttMessage) {
+	header := msg.VariableHeader.(*message.MqttPublishVaribleHeader)
+	fixedHeader := msg.FixedHeader
+
+	// qos2 消息在收到 PUBREL 前仅投递一次
+	deliver := true
+	if fixedHeader.Qos == 2 {
+		this.lock.Lock()
+		deliver = !this.received[header.MessageId]
+		this.received[header.MessageId] = true
+		this.lock.Unlock()
+	}
+	if deliver {
+		this.route(&Message{
+			Topic:  header.TopicName,
+			Qos:    fixedHeader.Qos,
+			Retain: fixedHeader.Retain,
+			Dup:    fixedHeader.Dup,
+			// payload 引用池化缓冲, 处理函数可能持有
+			Payload: append([]byte(nil), msg.Payload.([]byte)...),
+		})
+	}
+
+	switch fixedHeader.Qos {
+	case 1:
+		c.write(message.BuildPubAck(header.MessageId))
+	case 2:
+		c.write(message.BuildPubRec(header.MessageId))
+	}
+}
+
+// 空闲 KeepAlive/2 后发送 PINGREQ, 下一周期仍未收到 PINGRESP 即断开
+func (this *Client) pingLoop(c *conn) {
+	interval := this.opts.KeepAlive / 2
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if atomic.LoadInt32(&c.pinging) == 1 {
+				this.lost(c, errors.New("心跳超时"))
+				return
+			}
+			if time.Since(time.Unix(0, atomic.LoadInt64(&c.lastWrite))) >= interval {
+				atomic.StoreInt32(&c.pinging, 1)
+				c.write(message.BuildPingReq())
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// 重发超过 RetryInterval 仍未确认的报文
+func (this *Client) retryLoop(c *conn) {
+	ticker := time.NewTicker(this.opts.RetryInterval)
+	defer ticker.Stop()
+
+	// 上一周期已存在的报文
+	seen := make(map[*message.MqttMessage]bool)
+	for {
+		select {
+		case <-ticker.C:
+			current := make(map[*message.MqttMessage]bool)
+			for _, msg := range this.store.All() {
+				current[msg] = true
+				if !seen[msg] {
+					continue
+				}
+				if msg.FixedHeader.MessageType == message.PUBLISH {
+					msg = dup(msg)
+				}
+				if c.write(msg) != nil {
+					return
+				}
+			}
+			seen = current
+		case <-c.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"mqtt-go/src/message"
+	"sort"
+	"sync"
+)
+
+// 待确认报文存储, 保存已发出未完成确认的 qos1/qos2 PUBLISH 及 PUBREL.
+// 连接期间按 RetryInterval 重发, 重连后按保存顺序重发
+type Store interface {
+	// 保存报文, 相同 id 覆盖但保持原有顺序
+	Put(id uint16, msg *message.MqttMessage)
+
+	// 返回报文, 不存在时返回 nil
+	Get(id uint16) *message.MqttMessage
+
+	Delete(id uint16)
+
+	// 全部报文, 按保存顺序
+	All() []*message.MqttMessage
+
+	// 清空
+	Reset()
+}
+
+// 内存实现
+type memoryStore struct {
+	lock sync.Mutex
+
+	entries map[uint16]*storeEntry
+	seq     uint64
+}
+
+type storeEntry struct {
+	msg *message.MqttMessage
+	seq uint64
+}
+
+func NewMemoryStore() Store {
+	return &memoryStore{entries: make(map[uint16]*storeEntry)}
+}
+
+func (this *memoryStore) Put(id uint16, msg *message.MqttMessage) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if entry := this.entries[id]; entry != nil {
+		entry.msg = msg
+		return
+	}
+	this.seq++
+	this.entries[id] = &storeEntry{msg: msg, seq: this.seq}
+}
+
+func (this *memoryStore) Get(id uint16) *message.MqttMessage {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if entry := this.entries[id]; entry != nil {
+		return entry.msg
+	}
+	return nil
+}
+
+func (this *memoryStore) Delete(id uint16) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	delete(this.entries, id)
+}
+
+func (this *memoryStore) All() []*message.MqttMessage {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	entries := make([]*storeEntry, 0, len(this.entries))
+	for _, entry := range this.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+
+	msgs := make([]*message.MqttMessage, len(entries))
+	for i, entry := range entries {
+		msgs[i] = entry.msg
+	}
+	return msgs
+}
+
+func (this *memoryStore) Reset() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.entries = make(map[uint16]*storeEntry)
+}
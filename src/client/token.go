@@ -0,0 +1,84 @@
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// 等待超时
+var ErrTimeout = errors.New("等待超时")
+
+// 异步操作的完成凭证.
+// qos0 发布在写出后完成, qos1 在收到 PUBACK 后完成, qos2 在收到 PUBCOMP 后完成,
+// 订阅及取消订阅在收到 SUBACK/UNSUBACK 后完成
+type Token struct {
+	once sync.Once
+	done chan struct{}
+	err  error
+
+	// SUBACK 返回码, 按订阅顺序
+	granted []byte
+
+	// 订阅请求中的订阅, 按订阅顺序; 被 SUBACK 拒绝时移除
+	subs []*subscription
+}
+
+func newToken() *Token {
+	return &Token{done: make(chan struct{})}
+}
+
+// 以 err 完成的凭证
+func failed(err error) *Token {
+	t := newToken()
+	t.complete(err)
+	return t
+}
+
+// 完成, 重复调用无效
+func (this *Token) complete(err error) {
+	this.once.Do(func() {
+		this.err = err
+		close(this.done)
+	})
+}
+
+// 等待完成并返回结果
+func (this *Token) Wait() error {
+	<-this.done
+	return this.err
+}
+
+// 至多等待 d, 超时返回 ErrTimeout
+func (this *Token) WaitTimeout(d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-this.done:
+		return this.err
+	case <-timer.C:
+		return ErrTimeout
+	}
+}
+
+// 完成时关闭的通道, 用于 select
+func (this *Token) Done() <-chan struct{} {
+	return this.done
+}
+
+// 结果, 未完成时返回 nil
+func (this *Token) Error() error {
+	select {
+	case <-this.done:
+		return this.err
+	default:
+		return nil
+	}
+}
+
+// SUBACK 返回码, 0x80 为订阅失败
+func (this *Token) Granted() []byte {
+	<-this.done
+	return this.granted
+}
@@ -0,0 +1,176 @@
+package client
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// RFC 6455 握手使用的固定 GUID
+const websocketGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// websocket 帧类型
+const (
+	opContinuation = 0x0
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// 基于 websocket 的连接, MQTT 报文以二进制帧传输.
+// 读取时将数据帧拼接为字节流, 写出时每次 Write 为一个帧
+type wsConn struct {
+	net.Conn
+
+	r *bufio.Reader
+
+	// 当前帧未读完的字节数
+	remain int64
+
+	// 读取方回复 pong 与写出方并发, 帧须整体写出
+	lock sync.Mutex
+}
+
+// 在已建立的连接上完成 websocket 握手, 子协议为 mqtt
+func websocketHandshake(conn net.Conn, u *url.URL) (net.Conn, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	path := u.RequestURI()
+	req := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Protocol: mqtt\r\n\r\n", path, u.Host, key)
+	if _, err := io.WriteString(conn, req); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, errors.New(fmt.Sprintf("websocket 握手失败: %s", resp.Status))
+	}
+	sum := sha1.Sum([]byte(key + websocketGuid))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		return nil, errors.New("websocket 握手失败: Sec-WebSocket-Accept 不匹配")
+	}
+
+	return &wsConn{Conn: conn, r: r}, nil
+}
+
+func (this *wsConn) Read(b []byte) (int, error) {
+	for this.remain == 0 {
+		if err := this.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	if int64(len(b)) > this.remain {
+		b = b[:this.remain]
+	}
+	n, err := this.r.Read(b)
+	this.remain -= int64(n)
+	return n, err
+}
+
+// 读取下一个数据帧的帧头, 控制帧就地处理
+func (this *wsConn) nextFrame() error {
+	var header [2]byte
+	if _, err := io.ReadFull(this.r, header[:]); err != nil {
+		return err
+	}
+	opcode := header[0] & 0x0f
+	if header[1]&0x80 != 0 {
+		return errors.New("websocket 服务端帧不能掩码")
+	}
+
+	length := int64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(this.r, ext[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(this.r, ext[:]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+
+	switch opcode {
+	case opBinary, opContinuation:
+		this.remain = length
+		return nil
+	case opPing:
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(this.r, payload); err != nil {
+			return err
+		}
+		_, err := this.writeFrame(opPong, payload)
+		return err
+	case opClose:
+		return io.EOF
+	default:
+		// 忽略 pong 及文本帧
+		_, err := io.CopyN(ioutil.Discard, this.r, length)
+		return err
+	}
+}
+
+func (this *wsConn) Write(b []byte) (int, error) {
+	return this.writeFrame(opBinary, b)
+}
+
+// 写出单个帧, 客户端帧必须掩码
+func (this *wsConn) writeFrame(opcode byte, payload []byte) (int, error) {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+
+	length := len(payload)
+	switch {
+	case length < 126:
+		frame = append(frame, 0x80|byte(length))
+	case length <= 0xffff:
+		frame = append(frame, 0x80|126, byte(length>>8), byte(length))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(length))
+		frame = append(frame, 0x80|127)
+		frame = append(frame, ext[:]...)
+	}
+
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return 0, err
+	}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if _, err := this.Conn.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(payload), nil
+}
@@ -0,0 +1,112 @@
+package codec
+
+import (
+	"bytes"
+	"mqtt-go/src/message"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// 全部 14 种报文
+func allPackets() []*message.MqttMessage {
+	return []*message.MqttMessage{
+		message.BuildConnect(&message.MqttConnVariableHeader{
+			CleanSession: true,
+			KeepAlive:    60 * time.Second,
+		}, &message.MqttConnPayload{ClientId: "c1"}),
+		message.BuildConnect(&message.MqttConnVariableHeader{
+			WillFlag:     true,
+			WillQos:      2,
+			WillRetain:   true,
+			UsernameFlag: true,
+			PasswordFlag: true,
+			KeepAlive:    5 * time.Second,
+		}, &message.MqttConnPayload{
+			ClientId:    "c2",
+			Username:    "user",
+			Password:    "pass",
+			WillTopic:   "will/t",
+			WillMessage: []byte("bye"),
+		}),
+		message.BuildConnAck(true, 0),
+		message.BuildConnAck(false, 5),
+		message.BuildPublish(false, false, 0, "a/b", 0, []byte("qos0")),
+		message.BuildPublish(true, true, 2, "a/b/c", 7, []byte("qos2")),
+		message.BuildPubAck(1),
+		message.BuildPubRec(2),
+		message.BuildPubRel(3),
+		message.BuildPubComp(4),
+		message.BuildSubscribe(5, &message.Topic{Name: "a/+", Qos: 1}, &message.Topic{Name: "b/#", Qos: 2}),
+		message.BuildSubAck(5, []byte{1, 0x80}),
+		message.BuildUnsubscribe(6, "a/+", "b/#"),
+		message.BuildUnsubAck(6),
+		message.BuildPingReq(),
+		message.BuildPingAck(),
+		message.BuildDisconnect(),
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, msg := range allPackets() {
+		buf := Encode(msg)
+		decoded, left, err := Decode(buf)
+		if err != nil {
+			t.Fatalf("报文类型 %d 解码失败: %v", msg.FixedHeader.MessageType, err)
+		}
+		if decoded == nil || len(left) != 0 {
+			t.Fatalf("报文类型 %d 解码不完整", msg.FixedHeader.MessageType)
+		}
+
+		h1, h2 := *msg.FixedHeader, *decoded.FixedHeader
+		h1.RemainLength, h2.RemainLength = 0, 0
+		if h1 != h2 {
+			t.Errorf("报文类型 %d 固定头不一致: %+v != %+v", msg.FixedHeader.MessageType, h1, h2)
+		}
+		if !reflect.DeepEqual(msg.VariableHeader, decoded.VariableHeader) {
+			t.Errorf("报文类型 %d 可变头不一致: %+v != %+v", msg.FixedHeader.MessageType, msg.VariableHeader, decoded.VariableHeader)
+		}
+		if !reflect.DeepEqual(msg.Payload, decoded.Payload) {
+			t.Errorf("报文类型 %d 载荷不一致: %+v != %+v", msg.FixedHeader.MessageType, msg.Payload, decoded.Payload)
+		}
+		if again := Encode(decoded); !bytes.Equal(buf, again) {
+			t.Errorf("报文类型 %d 重新编码不一致: %x != %x", msg.FixedHeader.MessageType, buf, again)
+		}
+	}
+}
+
+// 服务端与客户端解码器仅接收对端发出的报文
+func TestDecoderDirection(t *testing.T) {
+	toServer := map[byte]bool{
+		message.CONNECT: true, message.PUBLISH: true, message.PUBACK: true, message.PUBREC: true,
+		message.PUBREL: true, message.PUBCOMP: true, message.SUBSCRIBE: true, message.UNSUBSCRIBE: true,
+		message.PINGREQ: true, message.DISCONNECT: true,
+	}
+	toClient := map[byte]bool{
+		message.CONNACK: true, message.PUBLISH: true, message.PUBACK: true, message.PUBREC: true,
+		message.PUBREL: true, message.PUBCOMP: true, message.SUBACK: true, message.UNSUBACK: true,
+		message.PINGRESP: true,
+	}
+
+	connect := Encode(allPackets()[0])
+	connAck := Encode(message.BuildConnAck(false, 0))
+	for _, msg := range allPackets() {
+		messageType := msg.FixedHeader.MessageType
+		if messageType == message.CONNECT || messageType == message.CONNACK {
+			continue
+		}
+		buf := Encode(msg)
+
+		server := NewDecoder(bytes.NewReader(append(append([]byte(nil), connect...), buf...)), 512)
+		server.ReadMessage()
+		if _, err := server.ReadMessage(); (err == nil) != toServer[messageType] {
+			t.Errorf("服务端解码报文类型 %d: %v", messageType, err)
+		}
+
+		client := NewClientDecoder(bytes.NewReader(append(append([]byte(nil), connAck...), buf...)), 512)
+		client.ReadMessage()
+		if _, err := client.ReadMessage(); (err == nil) != toClient[messageType] {
+			t.Errorf("客户端解码报文类型 %d: %v", messageType, err)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package codec
+
+import (
+	"bufio"
+	"io"
+	"mqtt-go/src/message"
+	"mqtt-go/src/utils"
+)
+
+// 绑定单个连接的流式解码器, 同时校验报文顺序及方向.
+// 每次读取固定头与 remaining length 后, 按报文实际大小从缓冲池获取报文体缓冲并一次读满,
+// 解码得到的报文处理完毕后须调用 Release 归还缓冲.
+type Decoder struct {
+	r *bufio.Reader
+
+	// 是否已收到 CONNECT(客户端为 CONNACK)
+	connected bool
+
+	// 客户端解码器, 解码服务端发出的报文; 零值为服务端解码器
+	client bool
+}
+
+// 构建服务端流式解码器, size 为读缓冲大小
+func NewDecoder(r io.Reader, size int) *Decoder {
+	return &Decoder{r: bufio.NewReaderSize(r, size)}
+}
+
+// 构建客户端流式解码器, 首个报文须为 CONNACK
+func NewClientDecoder(r io.Reader, size int) *Decoder {
+	return &Decoder{r: bufio.NewReaderSize(r, size), client: true}
+}
+
+// 读取并解码下一个报文
+func (this *Decoder) ReadMessage() (*message.MqttMessage, error) {
+	header, err := this.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	remainingLen, digits, err := this.readRemainLength(header >> 4)
+	if err != nil {
+		return nil, err
+	}
+
+	// 报文体到达前即拒绝超限报文
+	if err := DecodeLimits.checkPacketSize(header>>4, 1+digits+remainingLen); err != nil {
+		return nil, err
+	}
+
+	body, pooled := getBuf(remainingLen)
+	if _, err := io.ReadFull(this.r, body); err != nil {
+		if pooled != nil {
+			pooled.Release()
+		}
+		return nil, err
+	}
+
+	msg, err := decodePacket(header, remainingLen, body)
+	if err == nil {
+		err = this.check(msg)
+	}
+	if err != nil {
+		if pooled != nil {
+			pooled.Release()
+		}
+		return nil, err
+	}
+	if pooled != nil {
+		msg.Attach(pooled)
+	}
+
+	return msg, nil
+}
+
+// 拆包, 同时要求首个报文为 CONNECT(客户端为 CONNACK) 且仅出现一次
+func (this *Decoder) Decode(buf []byte) (*message.MqttMessage, []byte, error) {
+	msg, left, err := Decode(buf)
+	if err != nil || msg == nil {
+		return msg, left, err
+	}
+	if err := this.check(msg); err != nil {
+		return nil, nil, err
+	}
+
+	return msg, left, nil
+}
+
+// 是否已收到 CONNECT(客户端为 CONNACK)
+func (this *Decoder) Connected() bool {
+	return this.connected
+}
+
+// 校验报文顺序及方向
+func (this *Decoder) check(msg *message.MqttMessage) error {
+	if this.client {
+		return this.checkClient(msg)
+	}
+
+	messageType := msg.FixedHeader.MessageType
+	switch messageType {
+	case message.CONNACK, message.SUBACK, message.UNSUBACK, message.PINGRESP:
+		return message.NewProtocolError(messageType, "", "服务端不接收的报文类型")
+	}
+
+	if messageType == message.CONNECT {
+		// A Client can only send the CONNECT Packet once over a Network Connection. The Server MUST
+		// process a second CONNECT Packet sent from a Client as a protocol violation and disconnect
+		// the Client [MQTT-3.1.0-2].
+		if this.connected {
+			return message.NewProtocolError(messageType, "MQTT-3.1.0-2", "重复的 CONNECT 报文")
+		}
+		this.connected = true
+	} else if !this.connected {
+		// After a Network Connection is established by a Client to a Server, the first Packet sent
+		// from the Client to the Server MUST be a CONNECT Packet [MQTT-3.1.0-1].
+		return message.NewProtocolError(messageType, "MQTT-3.1.0-1", "首个报文必须为 CONNECT")
+	}
+
+	return nil
+}
+
+// 客户端校验报文顺序及方向
+func (this *Decoder) checkClient(msg *message.MqttMessage) error {
+	messageType := msg.FixedHeader.MessageType
+	switch messageType {
+	case message.CONNECT, message.SUBSCRIBE, message.UNSUBSCRIBE, message.PINGREQ, message.DISCONNECT:
+		return message.NewProtocolError(messageType, "", "客户端不接收的报文类型")
+	}
+
+	if messageType == message.CONNACK {
+		if this.connected {
+			return message.NewProtocolError(messageType, "", "重复的 CONNACK 报文")
+		}
+		this.connected = true
+	} else if !this.connected {
+		// The first packet sent from the Server to the Client MUST be a CONNACK Packet [MQTT-3.2.0-1].
+		return message.NewProtocolError(messageType, "MQTT-3.2.0-1", "首个报文必须为 CONNACK")
+	}
+
+	return nil
+}
+
+// 读取 remaining length, 算法同 utils.DecodeRemainLength
+func (this *Decoder) readRemainLength(packetType byte) (int, int, error) {
+	multiplier, value := 1, 0
+	for digits := 1; digits <= 4; digits++ {
+		encodedByte, err := this.r.ReadByte()
+		if err != nil {
+			return 0, 0, err
+		}
+
+		value += int(encodedByte&127) * multiplier
+		multiplier *= 128
+		if encodedByte&128 == 0 {
+			return value, digits, nil
+		}
+	}
+
+	// MQTT protocol limits Remaining Length to 4 bytes
+	return 0, 0, message.WrapProtocolError(packetType, "MQTT-2.2.3", utils.ErrRemainLength)
+}
@@ -0,0 +1,88 @@
+package codec
+
+import (
+	"bytes"
+	"io"
+	"mqtt-go/src/message"
+	"strconv"
+	"testing"
+)
+
+// 构建包含 n 个 PUBLISH 报文的字节流, 首个报文为 CONNECT
+func publishStream(n int, payloadSize int) []byte {
+	stream := []byte{
+		message.CONNECT << 4, 13,
+		0, 4, 'M', 'Q', 'T', 'T', 4, 0b10, 0, 60,
+		0, 1, 'c',
+	}
+	payload := bytes.Repeat([]byte{'x'}, payloadSize)
+	for i := 0; i < n; i++ {
+		stream = append(stream, encodePublish(message.BuildPublish(false, false, 1, "a/b/c", uint16(i%65535+1), payload))...)
+	}
+	return stream
+}
+
+// 原有方式: 每次读取 512 字节追加到 cumulation 后从头解码
+func BenchmarkDecodeCumulation(b *testing.B) {
+	for _, size := range []int{64, 1024, 16 << 10} {
+		stream := publishStream(100, size)
+		b.Run(byteSize(size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(stream)))
+			buf := make([]byte, 512)
+			for i := 0; i < b.N; i++ {
+				r := bytes.NewReader(stream)
+				decoder := new(Decoder)
+				var cumulation []byte
+				for {
+					n, err := r.Read(buf)
+					if err == io.EOF {
+						break
+					}
+					cumulation = append(cumulation, buf[:n]...)
+					for {
+						msg, left, err := decoder.Decode(cumulation)
+						if err != nil {
+							b.Fatal(err)
+						}
+						if msg == nil {
+							cumulation = left
+							break
+						}
+						cumulation = left
+					}
+				}
+			}
+		})
+	}
+}
+
+// 流式解码: 报文体读入按大小分级的池化缓冲
+func BenchmarkDecoderStream(b *testing.B) {
+	for _, size := range []int{64, 1024, 16 << 10} {
+		stream := publishStream(100, size)
+		b.Run(byteSize(size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(stream)))
+			for i := 0; i < b.N; i++ {
+				decoder := NewDecoder(bytes.NewReader(stream), 512)
+				for {
+					msg, err := decoder.ReadMessage()
+					if err == io.EOF {
+						break
+					} else if err != nil {
+						b.Fatal(err)
+					}
+					msg.Release()
+				}
+			}
+		})
+	}
+}
+
+func byteSize(n int) string {
+	if n >= 1<<10 {
+		return strconv.Itoa(n>>10) + "KB"
+	}
+	return strconv.Itoa(n) + "B"
+}
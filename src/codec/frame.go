@@ -0,0 +1,224 @@
+package codec
+
+import (
+	"io"
+	"mqtt-go/src/message"
+	"mqtt-go/src/utils"
+	"net"
+	"sync/atomic"
+)
+
+// 引用计数的共享缓冲, 计数归零时归还池化内存
+type SharedBuf struct {
+	B []byte
+
+	refs int32
+
+	pooled *pooledBuf
+}
+
+// 从缓冲池分配长度为 n 的共享缓冲, 初始计数为 1
+func NewSharedBuf(n int) *SharedBuf {
+	b, pooled := getBuf(n)
+	return &SharedBuf{B: b, refs: 1, pooled: pooled}
+}
+
+// 增加引用
+func (this *SharedBuf) Retain() *SharedBuf {
+	atomic.AddInt32(&this.refs, 1)
+	return this
+}
+
+// 减少引用, 归零时归还内存
+func (this *SharedBuf) Release() {
+	if n := atomic.AddInt32(&this.refs, -1); n == 0 && this.pooled != nil {
+		this.pooled.Release()
+		this.pooled = nil
+	} else if n < 0 {
+		panic("SharedBuf 重复释放")
+	}
+}
+
+// 待写出的报文.
+// PUBLISH 报文由共享的固定头+主题、独占的 packetId 及共享的 payload 三段组成,
+// 其余报文仅有 raw 一段
+type Frame struct {
+	// 固定头, remaining length 及主题
+	head *SharedBuf
+
+	// qos>0 时的 packetId
+	id    [2]byte
+	hasId bool
+
+	payload *SharedBuf
+
+	raw []byte
+}
+
+// 由非共享的完整报文构建 Frame
+func RawFrame(buf []byte) *Frame {
+	return &Frame{raw: buf}
+}
+
+// 编码报文为 Frame
+func EncodeFrame(msg *message.MqttMessage) *Frame {
+	return RawFrame(Encode(msg))
+}
+
+// 报文总长度
+func (this *Frame) Len() int {
+	if this.raw != nil {
+		return len(this.raw)
+	}
+
+	n := len(this.head.B) + len(this.payload.B)
+	if this.hasId {
+		n += 2
+	}
+	return n
+}
+
+// 是否为 PUBLISH 报文
+func (this *Frame) IsPublish() bool {
+	return this.raw == nil
+}
+
+// PUBLISH 报文的 qos, 非 PUBLISH 报文返回 0
+func (this *Frame) Qos() byte {
+	if this.raw != nil {
+		return 0
+	}
+	return (this.head.B[0] & 0b0110) >> 1
+}
+
+// 报文各片段, 写出时作为 net.Buffers 的元素
+func (this *Frame) AppendBuffers(bufs net.Buffers) net.Buffers {
+	if this.raw != nil {
+		return append(bufs, this.raw)
+	}
+
+	bufs = append(bufs, this.head.B)
+	if this.hasId {
+		bufs = append(bufs, this.id[:])
+	}
+	if len(this.payload.B) > 0 {
+		bufs = append(bufs, this.payload.B)
+	}
+	return bufs
+}
+
+// 写出报文
+func (this *Frame) WriteTo(w io.Writer) (int64, error) {
+	bufs := this.AppendBuffers(make(net.Buffers, 0, 3))
+	return bufs.WriteTo(w)
+}
+
+// 复制一份 dup 标志置位的 PUBLISH 报文, 用于重发; 非 PUBLISH 报文返回自身
+func (this *Frame) Dup() *Frame {
+	if this.raw != nil {
+		return this
+	}
+
+	head := NewSharedBuf(len(this.head.B))
+	copy(head.B, this.head.B)
+	head.B[0] |= 0b1000
+
+	return &Frame{
+		head:    head,
+		id:      this.id,
+		hasId:   this.hasId,
+		payload: this.payload.Retain(),
+	}
+}
+
+// 增加 Frame 持有的共享缓冲引用, 同一 Frame 被多处持有(如写出队列与待确认消息)时使用
+func (this *Frame) Retain() *Frame {
+	if this.raw == nil {
+		this.head.Retain()
+		this.payload.Retain()
+	}
+	return this
+}
+
+// 释放 Frame 持有的共享缓冲引用
+func (this *Frame) Release() {
+	if this.raw != nil {
+		return
+	}
+
+	this.head.Release()
+	this.payload.Release()
+}
+
+// 一次发布的共享编码结果.
+// payload 仅复制一次, 固定头与主题按 qos 各编码一次, 供全部订阅者共享
+type SharedPublish struct {
+	topic  string
+	retain bool
+
+	payload *SharedBuf
+
+	// 按 qos 缓存的固定头+主题
+	heads [3]*SharedBuf
+}
+
+// 构建共享发布, payload 被复制进共享缓冲
+func NewSharedPublish(topic string, retain bool, payload []byte) *SharedPublish {
+	buf := NewSharedBuf(len(payload))
+	copy(buf.B, payload)
+
+	return &SharedPublish{
+		topic:   topic,
+		retain:  retain,
+		payload: buf,
+	}
+}
+
+// 为一个订阅者生成 PUBLISH 报文, qos 为 0 时忽略 messageId
+func (this *SharedPublish) Frame(qos byte, messageId uint16) *Frame {
+	if this.heads[qos] == nil {
+		this.heads[qos] = this.encodeHead(qos)
+	}
+
+	f := &Frame{
+		head:    this.heads[qos].Retain(),
+		payload: this.payload.Retain(),
+	}
+	if qos > 0 {
+		f.hasId = true
+		f.id = [2]byte{byte(messageId >> 8), byte(messageId)}
+	}
+	return f
+}
+
+// 释放构建方持有的引用, 已生成的 Frame 不受影响
+func (this *SharedPublish) Release() {
+	for _, head := range this.heads {
+		if head != nil {
+			head.Release()
+		}
+	}
+	this.payload.Release()
+}
+
+// 编码固定头, remaining length 及主题
+func (this *SharedPublish) encodeHead(qos byte) *SharedBuf {
+	topicLen := len(this.topic)
+	remainingLen := 2 + topicLen + len(this.payload.B)
+	if qos > 0 {
+		remainingLen += 2
+	}
+	lenBuf := utils.EncodeRemainLength(remainingLen)
+
+	head := NewSharedBuf(1 + len(lenBuf) + 2 + topicLen)
+	b := head.B[:0]
+	b = append(b, message.PUBLISH<<4|qos<<1)
+	if this.retain {
+		b[0] |= 1
+	}
+	b = append(b, lenBuf...)
+	b = append(b, byte(topicLen>>8), byte(topicLen))
+	b = append(b, this.topic...)
+
+	return head
+}
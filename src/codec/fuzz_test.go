@@ -0,0 +1,111 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mqtt-go/src/message"
+	"mqtt-go/src/utils"
+	"testing"
+)
+
+// 解码任意输入, 不能 panic, 失败时须返回协议错误
+func decodeAll(t *testing.T, data []byte) {
+	for buf := data; len(buf) > 0; {
+		msg, left, err := Decode(buf)
+		if err != nil {
+			var protocolErr *message.ProtocolError
+			if !errors.As(err, &protocolErr) {
+				t.Fatalf("%x: 非协议错误: %v", data, err)
+			}
+			break
+		}
+		if msg == nil {
+			break
+		}
+		buf = left
+	}
+
+	for _, decoder := range []*Decoder{NewDecoder(bytes.NewReader(data), 64), NewClientDecoder(bytes.NewReader(data), 64)} {
+		for {
+			msg, err := decoder.ReadMessage()
+			if err != nil {
+				var protocolErr *message.ProtocolError
+				if err != io.EOF && err != io.ErrUnexpectedEOF && !errors.As(err, &protocolErr) {
+					t.Fatalf("%x: 非协议错误: %v", data, err)
+				}
+				break
+			}
+			msg.Release()
+		}
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, msg := range allPackets() {
+		f.Add(Encode(msg))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decodeAll(t, data)
+	})
+}
+
+// 以正确的 remaining length 重新封装报文体
+func frame(header byte, body []byte) []byte {
+	return append(append([]byte{header}, utils.EncodeRemainLength(len(body))...), body...)
+}
+
+// 截断报文体及逐字节篡改, 覆盖全部长度字段
+func TestDecodeMalformed(t *testing.T) {
+	for _, msg := range allPackets() {
+		buf := Encode(msg)
+		_, digits, _ := utils.DecodeRemainLength(buf[1:])
+		header, body := buf[0], buf[1+digits:]
+
+		for n := 0; n < len(body); n++ {
+			decodeAll(t, frame(header, body[:n]))
+		}
+		for i := range body {
+			for _, b := range []byte{0x00, 0x01, 0x7f, 0x80, 0xff} {
+				mutated := append([]byte(nil), body...)
+				mutated[i] = b
+				decodeAll(t, frame(header, mutated))
+			}
+		}
+		for b := 0; b < 16; b++ {
+			decodeAll(t, frame(header&0xf0|byte(b), body))
+		}
+	}
+}
+
+// 错误携带报文类型及规范条目
+func TestProtocolError(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+		typ  byte
+		ref  string
+	}{
+		{"CONNECT 截断", frame(0x10, []byte{0, 4, 'M', 'Q', 'T', 'T', 4}), message.CONNECT, "MQTT-3.1.2"},
+		{"CONNECT 协议名", frame(0x10, []byte{0, 4, 'M', 'Q', 'T', 'X', 4, 2, 0, 60, 0, 0}), message.CONNECT, "MQTT-3.1.2-1"},
+		{"CONNECT clientId 截断", frame(0x10, []byte{0, 4, 'M', 'Q', 'T', 'T', 4, 2, 0, 60, 0, 9, 'c'}), message.CONNECT, "MQTT-3.1.3-3"},
+		{"PUBLISH 主题长度", frame(0x30, []byte{0, 9, 'a'}), message.PUBLISH, "MQTT-3.3.2-1"},
+		{"PUBLISH 缺少 packetId", frame(0x32, []byte{0, 1, 'a'}), message.PUBLISH, "MQTT-2.3.1-1"},
+		{"PUBACK 缺少 packetId", frame(0x40, []byte{0}), message.PUBACK, "MQTT-2.2.3"},
+		{"SUBSCRIBE 无载荷", frame(0x82, []byte{0, 1}), message.SUBSCRIBE, "MQTT-3.8.3-3"},
+		{"SUBSCRIBE 缺少 Qos", frame(0x82, []byte{0, 1, 0, 2, 'a', 'b'}), message.SUBSCRIBE, "MQTT-3.8.3-1"},
+		{"UNSUBSCRIBE 主题截断", frame(0xa2, []byte{0, 1, 0, 5, 'a', 'b'}), message.UNSUBSCRIBE, "MQTT-3.10.3-1"},
+		{"remaining length", []byte{0x30, 0xff, 0xff, 0xff, 0xff}, message.PUBLISH, "MQTT-2.2.3"},
+	}
+	for _, c := range cases {
+		_, _, err := Decode(c.data)
+		var protocolErr *message.ProtocolError
+		if !errors.As(err, &protocolErr) {
+			t.Errorf("%s: 非协议错误: %v", c.name, err)
+			continue
+		}
+		if protocolErr.PacketType != c.typ || protocolErr.Ref != c.ref {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+}
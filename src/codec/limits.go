@@ -0,0 +1,68 @@
+package codec
+
+import (
+	"fmt"
+	"mqtt-go/src/message"
+	"strings"
+)
+
+// 解码限制, 值为 0 表示不限制
+type Limits struct {
+	// 单个报文最大字节数(含固定头)
+	MaxPacketSize int
+
+	// 主题(含主题过滤器)最大字节数
+	MaxTopicLength int
+
+	// 主题最大层级数
+	MaxTopicLevels int
+
+	// clientId 最大字节数
+	MaxClientIdLength int
+
+	// 单个 SUBSCRIBE 报文最多包含的订阅数
+	MaxSubscriptions int
+}
+
+// 解码器使用的限制
+var DecodeLimits = Limits{
+	MaxPacketSize:     1 << 20,
+	MaxTopicLength:    1024,
+	MaxTopicLevels:    32,
+	MaxClientIdLength: 256,
+	MaxSubscriptions:  64,
+}
+
+// 读取到 remaining length 后即检查报文大小, 无需等待报文体到达
+func (this *Limits) checkPacketSize(packetType byte, size int) error {
+	if this.MaxPacketSize > 0 && size > this.MaxPacketSize {
+		return message.NewProtocolError(packetType, "", fmt.Sprintf("报文长度 %d 超过上限 %d", size, this.MaxPacketSize))
+	}
+	return nil
+}
+
+func (this *Limits) checkTopic(packetType byte, topic string) error {
+	if this.MaxTopicLength > 0 && len(topic) > this.MaxTopicLength {
+		return message.NewProtocolError(packetType, "", fmt.Sprintf("主题长度 %d 超过上限 %d", len(topic), this.MaxTopicLength))
+	}
+	if this.MaxTopicLevels > 0 {
+		if levels := strings.Count(topic, "/") + 1; levels > this.MaxTopicLevels {
+			return message.NewProtocolError(packetType, "", fmt.Sprintf("主题层级 %d 超过上限 %d", levels, this.MaxTopicLevels))
+		}
+	}
+	return nil
+}
+
+func (this *Limits) checkClientId(clientId string) error {
+	if this.MaxClientIdLength > 0 && len(clientId) > this.MaxClientIdLength {
+		return message.NewProtocolError(message.CONNECT, "", fmt.Sprintf("clientId 长度 %d 超过上限 %d", len(clientId), this.MaxClientIdLength))
+	}
+	return nil
+}
+
+func (this *Limits) checkSubscriptions(n int) error {
+	if this.MaxSubscriptions > 0 && n > this.MaxSubscriptions {
+		return message.NewProtocolError(message.SUBSCRIBE, "", fmt.Sprintf("订阅数 %d 超过上限 %d", n, this.MaxSubscriptions))
+	}
+	return nil
+}
@@ -1,7 +1,6 @@
 package codec
 
 import (
-	"errors"
 	"fmt"
 	"mqtt-go/src/message"
 	"mqtt-go/src/utils"
@@ -18,23 +17,45 @@ func Decode(buf []byte) (*message.MqttMessage, []byte, error) {
 	// 检查 buf 是否最少含有一个完整的消息
 	remainingLen, digits, err := utils.DecodeRemainLength(buf[1:])
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, message.WrapProtocolError(buf[0]>>4, "MQTT-2.2.3", err)
 	}
 	if digits == 0 {
 		return nil, buf, nil
 	}
 	mqttMsgLen := 1 + digits + remainingLen
+	if err := DecodeLimits.checkPacketSize(buf[0]>>4, mqttMsgLen); err != nil {
+		return nil, nil, err
+	}
 	if bufLen < mqttMsgLen {
 		return nil, buf, nil
 	}
 	// 至此，可以确定 buf 最少含有一个完整数据包
+	msg, err := decodePacket(buf[0], remainingLen, buf[1+digits:mqttMsgLen])
+	if err != nil {
+		return nil, nil, err
+	}
+	return msg, buf[mqttMsgLen:], nil
+}
+
+// 解码单个完整报文
+//
+//	header: 固定头首字节
+//	body: 可变头及载荷, 长度即 remaining length
+//
+// PUBLISH 报文的 payload 直接引用 body, 其余字段均为复制.
+// 全部读取均检查边界, 非法报文返回 *message.ProtocolError
+func decodePacket(header byte, remainingLen int, body []byte) (*message.MqttMessage, error) {
+	bodyLen := len(body)
+	if err := checkFlags(header); err != nil {
+		return nil, err
+	}
 
 	// 解析固定头
 	fixedHeader := &message.MqttFixedHeader{
-		MessageType:  buf[0] >> 4,
-		Qos:          (buf[0] & 0b0110) >> 1,
-		Dup:          ((buf[0] & 0b1000) >> 1) == 1,
-		Retain:       (buf[0] & 0b1) == 1,
+		MessageType:  header >> 4,
+		Qos:          (header & 0b0110) >> 1,
+		Dup:          ((header & 0b1000) >> 3) == 1,
+		Retain:       (header & 0b1) == 1,
 		RemainLength: remainingLen,
 	}
 
@@ -44,28 +65,56 @@ func Decode(buf []byte) (*message.MqttMessage, []byte, error) {
 	}
 	switch fixedHeader.MessageType {
 	case message.CONNECT:
-		if connVariableHeader, err := message.ReadFrom(buf[1+digits:]); err != nil {
-			return nil, nil, err
+		if connVariableHeader, err := message.ReadFrom(body); err != nil {
+			return nil, err
 		} else {
 			msg.VariableHeader = connVariableHeader
-			// conn 类型的报文固定头为 10 个字节
-			payload := decodeConnPayload(connVariableHeader, buf[1+digits+10:])
+			// conn 类型的报文可变头为 10 个字节
+			payload, err := decodeConnPayload(connVariableHeader, body[10:])
+			if err != nil {
+				return nil, err
+			}
+			if err := DecodeLimits.checkClientId(payload.ClientId); err != nil {
+				return nil, err
+			}
+			if connVariableHeader.WillFlag {
+				if err := checkTopicName(message.CONNECT, payload.WillTopic); err != nil {
+					return nil, err
+				}
+				if err := DecodeLimits.checkTopic(message.CONNECT, payload.WillTopic); err != nil {
+					return nil, err
+				}
+			}
 
 			msg.Payload = payload
-			return msg, buf[mqttMsgLen:], nil
+			return msg, nil
 		}
+	case message.CONNACK:
+		m := new(message.MqttConnAckVariableHeader)
+		if _, err := m.ParseFrom(body, 0); err != nil {
+			return nil, err
+		}
+		msg.VariableHeader = m
+
+		return msg, nil
 	case message.PUBLISH:
 		m := new(message.MqttPublishVaribleHeader)
-		index, err := m.ParseFrom(buf, fixedHeader.Qos, 1+digits)
+		index, err := m.ParseFrom(body, fixedHeader.Qos, 0)
 		if err != nil {
-			return nil, nil, err
+			return nil, err
+		}
+		if err := checkTopicName(message.PUBLISH, m.TopicName); err != nil {
+			return nil, err
+		}
+		if err := DecodeLimits.checkTopic(message.PUBLISH, m.TopicName); err != nil {
+			return nil, err
 		}
 		msg.VariableHeader = m
 
 		// 获取 payload
-		msg.Payload = buf[index:mqttMsgLen]
+		msg.Payload = body[index:]
 
-		return msg, buf[mqttMsgLen:], nil
+		return msg, nil
 	case message.PUBACK:
 		fallthrough
 	case message.PUBREC:
@@ -73,105 +122,156 @@ func Decode(buf []byte) (*message.MqttMessage, []byte, error) {
 	case message.PUBREL:
 		fallthrough
 	case message.PUBCOMP:
+		fallthrough
+	case message.UNSUBACK:
+		if bodyLen != 2 {
+			return nil, message.NewProtocolError(fixedHeader.MessageType, "MQTT-2.2.3", fmt.Sprintf("remaining length %d, 应为 2", bodyLen))
+		}
 		m := new(message.MqttMessageIdVariableHeader)
-		_, err := m.ParseFrom(buf, 1+digits)
+		_, err := m.ParseFrom(body, fixedHeader.MessageType, 0)
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 		msg.VariableHeader = m
 
-		return msg, buf[mqttMsgLen:], nil
+		return msg, nil
 	case message.SUBSCRIBE:
-		// Bits 3,2,1 and 0 of the fixed header of the SUBSCRIBE Control Packet
-		// are reserved and MUST be set to 0,0,1 and 0 respectively. The Server MUST
-		// treat any other value as malformed and close the Network Connection
-		// [MQTT-3.8.1-1].
-		if fixedHeader.Dup || fixedHeader.Qos != 1 || fixedHeader.Retain {
-			return nil, nil, errors.New("SUBSCRIBE 报文格式非法")
-		}
-
 		// 可变头
 		m := new(message.MqttMessageIdVariableHeader)
-		index, err := m.ParseFrom(buf, 1+digits)
+		index, err := m.ParseFrom(body, message.SUBSCRIBE, 0)
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 		msg.VariableHeader = m
 
 		// The payload of a SUBSCRIBE packet MUST contain at least one Topic Filter / QoS pair.
 		// A SUBSCRIBE packet with no payload is a protocol violation [MQTT-3.8.3-3].
 		// payload 检查, 至少四个字节
-		if mqttMsgLen-index < 4 {
-			return nil, nil, errors.New("非法的 SUBSCRIBE 报文")
+		if bodyLen-index < 4 {
+			return nil, message.NewProtocolError(message.SUBSCRIBE, "MQTT-3.8.3-3", "至少包含一个订阅")
 		}
 		payload := &message.MqttSubscribePayload{}
-		if _, err := payload.ParseFrom(buf, index, mqttMsgLen); err != nil {
-			return nil, nil, err
+		if _, err := payload.ParseFrom(body, index, bodyLen); err != nil {
+			return nil, err
+		}
+		if err := DecodeLimits.checkSubscriptions(len(payload.Topics)); err != nil {
+			return nil, err
+		}
+		for _, topic := range payload.Topics {
+			if err := checkTopicFilter(message.SUBSCRIBE, topic.Name); err != nil {
+				return nil, err
+			}
+			if err := DecodeLimits.checkTopic(message.SUBSCRIBE, topic.Name); err != nil {
+				return nil, err
+			}
 		}
 		msg.Payload = payload
 
-		return msg, buf[mqttMsgLen:], nil
+		return msg, nil
+	case message.SUBACK:
+		if bodyLen < 3 {
+			return nil, message.NewProtocolError(message.SUBACK, "MQTT-3.9.3", "至少包含一个返回码")
+		}
+		m := new(message.MqttMessageIdVariableHeader)
+		index, err := m.ParseFrom(body, message.SUBACK, 0)
+		if err != nil {
+			return nil, err
+		}
+		msg.VariableHeader = m
+
+		// 返回码 0x00, 0x01, 0x02, 0x80, 其余保留 [MQTT-3.9.3-2]
+		for _, code := range body[index:] {
+			if code > 2 && code != 0x80 {
+				return nil, message.NewProtocolError(message.SUBACK, "MQTT-3.9.3-2", fmt.Sprintf("非法的返回码: %d", code))
+			}
+		}
+
+		// 报文体可能为池化缓冲, 复制返回码
+		msg.Payload = append([]byte(nil), body[index:]...)
+
+		return msg, nil
 	case message.UNSUBSCRIBE:
 		m := new(message.MqttMessageIdVariableHeader)
-		index, err := m.ParseFrom(buf, 1+digits)
+		index, err := m.ParseFrom(body, message.UNSUBSCRIBE, 0)
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 		msg.VariableHeader = m
 
 		// The Payload of an UNSUBSCRIBE packet MUST contain at least one Topic Filter.
 		// An UNSUBSCRIBE packet with no payload is a protocol violation [MQTT-3.10.3-2].
 		// payload 检查，至少三个字节
-		if mqttMsgLen-index < 3 {
-			return nil, nil, errors.New("非法的 UNSUBSCRIBE 报文")
+		if bodyLen-index < 3 {
+			return nil, message.NewProtocolError(message.UNSUBSCRIBE, "MQTT-3.10.3-2", "至少包含一个主题过滤器")
 		}
 
 		topic, payload := "", make([]string, 0, 1)
-		for {
-			topic, index = utils.DecodeMqttString(buf, index)
-			payload = append(payload, topic)
-			if index == mqttMsgLen {
-				break
-			} else if index > mqttMsgLen {
-				return nil, nil, errors.New("非法的 UNSUBSCRIBE 报文")
+		for index < bodyLen {
+			if topic, index, err = utils.DecodeMqttString(body, index); err != nil {
+				return nil, message.WrapStringError(message.UNSUBSCRIBE, "MQTT-3.10.3-1", err)
 			}
+			if err := checkTopicFilter(message.UNSUBSCRIBE, topic); err != nil {
+				return nil, err
+			}
+			if err := DecodeLimits.checkTopic(message.UNSUBSCRIBE, topic); err != nil {
+				return nil, err
+			}
+			payload = append(payload, topic)
 		}
 		msg.Payload = payload
 
-		return msg, buf[mqttMsgLen:], nil
+		return msg, nil
 	case message.PINGREQ:
 		fallthrough
+	case message.PINGRESP:
+		fallthrough
 	case message.DISCONNECT:
-		return msg, buf[mqttMsgLen:], nil
+		return msg, nil
 	default:
-		return nil, nil, errors.New(fmt.Sprintf("非法的MQTT报文类型: %d", fixedHeader.MessageType))
+		return nil, message.NewProtocolError(fixedHeader.MessageType, "MQTT-2.2.1", "非法的报文类型")
 	}
 }
 
 // 解码载荷
-func decodeConnPayload(variableHeader interface{}, buf []byte) *message.MqttConnPayload {
+func decodeConnPayload(variableHeader interface{}, buf []byte) (*message.MqttConnPayload, error) {
 	payload := new(message.MqttConnPayload)
 
 	connVariableHeader := variableHeader.(*message.MqttConnVariableHeader)
 	index := 0
+	var err error
 
 	// clientId
-	payload.ClientId, index = utils.DecodeMqttString(buf, index)
+	if payload.ClientId, index, err = utils.DecodeMqttString(buf, index); err != nil {
+		return nil, message.WrapStringError(message.CONNECT, "MQTT-3.1.3-3", err)
+	}
 
 	// 遗嘱消息
 	if connVariableHeader.WillFlag {
-		payload.WillTopic, index = utils.DecodeMqttString(buf, index)
-		payload.WillMessage, index = utils.DecodeMqttBytes(buf, index)
+		if payload.WillTopic, index, err = utils.DecodeMqttString(buf, index); err != nil {
+			return nil, message.WrapStringError(message.CONNECT, "MQTT-3.1.2-9", err)
+		}
+		if payload.WillMessage, index, err = utils.DecodeMqttBytes(buf, index); err != nil {
+			return nil, message.WrapProtocolError(message.CONNECT, "MQTT-3.1.2-9", err)
+		}
+
+		// 遗嘱消息在连接存续期间一直持有, 不能引用报文缓冲
+		payload.WillMessage = append([]byte(nil), payload.WillMessage...)
 	}
 
 	// 用户名/密码
 	if connVariableHeader.UsernameFlag {
-		payload.Username, index = utils.DecodeMqttString(buf, index)
+		if payload.Username, index, err = utils.DecodeMqttString(buf, index); err != nil {
+			return nil, message.WrapStringError(message.CONNECT, "MQTT-3.1.2-19", err)
+		}
 	}
+	// 密码为二进制数据, 不校验 UTF-8
 	if connVariableHeader.PasswordFlag {
-		payload.Password, index = utils.DecodeMqttString(buf, index)
+		var password []byte
+		if password, index, err = utils.DecodeMqttBytes(buf, index); err != nil {
+			return nil, message.WrapProtocolError(message.CONNECT, "MQTT-3.1.2-21", err)
+		}
+		payload.Password = string(password)
 	}
 
-	return payload
-
+	return payload, nil
 }
@@ -4,11 +4,14 @@ import (
 	"fmt"
 	"mqtt-go/src/message"
 	"mqtt-go/src/utils"
+	"time"
 )
 
 func Encode(msg *message.MqttMessage) []byte {
 	fixedHeader := msg.FixedHeader
 	switch fixedHeader.MessageType {
+	case message.CONNECT:
+		return encodeConnect(msg)
 	case message.CONNACK:
 		return encodeConnAck(msg)
 	case message.PUBLISH:
@@ -24,15 +27,67 @@ func Encode(msg *message.MqttMessage) []byte {
 	case message.PUBCOMP:
 		variableHeader := msg.VariableHeader.(*message.MqttMessageIdVariableHeader)
 		return encodeMessageIdButNoPayload(fixedHeader.MessageType, variableHeader.MessageId)
+	case message.SUBSCRIBE:
+		return encodeSubscribe(msg)
 	case message.SUBACK:
 		return encodeSubAck(msg)
+	case message.UNSUBSCRIBE:
+		return encodeUnsubscribe(msg)
+	case message.PINGREQ:
+		fallthrough
 	case message.PINGRESP:
+		fallthrough
+	case message.DISCONNECT:
 		buf := make([]byte, 2)
 		buf[0] = fixedHeader.MessageType << 4
 		return buf
 	default:
-		panic(fmt.Sprintf("无法解码的消息类别: %d", fixedHeader.MessageType))
+		panic(fmt.Sprintf("无法编码的消息类别: %d", fixedHeader.MessageType))
+	}
+}
+
+func encodeConnect(msg *message.MqttMessage) []byte {
+	variableHeader := msg.VariableHeader.(*message.MqttConnVariableHeader)
+	payload := msg.Payload.(*message.MqttConnPayload)
+
+	// 可变头: 协议名, 协议级别, 连接标志, 心跳
+	body := make([]byte, 0, 10+2+len(payload.ClientId))
+	body = appendMqttString(body, "MQTT")
+	body = append(body, 4)
+
+	var connectFlags byte
+	if variableHeader.CleanSession {
+		connectFlags |= 0b10
+	}
+	if variableHeader.WillFlag {
+		connectFlags |= 0b100 | variableHeader.WillQos<<3
+		if variableHeader.WillRetain {
+			connectFlags |= 0b10_0000
+		}
+	}
+	if variableHeader.PasswordFlag {
+		connectFlags |= 0x40
 	}
+	if variableHeader.UsernameFlag {
+		connectFlags |= 0x80
+	}
+	keepAlive := uint16(variableHeader.KeepAlive / time.Second)
+	body = append(body, connectFlags, byte(keepAlive>>8), byte(keepAlive))
+
+	// payload
+	body = appendMqttString(body, payload.ClientId)
+	if variableHeader.WillFlag {
+		body = appendMqttString(body, payload.WillTopic)
+		body = appendMqttBytes(body, payload.WillMessage)
+	}
+	if variableHeader.UsernameFlag {
+		body = appendMqttString(body, payload.Username)
+	}
+	if variableHeader.PasswordFlag {
+		body = appendMqttString(body, payload.Password)
+	}
+
+	return appendFixedHeader(message.CONNECT<<4, body)
 }
 
 func encodeConnAck(msg *message.MqttMessage) []byte {
@@ -109,9 +164,62 @@ func encodeSubAck(msg *message.MqttMessage) []byte {
 	return buf
 }
 
+func encodeSubscribe(msg *message.MqttMessage) []byte {
+	variableHeader := msg.VariableHeader.(*message.MqttMessageIdVariableHeader)
+	payload := msg.Payload.(*message.MqttSubscribePayload)
+
+	body := make([]byte, 2, 64)
+	body[0], body[1] = byte(variableHeader.MessageId>>8), byte(variableHeader.MessageId)
+	for _, topic := range payload.Topics {
+		body = appendMqttString(body, topic.Name)
+		body = append(body, topic.Qos)
+	}
+
+	// SUBSCRIBE 固定头保留位为 0010 [MQTT-3.8.1-1]
+	return appendFixedHeader(message.SUBSCRIBE<<4|0b0010, body)
+}
+
+func encodeUnsubscribe(msg *message.MqttMessage) []byte {
+	variableHeader := msg.VariableHeader.(*message.MqttMessageIdVariableHeader)
+	topics := msg.Payload.([]string)
+
+	body := make([]byte, 2, 64)
+	body[0], body[1] = byte(variableHeader.MessageId>>8), byte(variableHeader.MessageId)
+	for _, topic := range topics {
+		body = appendMqttString(body, topic)
+	}
+
+	// UNSUBSCRIBE 固定头保留位为 0010 [MQTT-3.10.1-1]
+	return appendFixedHeader(message.UNSUBSCRIBE<<4|0b0010, body)
+}
+
+// 拼接固定头及报文体
+func appendFixedHeader(header byte, body []byte) []byte {
+	lenBuf := utils.EncodeRemainLength(len(body))
+	buf := make([]byte, 1, 1+len(lenBuf)+len(body))
+	buf[0] = header
+	buf = append(buf, lenBuf...)
+	return append(buf, body...)
+}
+
+// 追加 2 字节长度前缀的字符串
+func appendMqttString(buf []byte, s string) []byte {
+	buf = append(buf, byte(len(s)>>8), byte(len(s)))
+	return append(buf, s...)
+}
+
+func appendMqttBytes(buf []byte, b []byte) []byte {
+	buf = append(buf, byte(len(b)>>8), byte(len(b)))
+	return append(buf, b...)
+}
+
 func encodeMessageIdButNoPayload(messageType byte, messageId uint16) []byte {
 	buf := make([]byte, 4, 4)
 	buf[0] = messageType << 4
+	if messageType == message.PUBREL {
+		// PUBREL 固定头保留位为 0010 [MQTT-3.6.1-1]
+		buf[0] |= 0b0010
+	}
 	buf[1] = 2
 	buf[2] = byte(messageId >> 8)
 	buf[3] = byte(messageId)
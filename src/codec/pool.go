@@ -0,0 +1,51 @@
+package codec
+
+import "sync"
+
+const (
+	// 最小的缓冲规格
+	minPooledSize = 64
+
+	// 池化的规格数, 最大规格为 minPooledSize << (pooledClasses-1) 即 1MB
+	pooledClasses = 15
+)
+
+// 池化的报文体缓冲
+type pooledBuf struct {
+	b     []byte
+	class int
+}
+
+// 归还缓冲
+func (this *pooledBuf) Release() {
+	bufPools[this.class].Put(this)
+}
+
+// 按 2 的幂分级的缓冲池
+var bufPools [pooledClasses]sync.Pool
+
+func init() {
+	for i := range bufPools {
+		class := i
+		bufPools[i].New = func() interface{} {
+			return &pooledBuf{
+				b:     make([]byte, minPooledSize<<class),
+				class: class,
+			}
+		}
+	}
+}
+
+// 获取长度为 n 的缓冲, 超出最大规格时直接分配, 此时返回的 *pooledBuf 为 nil
+func getBuf(n int) ([]byte, *pooledBuf) {
+	class := 0
+	for minPooledSize<<class < n {
+		class++
+		if class == pooledClasses {
+			return make([]byte, n), nil
+		}
+	}
+
+	p := bufPools[class].Get().(*pooledBuf)
+	return p.b[:n], p
+}
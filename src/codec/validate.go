@@ -0,0 +1,112 @@
+package codec
+
+import (
+	"fmt"
+	"mqtt-go/src/message"
+	"mqtt-go/src/utils"
+	"strings"
+)
+
+// 校验固定头标志位.
+// Where a flag bit is marked as "Reserved", it is reserved for future use and MUST be set to the
+// value listed in that table [MQTT-2.2.2-1]. If invalid flags are received, the receiver MUST close
+// the Network Connection [MQTT-2.2.2-2].
+func checkFlags(header byte) error {
+	packetType, flags := header>>4, header&0x0f
+	switch packetType {
+	case message.PUBLISH:
+		qos := (flags & 0b0110) >> 1
+
+		// A PUBLISH Packet MUST NOT have both QoS bits set to 1 [MQTT-3.3.1-4].
+		if qos == 3 {
+			return message.NewProtocolError(packetType, "MQTT-3.3.1-4", "非法的 Qos:3")
+		}
+
+		// The DUP flag MUST be set to 0 for all QoS 0 messages [MQTT-3.3.1-2].
+		if qos == 0 && flags&0b1000 != 0 {
+			return message.NewProtocolError(packetType, "MQTT-3.3.1-2", "qos0 消息的 dup 须为 0")
+		}
+		return nil
+	case message.PUBREL, message.SUBSCRIBE, message.UNSUBSCRIBE:
+		// Bits 3,2,1 and 0 of the fixed header of the PUBREL/SUBSCRIBE/UNSUBSCRIBE Control Packet
+		// are reserved and MUST be set to 0,0,1 and 0 respectively [MQTT-3.6.1-1] [MQTT-3.8.1-1] [MQTT-3.10.1-1].
+		if flags != 0b0010 {
+			return message.NewProtocolError(packetType, flagsRef[packetType], fmt.Sprintf("固定头保留位 %04b, 应为 0010", flags))
+		}
+		return nil
+	case 0, 15:
+		return message.NewProtocolError(packetType, "MQTT-2.2.1", "非法的报文类型")
+	default:
+		if flags != 0 {
+			return message.NewProtocolError(packetType, "MQTT-2.2.2-1", fmt.Sprintf("固定头保留位 %04b, 应为 0000", flags))
+		}
+		return nil
+	}
+}
+
+// 固定头保留位为 0010 的报文对应的规范条目
+var flagsRef = map[byte]string{
+	message.PUBREL:      "MQTT-3.6.1-1",
+	message.SUBSCRIBE:   "MQTT-3.8.1-1",
+	message.UNSUBSCRIBE: "MQTT-3.10.1-1",
+}
+
+// 校验发布主题
+func checkTopicName(packetType byte, topic string) error {
+	// All Topic Names and Topic Filters MUST be at least one character long [MQTT-4.7.3-1].
+	if topic == "" {
+		return message.NewProtocolError(packetType, "MQTT-4.7.3-1", "主题为空")
+	}
+
+	// The Topic Name in the PUBLISH Packet MUST NOT contain wildcard characters [MQTT-3.3.2-2].
+	if strings.ContainsAny(topic, "+#") {
+		return message.NewProtocolError(packetType, "MQTT-3.3.2-2", fmt.Sprintf("主题包含通配符: %s", topic))
+	}
+	return nil
+}
+
+// 校验主题过滤器
+func checkTopicFilter(packetType byte, filter string) error {
+	if filter == "" {
+		return message.NewProtocolError(packetType, "MQTT-4.7.3-1", "主题过滤器为空")
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		// The multi-level wildcard character MUST be specified either on its own or following a
+		// topic level separator. In either case it MUST be the last character specified in the
+		// Topic Filter [MQTT-4.7.1-2].
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return message.NewProtocolError(packetType, "MQTT-4.7.1-2", fmt.Sprintf("非法的主题过滤器: %s", filter))
+		}
+
+		// The single-level wildcard can be used at any level in the Topic Filter, including first
+		// and last levels. Where it is used it MUST occupy an entire level of the filter [MQTT-4.7.1-3].
+		if strings.Contains(level, "+") && level != "+" {
+			return message.NewProtocolError(packetType, "MQTT-4.7.1-3", fmt.Sprintf("非法的主题过滤器: %s", filter))
+		}
+	}
+	return nil
+}
+
+// 校验发布主题, 规则及长度、层级限制与解码 PUBLISH 时相同, 供 HTTP 发布等非报文来源使用
+func ValidateTopicName(topic string) error {
+	if err := utils.CheckMqttString([]byte(topic)); err != nil {
+		return message.WrapStringError(message.PUBLISH, "", err)
+	}
+	if err := checkTopicName(message.PUBLISH, topic); err != nil {
+		return err
+	}
+	return DecodeLimits.checkTopic(message.PUBLISH, topic)
+}
+
+// 校验主题过滤器, 规则及长度、层级限制与解码 SUBSCRIBE 时相同
+func ValidateTopicFilter(filter string) error {
+	if err := utils.CheckMqttString([]byte(filter)); err != nil {
+		return message.WrapStringError(message.SUBSCRIBE, "", err)
+	}
+	if err := checkTopicFilter(message.SUBSCRIBE, filter); err != nil {
+		return err
+	}
+	return DecodeLimits.checkTopic(message.SUBSCRIBE, filter)
+}
@@ -0,0 +1,77 @@
+package codec
+
+import (
+	"errors"
+	"mqtt-go/src/message"
+	"strings"
+	"testing"
+)
+
+func TestStrictValidation(t *testing.T) {
+	connect := func(flags byte, payload ...byte) []byte {
+		return frame(0x10, append([]byte{0, 4, 'M', 'Q', 'T', 'T', 4, flags, 0, 60}, payload...))
+	}
+	cases := []struct {
+		name string
+		data []byte
+		ref  string
+	}{
+		{"保留报文类型", frame(0xf0, nil), "MQTT-2.2.1"},
+		{"PINGREQ 保留位", frame(0xc1, nil), "MQTT-2.2.2-1"},
+		{"CONNECT 保留位", frame(0x18, nil), "MQTT-2.2.2-1"},
+		{"PUBREL 保留位", frame(0x60, []byte{0, 1}), "MQTT-3.6.1-1"},
+		{"SUBSCRIBE 保留位", frame(0x80, []byte{0, 1, 0, 1, 'a', 0}), "MQTT-3.8.1-1"},
+		{"UNSUBSCRIBE 保留位", frame(0xa0, []byte{0, 1, 0, 1, 'a'}), "MQTT-3.10.1-1"},
+		{"PUBLISH qos3", frame(0x36, []byte{0, 1, 'a', 0, 1}), "MQTT-3.3.1-4"},
+		{"PUBLISH qos0 dup", frame(0x38, []byte{0, 1, 'a'}), "MQTT-3.3.1-2"},
+		{"PUBLISH 通配符", frame(0x30, []byte{0, 3, 'a', '/', '+'}), "MQTT-3.3.2-2"},
+		{"PUBLISH 空主题", frame(0x30, []byte{0, 0}), "MQTT-4.7.3-1"},
+		{"PUBLISH 非法 UTF-8", frame(0x30, []byte{0, 2, 0xc3, 0x28}), "MQTT-1.5.3-1"},
+		{"PUBLISH 代理项", frame(0x30, []byte{0, 3, 0xed, 0xa0, 0x80}), "MQTT-1.5.3-1"},
+		{"PUBLISH U+0000", frame(0x30, []byte{0, 2, 'a', 0}), "MQTT-1.5.3-2"},
+		{"SUBSCRIBE 过滤器 #", frame(0x82, []byte{0, 1, 0, 3, '#', '/', 'a', 0}), "MQTT-4.7.1-2"},
+		{"SUBSCRIBE 过滤器 +", frame(0x82, []byte{0, 1, 0, 2, 'a', '+', 0}), "MQTT-4.7.1-3"},
+		{"UNSUBSCRIBE 空过滤器", frame(0xa2, []byte{0, 1, 0, 0, 0, 1, 'a'}), "MQTT-4.7.3-1"},
+		{"CONNECT clientId U+0000", connect(0b10, 0, 1, 0), "MQTT-1.5.3-2"},
+		{"CONNECT 遗嘱 qos3", connect(0b11110, 0, 1, 'c'), "MQTT-3.1.2-14"},
+		{"CONNECT 无遗嘱 retain", connect(0b100010, 0, 1, 'c'), "MQTT-3.1.2-13"},
+		{"CONNECT 仅密码", connect(0b1000010, 0, 1, 'c', 0, 1, 'p'), "MQTT-3.1.2-22"},
+		{"CONNECT 遗嘱主题通配符", connect(0b110, 0, 1, 'c', 0, 1, '#', 0, 0), "MQTT-3.3.2-2"},
+	}
+	for _, c := range cases {
+		_, _, err := Decode(c.data)
+		var protocolErr *message.ProtocolError
+		if !errors.As(err, &protocolErr) || protocolErr.Ref != c.ref {
+			t.Errorf("%s: %v, 应为 %s", c.name, err, c.ref)
+		}
+	}
+
+	// 密码为二进制数据
+	if _, _, err := Decode(connect(0b11000010, 0, 1, 'c', 0, 1, 'u', 0, 2, 0xff, 0)); err != nil {
+		t.Errorf("二进制密码: %v", err)
+	}
+}
+
+func TestValidateTopic(t *testing.T) {
+	for _, topic := range []string{"a", "a/b", "$SYS/x", "/"} {
+		if err := ValidateTopicName(topic); err != nil {
+			t.Errorf("%q: %v", topic, err)
+		}
+	}
+	for _, topic := range []string{"", "a/+", "#", "a\x00", "\xc3\x28", strings.Repeat("a/", 40)} {
+		if err := ValidateTopicName(topic); err == nil {
+			t.Errorf("应拒绝发布主题 %q", topic)
+		}
+	}
+
+	for _, filter := range []string{"a", "+", "#", "a/+/b", "a/#", "+/+"} {
+		if err := ValidateTopicFilter(filter); err != nil {
+			t.Errorf("%q: %v", filter, err)
+		}
+	}
+	for _, filter := range []string{"", "a#", "a/#/b", "+x", "a\x00", "\xc3\x28"} {
+		if err := ValidateTopicFilter(filter); err == nil {
+			t.Errorf("应拒绝主题过滤器 %q", filter)
+		}
+	}
+}
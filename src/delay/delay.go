@@ -0,0 +1,205 @@
+// 延迟发布, 发布到 $delayed/{seconds}/{topic} 的消息在 seconds 秒后投递到 topic
+
+package delay
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"mqtt-go/src/persist"
+	"mqtt-go/src/timewheel"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 延迟主题前缀
+const Prefix = "$delayed/"
+
+// 解析延迟主题, 返回延迟时长及实际投递主题
+func Parse(topic string) (time.Duration, string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(topic, Prefix), "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return 0, "", errors.New(fmt.Sprintf("非法的延迟主题: %s", topic))
+	}
+
+	seconds, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return 0, "", errors.New(fmt.Sprintf("非法的延迟时间: %s", topic))
+	}
+
+	return time.Duration(seconds) * time.Second, parts[1], nil
+}
+
+// 待投递的延迟消息
+type Message struct {
+	Id      uint64    `json:"id"`
+	Topic   string    `json:"topic"`
+	Qos     byte      `json:"qos"`
+	Retain  bool      `json:"retain"`
+	Payload []byte    `json:"payload"`
+	Deliver time.Time `json:"deliver"`
+}
+
+// 延迟消息存储, persist.Persistence 即为其实现
+type Store interface {
+	SaveDelayed(d *persist.Delayed) error
+	DeleteDelayed(id uint64) error
+	AllDelayed() []*persist.Delayed
+}
+
+type entry struct {
+	msg   *Message
+	timer *timewheel.Timer
+}
+
+// 延迟消息调度器
+type Scheduler struct {
+	lock sync.Mutex
+
+	// 消息 id 序列
+	seq uint64
+
+	// id <--> 待投递消息
+	pending map[uint64]*entry
+
+	// 持久化存储, 为 nil 则不持久化
+	store Store
+
+	// 到期投递
+	publish func(msg *Message)
+}
+
+// 构建调度器, 消息到期后交由 publish 投递
+func NewScheduler(publish func(msg *Message)) *Scheduler {
+	return &Scheduler{
+		pending: make(map[uint64]*entry),
+		publish: publish,
+	}
+}
+
+// 启用持久化, 并恢复存储中尚未投递的消息(已过期的消息立即投递)
+func (this *Scheduler) Load(store Store) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.store = store
+	delayed := store.AllDelayed()
+	for _, d := range delayed {
+		if d.Id > this.seq {
+			this.seq = d.Id
+		}
+		this.add(&Message{
+			Id:      d.Id,
+			Topic:   d.Msg.Topic,
+			Qos:     d.Msg.Qos,
+			Retain:  d.Msg.Retain,
+			Payload: d.Msg.Payload,
+			Deliver: d.Deliver,
+		})
+	}
+	log.Printf("恢复延迟消息 %d 条\n", len(delayed))
+
+	return nil
+}
+
+// 调度一条延迟消息, payload 会被复制. 持久化失败时不调度
+func (this *Scheduler) Schedule(topic string, qos byte, retain bool, payload []byte, delay time.Duration) (*Message, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	msg := &Message{
+		Id:      this.seq + 1,
+		Topic:   topic,
+		Qos:     qos,
+		Retain:  retain,
+		Payload: append([]byte(nil), payload...),
+		Deliver: time.Now().Add(delay),
+	}
+	if this.store != nil {
+		err := this.store.SaveDelayed(&persist.Delayed{
+			Id:      msg.Id,
+			Deliver: msg.Deliver,
+			Msg:     &persist.Message{Topic: topic, Qos: qos, Retain: retain, Payload: msg.Payload},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	this.seq++
+	this.add(msg)
+
+	return msg, nil
+}
+
+// 取消尚未投递的消息
+func (this *Scheduler) Cancel(id uint64) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	e, ok := this.pending[id]
+	if !ok {
+		return false
+	}
+	e.timer.Stop()
+	delete(this.pending, id)
+	this.remove(id)
+
+	return true
+}
+
+// 返回全部待投递消息, 按投递时间排序
+func (this *Scheduler) List() []*Message {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	msgs := make([]*Message, 0, len(this.pending))
+	for _, e := range this.pending {
+		msgs = append(msgs, e.msg)
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		if msgs[i].Deliver.Equal(msgs[j].Deliver) {
+			return msgs[i].Id < msgs[j].Id
+		}
+		return msgs[i].Deliver.Before(msgs[j].Deliver)
+	})
+
+	return msgs
+}
+
+func (this *Scheduler) add(msg *Message) {
+	id := msg.Id
+
+	// 投递涉及文件写入及消息分发, 不在时间轮 goroutine 中执行
+	this.pending[id] = &entry{
+		msg:   msg,
+		timer: timewheel.Default.AfterFunc(time.Until(msg.Deliver), func() { go this.fire(id) }),
+	}
+}
+
+func (this *Scheduler) fire(id uint64) {
+	this.lock.Lock()
+	e, ok := this.pending[id]
+	if ok {
+		delete(this.pending, id)
+	}
+	this.lock.Unlock()
+
+	// 投递之后再移除, 期间崩溃的消息重启后重复投递
+	if ok {
+		this.publish(e.msg)
+		this.remove(id)
+	}
+}
+
+// 从存储中移除
+func (this *Scheduler) remove(id uint64) {
+	if this.store == nil {
+		return
+	}
+	if err := this.store.DeleteDelayed(id); err != nil {
+		log.Printf("延迟消息[%d]持久化失败: %v\n", id, err)
+	}
+}
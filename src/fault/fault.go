@@ -0,0 +1,325 @@
+// 故障注入: 包装 net.Conn, 注入延迟、带宽限制、读写分片、随机断开及卡顿, 用于测试 broker 及客户端在劣质网络下的表现.
+// 随机数由 seed 决定, 同一 seed 下每次读写注入的故障相同, 失败的用例可按日志中的 seed 复现
+
+package fault
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 注入的连接断开
+var ErrDisconnect = errors.New("故障注入: 连接断开")
+
+// 故障配置, 零值为不注入故障
+type Config struct {
+	// 随机数种子, 为 0 且 SeedSet 为 false 时按当前时间生成
+	Seed int64
+
+	// 已指定种子, 此时种子 0 同样按原值使用
+	SeedSet bool
+
+	// 每次读写前的延迟, 实际延迟为 Latency 加上 [0, Jitter) 内的随机值
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// 每个方向每秒字节数, 0 为不限制
+	Bandwidth int
+
+	// 单次读取最多返回的字节数, 实际为 [1, ReadChunk] 内的随机值, 0 为不限制
+	ReadChunk int
+
+	// 写入按 [1, WriteChunk] 内的随机长度分片写出, 0 为不分片
+	WriteChunk int
+
+	// 每次读写断开连接的概率
+	Disconnect float64
+
+	// 每次读写卡顿的概率及卡顿时长
+	Stall     float64
+	StallTime time.Duration
+}
+
+// 解析故障配置, 格式:
+//
+//	seed=1,latency=50ms,jitter=20ms,bandwidth=10240,read-chunk=3,write-chunk=3,disconnect=0.001,stall=0.01,stall-time=2s
+//
+// 未指定的项为零值
+func ParseConfig(s string) (Config, error) {
+	var config Config
+	if s == "" {
+		return config, nil
+	}
+
+	for _, item := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(kv) != 2 {
+			return config, errors.New(fmt.Sprintf("非法的故障配置: %s", item))
+		}
+
+		var err error
+		switch kv[0] {
+		case "seed":
+			config.Seed, err = strconv.ParseInt(kv[1], 10, 64)
+			config.SeedSet = true
+		case "latency":
+			config.Latency, err = time.ParseDuration(kv[1])
+		case "jitter":
+			config.Jitter, err = time.ParseDuration(kv[1])
+		case "bandwidth":
+			config.Bandwidth, err = strconv.Atoi(kv[1])
+		case "read-chunk":
+			config.ReadChunk, err = strconv.Atoi(kv[1])
+		case "write-chunk":
+			config.WriteChunk, err = strconv.Atoi(kv[1])
+		case "disconnect":
+			config.Disconnect, err = parseProbability(kv[1])
+		case "stall":
+			config.Stall, err = parseProbability(kv[1])
+		case "stall-time":
+			config.StallTime, err = time.ParseDuration(kv[1])
+		default:
+			return config, errors.New(fmt.Sprintf("未知的故障配置项: %s", kv[0]))
+		}
+		if err != nil {
+			return config, errors.New(fmt.Sprintf("非法的故障配置 %s: %v", kv[0], err))
+		}
+	}
+
+	if config.Latency < 0 || config.Jitter < 0 || config.StallTime < 0 || config.Bandwidth < 0 || config.ReadChunk < 0 || config.WriteChunk < 0 {
+		return config, errors.New(fmt.Sprintf("非法的故障配置: %s", s))
+	}
+	return config, nil
+}
+
+func parseProbability(s string) (float64, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if v < 0 || v > 1 {
+		return 0, errors.New("概率须在 [0, 1] 之内")
+	}
+	return v, nil
+}
+
+// 单个方向的状态, 读写各自使用独立的随机数, 注入的故障不受读写交错的影响
+type direction struct {
+	rand *rand.Rand
+
+	// 读写超时
+	deadline time.Time
+
+	// 带宽限制下, 下一次读写的最早时间
+	next time.Time
+}
+
+// 注入故障的连接. 包装后不再实现 syscall.Conn, epoll 模式下按 goroutine 模式处理
+type Conn struct {
+	net.Conn
+
+	config Config
+	seed   int64
+
+	lock        sync.Mutex
+	read, write direction
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// 包装连接
+func Wrap(conn net.Conn, config Config) *Conn {
+	seed := config.Seed
+	if seed == 0 && !config.SeedSet {
+		seed = time.Now().UnixNano()
+	}
+	return &Conn{
+		Conn:   conn,
+		config: config,
+		seed:   seed,
+		read:   direction{rand: rand.New(rand.NewSource(seed))},
+		write:  direction{rand: rand.New(rand.NewSource(^seed))},
+		closed: make(chan struct{}),
+	}
+}
+
+// 随机数种子, 以同一配置及种子包装即可复现
+func (this *Conn) Seed() int64 {
+	return this.seed
+}
+
+func (this *Conn) Read(b []byte) (int, error) {
+	if err := this.inject(&this.read); err != nil {
+		return 0, err
+	}
+	if n := this.chunk(&this.read, this.config.ReadChunk); n > 0 && n < len(b) {
+		b = b[:n]
+	}
+	n, err := this.Conn.Read(b)
+	this.account(&this.read, n)
+	return n, err
+}
+
+// 按配置分片写出, 每个分片均注入故障
+func (this *Conn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		if err := this.inject(&this.write); err != nil {
+			return written, err
+		}
+		n := len(b)
+		if c := this.chunk(&this.write, this.config.WriteChunk); c > 0 && c < n {
+			n = c
+		}
+		m, err := this.Conn.Write(b[:n])
+		written += m
+		this.account(&this.write, m)
+		if err != nil {
+			return written, err
+		}
+		b = b[m:]
+	}
+	return written, nil
+}
+
+func (this *Conn) Close() error {
+	this.closeOnce.Do(func() { close(this.closed) })
+	return this.Conn.Close()
+}
+
+func (this *Conn) SetDeadline(t time.Time) error {
+	this.lock.Lock()
+	this.read.deadline, this.write.deadline = t, t
+	this.lock.Unlock()
+	return this.Conn.SetDeadline(t)
+}
+
+func (this *Conn) SetReadDeadline(t time.Time) error {
+	this.lock.Lock()
+	this.read.deadline = t
+	this.lock.Unlock()
+	return this.Conn.SetReadDeadline(t)
+}
+
+func (this *Conn) SetWriteDeadline(t time.Time) error {
+	this.lock.Lock()
+	this.write.deadline = t
+	this.lock.Unlock()
+	return this.Conn.SetWriteDeadline(t)
+}
+
+// 读写之前按配置断开连接或等待, 等待超过读写超时时返回超时错误
+func (this *Conn) inject(d *direction) error {
+	this.lock.Lock()
+	disconnect := this.config.Disconnect > 0 && d.rand.Float64() < this.config.Disconnect
+	stall := this.config.Stall > 0 && d.rand.Float64() < this.config.Stall
+	wait := this.config.Latency
+	if this.config.Jitter > 0 {
+		wait += time.Duration(d.rand.Int63n(int64(this.config.Jitter)))
+	}
+	if stall {
+		wait += this.config.StallTime
+	}
+	until, deadline := time.Now().Add(wait), d.deadline
+	if d.next.After(until) {
+		until = d.next
+	}
+	this.lock.Unlock()
+
+	if disconnect {
+		this.Close()
+		return ErrDisconnect
+	}
+
+	timeout := false
+	if !deadline.IsZero() && deadline.Before(until) {
+		until, timeout = deadline, true
+	}
+	if wait := time.Until(until); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-this.closed:
+			// 由底层连接返回已关闭的错误
+			return nil
+		}
+	}
+	if timeout {
+		return timeoutError{}
+	}
+	return nil
+}
+
+// 随机分片长度, max 为 0 时不分片
+func (this *Conn) chunk(d *direction, max int) int {
+	if max <= 0 {
+		return 0
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return 1 + d.rand.Intn(max)
+}
+
+// 按带宽计算下一次读写的最早时间
+func (this *Conn) account(d *direction, n int) {
+	if this.config.Bandwidth <= 0 || n <= 0 {
+		return
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	start := time.Now()
+	if d.next.After(start) {
+		start = d.next
+	}
+	d.next = start.Add(time.Duration(n) * time.Second / time.Duration(this.config.Bandwidth))
+}
+
+// 等待超过读写超时
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "故障注入: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// 注入故障的监听器, 第 n 个连接的种子为基础种子加 n
+type Listener struct {
+	net.Listener
+
+	config Config
+	seq    int64
+}
+
+// 包装监听器, 未指定种子时按当前时间生成基础种子
+func NewListener(l net.Listener, config Config) *Listener {
+	if config.Seed == 0 && !config.SeedSet {
+		config.Seed = time.Now().UnixNano()
+	}
+	// 基础种子加 n 可能为 0, 须按原值使用
+	config.SeedSet = true
+	log.Printf("故障注入监听: %s, 基础种子: %d", l.Addr().String(), config.Seed)
+	return &Listener{Listener: l, config: config}
+}
+
+func (this *Listener) Accept() (net.Conn, error) {
+	conn, err := this.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	config := this.config
+	config.Seed += atomic.AddInt64(&this.seq, 1) - 1
+	log.Printf("故障注入连接 [%s] 种子: %d", conn.RemoteAddr().String(), config.Seed)
+	return Wrap(conn, config), nil
+}
@@ -0,0 +1,161 @@
+package fault
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig("seed=7,latency=50ms,jitter=20ms,bandwidth=1024,read-chunk=3,write-chunk=2,disconnect=0.01,stall=0.1,stall-time=2s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Config{Seed: 7, SeedSet: true, Latency: 50 * time.Millisecond, Jitter: 20 * time.Millisecond, Bandwidth: 1024,
+		ReadChunk: 3, WriteChunk: 2, Disconnect: 0.01, Stall: 0.1, StallTime: 2 * time.Second}
+	if config != want {
+		t.Fatalf("解析结果: %+v", config)
+	}
+
+	for _, s := range []string{"latency", "disconnect=2", "read-chunk=-1", "unknown=1"} {
+		if _, err := ParseConfig(s); err == nil {
+			t.Fatalf("应拒绝: %s", s)
+		}
+	}
+}
+
+// 读取 n 字节, 返回每次读取的长度
+func readSizes(t *testing.T, seed int64, n int) []int {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := Wrap(server, Config{Seed: seed, ReadChunk: 5})
+	defer conn.Close()
+
+	go client.Write(make([]byte, n))
+	var sizes []int
+	buf := make([]byte, 64)
+	for total := 0; total < n; {
+		m, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m < 1 || m > 5 {
+			t.Fatalf("读取长度: %d", m)
+		}
+		sizes = append(sizes, m)
+		total += m
+	}
+	return sizes
+}
+
+func TestReadChunk(t *testing.T) {
+	a, b := readSizes(t, 1, 100), readSizes(t, 1, 100)
+	if !reflect.DeepEqual(a, b) {
+		t.Fatalf("同一种子的读取长度不同: %v %v", a, b)
+	}
+	if c := readSizes(t, 2, 100); reflect.DeepEqual(a, c) {
+		t.Fatal("不同种子的读取长度相同")
+	}
+}
+
+func TestWriteChunk(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := Wrap(server, Config{Seed: 1, WriteChunk: 3})
+	defer conn.Close()
+
+	done := make(chan []int)
+	go func() {
+		var sizes []int
+		buf := make([]byte, 64)
+		for total := 0; total < 30; {
+			n, _ := client.Read(buf)
+			sizes = append(sizes, n)
+			total += n
+		}
+		done <- sizes
+	}()
+
+	if n, err := conn.Write(make([]byte, 30)); n != 30 || err != nil {
+		t.Fatalf("写入: %d %v", n, err)
+	}
+	for _, n := range <-done {
+		if n < 1 || n > 3 {
+			t.Fatalf("分片长度: %d", n)
+		}
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := Wrap(server, Config{Bandwidth: 1000})
+	defer conn.Close()
+	go io.Copy(ioutil.Discard, client)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		conn.Write(make([]byte, 50))
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("150 字节在 1000 字节/秒下耗时: %v", elapsed)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	client, server := net.Pipe()
+	conn := Wrap(server, Config{Disconnect: 1})
+
+	if _, err := conn.Read(make([]byte, 8)); err != ErrDisconnect {
+		t.Fatalf("读取: %v", err)
+	}
+	if _, err := client.Read(make([]byte, 8)); err != io.EOF {
+		t.Fatalf("对端读取: %v", err)
+	}
+}
+
+// 第 n 个连接的种子为基础种子加 n, 其中为 0 的种子同样按原值使用
+func TestListenerSeed(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fl := NewListener(l, Config{Seed: -1, SeedSet: true})
+	defer fl.Close()
+
+	for _, want := range []int64{-1, 0, 1} {
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := fl.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seed := conn.(*Conn).Seed(); seed != want {
+			t.Fatalf("种子: %d, 应为 %d", seed, want)
+		}
+		conn.Close()
+		client.Close()
+	}
+}
+
+func TestStallDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := Wrap(server, Config{Stall: 1, StallTime: time.Hour})
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	_, err := conn.Read(make([]byte, 8))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("读取: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("超时耗时: %v", elapsed)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"mqtt-go/src/channel"
 	"mqtt-go/src/message"
 	"sync"
+	"time"
 )
 
 var ChannelGroup = sync.Map{}
@@ -39,16 +40,48 @@ func ChannelActive(channel *channel.Channel) {
 func ChannelInactive(channel *channel.Channel) {
 	// 移除 channel
 	ChannelGroup.Delete(channel.Id)
-	ClientChannelMap.Delete(channel.ClientId())
+
+	// 未完成 CONNECT 的连接无会话
+	if !channel.Connected() {
+		return
+	}
+
+	// 未收到 DISCONNECT 的连接发布遗嘱 [MQTT-3.1.2-8]
+	publishWill(channel)
+
+	// 相同 clientId 的新连接可能已取代此连接, 仅移除仍指向自身的映射
+	clientId := channel.ClientId()
+	if value, ok := ClientChannelMap.Load(clientId); ok && value == channel.Id {
+		ClientChannelMap.Delete(clientId)
+		endSession(clientId, channel.CleanSession())
+	}
 }
 
-// 处理解包后的 message.MqttMessage
+// 处理解包后的 message.MqttMessage, 发布限流需暂停时阻塞当前 goroutine.
+// msg 可能引用池化缓冲, 返回后即被回收, 需要保留的数据须复制
 func ChannelRead(channel *channel.Channel, msg *message.MqttMessage) {
+	if wait := ChannelReadNoWait(channel, msg); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// 处理解包后的 message.MqttMessage, 不阻塞.
+// 发布限流需暂停时报文照常处理, 返回需暂停读取该连接的时长, 供事件循环模式使用
+func ChannelReadNoWait(channel *channel.Channel, msg *message.MqttMessage) time.Duration {
 	switch msg.FixedHeader.MessageType {
 	case message.CONNECT:
 		HandleConn(channel, msg)
 	case message.PUBLISH:
-		HandlePub(channel, msg)
+		ok, wait := allowPub(channel, msg)
+		if ok {
+			HandlePub(channel, msg)
+		}
+
+		// 暂停期间不读取报文, 不超过半个心跳周期, 避免限流中的客户端被判定心跳超时
+		if max := channel.Heartbeat() / 2; max > 0 && wait > max {
+			wait = max
+		}
+		return wait
 	case message.PUBACK:
 		HandlePubAck(channel, msg)
 	case message.PUBREC:
@@ -66,4 +99,5 @@ func ChannelRead(channel *channel.Channel, msg *message.MqttMessage) {
 	case message.DISCONNECT:
 		HandleDisconnect(channel, msg)
 	}
+	return 0
 }
@@ -1,11 +1,18 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"mqtt-go/src/channel"
+	"mqtt-go/src/codec"
+	"mqtt-go/src/delay"
+	"mqtt-go/src/limit"
 	"mqtt-go/src/message"
+	"mqtt-go/src/persist"
 	"mqtt-go/src/store"
+	"net"
+	"strings"
 	"sync"
 	"time"
 )
@@ -20,116 +27,318 @@ func HandleConn(channel *channel.Channel, msg *message.MqttMessage) {
 
 	// todo 认证
 
+	// 空 clientId: 清理会话时由服务端分配 [MQTT-3.1.3-6], 否则以 0x02 拒绝并断开 [MQTT-3.1.3-8]
+	clientId := payload.ClientId
+	if clientId == "" {
+		if !variableHeader.CleanSession {
+			log.Printf("连接[%s] clientId 为空且不清理会话, 拒绝连接\n", channel.Id)
+			rejectConn(channel, 2)
+			return
+		}
+		clientId = channel.Id
+	}
+
+	// 按 clientId 录制报文
+	if recorder := channel.Recorder(); recorder != nil {
+		recorder.Identify(clientId)
+	}
+
+	// 相同 clientId 的旧连接被取代 [MQTT-3.1.4-2]
+	takeOver(clientId)
+
 	// client 关联 channel
-	channel.SaveClientId(payload.ClientId)
+	channel.SaveClientId(clientId)
+	channel.SaveUsername(payload.Username)
+	channel.SaveCleanSession(variableHeader.CleanSession)
+
+	// 遗嘱消息, 连接非正常断开时发布
+	if variableHeader.WillFlag {
+		will := append([]byte(nil), payload.WillMessage...)
+		channel.SaveWill(message.BuildPublish(false, variableHeader.WillRetain, variableHeader.WillQos, payload.WillTopic, 0, will))
+	}
 
-	// 保存 client 与 channelId 的映射
-	ClientChannelMap.Store(payload.ClientId, channel.Id)
+	// 会话处理: 取消旧会话的过期, 清理会话丢弃旧订阅及消息
+	sessionPresent := openSession(clientId, variableHeader.CleanSession)
 
-	// keepalive
-	if v := float64(variableHeader.KeepAlive) * 1.5; v > 0 {
-		channel.Heartbeat = time.Duration(v)
+	// 发布限流
+	if limiter := limit.For(payload.Username); limiter != nil {
+		channel.SaveLimiter(limiter)
+	}
 
-		// 提醒心跳变更
-		channel.InputNotify <- channel.Heartbeat
+	// keepalive, 此后由心跳周期取代 CONNECT 超时
+	if v := float64(variableHeader.KeepAlive) * 1.5; v > 0 {
+		channel.SetHeartbeat(time.Duration(v))
 	}
 
-	connAck := message.BuildConnAck(false, 0)
+	// CONNACK 必须是服务端发送的第一个报文 [MQTT-3.2.0-1], 写出后才允许投递
+	connAck := message.BuildConnAck(sessionPresent, 0)
 	channel.Write(connAck)
 
-	// 由于 mqtt-go 不支持消息持久化，所以不存在补发消息的逻辑
+	// 保存 client 与 channelId 的映射
+	ClientChannelMap.Store(clientId, channel.Id)
+
+	// 补发未确认及离线消息
+	if sessionPresent {
+		resumeSession(channel)
+	}
 }
 
-// 处理 conn 报文
+// 以非 0 返回码的 CONNACK 拒绝连接并断开 [MQTT-3.2.2-5].
+// 关闭连接会丢弃写出队列, CONNACK 直接写出
+func rejectConn(channel *channel.Channel, code byte) {
+	if _, err := channel.Write0(net.Buffers{codec.Encode(message.BuildConnAck(false, code))}, time.Second); err != nil {
+		log.Printf("CONNACK 写入失败: %v\n", err)
+	}
+	if err := channel.Close(); err != nil {
+		log.Printf("连接关闭异常: %v\n", err)
+	}
+}
+
+// 断开 clientId 的在线连接, 丢弃其遗嘱.
+// 先移除映射, 旧连接断开时不再结束会话, 持久会话由新连接继续; 清理会话的订阅在此移除
+func takeOver(clientId string) {
+	old := findChannel(clientId)
+	if old == nil {
+		return
+	}
+	log.Printf("客户端[%s]在新连接上线, 断开旧连接[%s]\n", clientId, old.Id)
+
+	ClientChannelMap.Delete(clientId)
+	old.SaveWill(nil)
+	if old.CleanSession() {
+		store.Store.RemoveAllSub(clientId)
+	}
+	if err := old.Close(); err != nil {
+		log.Printf("连接关闭异常: %v\n", err)
+	}
+}
+
+// 处理 publish 报文
 func HandlePub(channel0 *channel.Channel, msg *message.MqttMessage) {
 	variableHeader := msg.VariableHeader.(*message.MqttPublishVaribleHeader)
 	payload := msg.Payload.([]byte)
 
 	log.Printf("消息id:%d topic: %s 内容:%s\n", variableHeader.MessageId, variableHeader.TopicName, msg.Payload)
-	clients := store.Store.Search(variableHeader.TopicName)
 
 	switch msg.FixedHeader.Qos {
 	case 0:
-		for _, clientSub := range clients {
-
-			// qos 处理
-			qos := clientSub.Qos
-			if qos > msg.FixedHeader.Qos {
-				qos = msg.FixedHeader.Qos
-			}
-
-			pubMsg := message.PubMsg{
-				Topic:          variableHeader.TopicName,
-				Qos:            qos,
-				SessionPresent: false,
-				Payload:        payload,
-			}
-
-			publish0(channel0, &pubMsg)
+		if err := Publish(variableHeader.TopicName, 0, msg.FixedHeader.Retain, payload); err != nil {
+			log.Printf("消息投递失败: %v\n", err)
 		}
 	case 1:
-		for _, clientSub := range clients {
-
-			// qos 处理
-			qos := clientSub.Qos
-			if qos > msg.FixedHeader.Qos {
-				qos = msg.FixedHeader.Qos
-			}
-
-			pubMsg := message.PubMsg{
-				Topic:          variableHeader.TopicName,
-				Qos:            qos,
-				SessionPresent: false,
-				Payload:        payload,
-			}
-
-			// 发布消息
-			publish0(channel0, &pubMsg)
+		// 未写入预写日志的消息不响应, 由发布方重发
+		if err := PublishDurable(variableHeader.TopicName, 1, msg.FixedHeader.Retain, payload); err != nil {
+			log.Printf("消息写入预写日志失败: %v\n", err)
+			return
 		}
 
 		ack := message.BuildPubAck(variableHeader.MessageId)
 		channel0.Write(ack)
-	case 2: // unsupported
+	case 2:
+		// 在收到 PUBREL 之前, 相同 messageId 的 PUBLISH 不再投递 [MQTT-4.3.3-2]
+		if !channel0.SavePubRel(variableHeader.MessageId) {
+			if err := PublishDurable(variableHeader.TopicName, 2, msg.FixedHeader.Retain, payload); err != nil {
+				log.Printf("消息写入预写日志失败: %v\n", err)
+				channel0.RemovePubRel(variableHeader.MessageId)
+				return
+			}
+		}
+
+		rec := message.BuildPubRec(variableHeader.MessageId)
+		channel0.Write(rec)
 	default:
 		panic(fmt.Sprintf("非法的 Qos:%d\n", msg.FixedHeader.Qos))
 	}
 }
 
-// 发布消息
-func publish0(channel0 *channel.Channel, msg *message.PubMsg) {
-	// search sub client list
-	clientSubs := store.Store.Search(msg.Topic)
-	for _, clientSub := range clientSubs {
-		clientId := clientSub.ClientId
-		value, ok := ClientChannelMap.Load(clientId)
-		var cc *channel.Channel
-		if !ok {
-			return
+// 延迟消息调度器
+var Delayed *delay.Scheduler
+
+func init() {
+	Delayed = delay.NewScheduler(func(msg *delay.Message) {
+		if err := Publish(msg.Topic, msg.Qos, msg.Retain, msg.Payload); err != nil {
+			log.Printf("延迟消息[%d]投递失败: %v\n", msg.Id, err)
 		}
-		if clientChannel, ok := ChannelGroup.Load(value); !ok {
-			return
+	})
+}
+
+// 先将 qos1/qos2 消息写入预写日志再投递, 返回错误表示未写入, 调用方不得响应发布方; 投递失败仅记录日志.
+// 投递完成前崩溃的消息在重启时由 Restore 重新投递
+func PublishDurable(topic string, qos byte, retain bool, payload []byte) error {
+	seq, err := Persistence.Accept(&persist.Message{
+		Topic:   topic,
+		Qos:     qos,
+		Retain:  retain,
+		Payload: append([]byte(nil), payload...),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := Publish(topic, qos, retain, payload); err != nil {
+		log.Printf("消息投递失败: %v\n", err)
+	}
+	logPersist(Persistence.Routed(seq))
+	return nil
+}
+
+// 将消息投递给全部订阅者, 客户端 PUBLISH 与 HTTP 发布接口共用此入口
+func Publish(topic string, qos byte, retain bool, payload []byte) error {
+	if qos > 2 {
+		return errors.New(fmt.Sprintf("非法的 Qos:%d", qos))
+	}
+
+	// 延迟消息, 到期后以实际主题重新进入此流程
+	if strings.HasPrefix(topic, delay.Prefix) {
+		d, target, err := delay.Parse(topic)
+		if err != nil {
+			return err
+		}
+		msg, err := Delayed.Schedule(target, qos, retain, payload, d)
+		if err != nil {
+			return err
+		}
+		log.Printf("延迟消息[%d] topic: %s 投递时间: %v\n", msg.Id, target, msg.Deliver)
+		return nil
+	}
+
+	// 保留消息, 空 payload 清除该主题的保留消息
+	if retain {
+		if len(payload) == 0 {
+			logPersist(Persistence.DeleteRetained(topic))
 		} else {
-			cc = clientChannel.(*channel.Channel)
+			logPersist(Persistence.SaveRetained(&persist.Message{
+				Topic:   topic,
+				Qos:     qos,
+				Retain:  true,
+				Payload: append([]byte(nil), payload...),
+			}))
 		}
+	}
 
-		var pubMsg *message.MqttMessage
-		switch msg.Qos {
-		case 0:
-			pubMsg = message.BuildPublish(false, false, 0, msg.Topic, 0, msg.Payload)
-		case 1:
-			messageId := cc.NextMessageId()
+	clients := store.Store.Search(topic)
+	if len(clients) == 0 {
+		return nil
+	}
+
+	// payload 仅复制一次, 各 qos 的报文头仅编码一次, 由全部订阅者共享
+	shared := codec.NewSharedPublish(topic, false, payload)
+	defer shared.Release()
+
+	// 持久会话需要保存的消息, 首次使用时复制 payload
+	var stored *persist.Message
+	template := func() persist.Message {
+		if stored == nil {
+			stored = &persist.Message{Topic: topic, Payload: append([]byte(nil), payload...)}
+		}
+		return *stored
+	}
+	for _, clientSub := range clients {
+
+		// qos 处理
+		subQos := clientSub.Qos
+		if subQos > qos {
+			subQos = qos
+		}
+
+		// 发布消息
+		publish0(shared, template, clientSub.ClientId, subQos)
+	}
 
-			// 构建 pubMsg
-			pubMsg = message.BuildPublish(false, false, msg.Qos, msg.Topic, channel0.NextMessageId(), msg.Payload)
+	return nil
+}
+
+// 发布限流, 返回 false 表示该报文不再处理; 超限动作为暂停时返回该连接需暂停读取的时长
+func allowPub(channel *channel.Channel, msg *message.MqttMessage) (bool, time.Duration) {
+	limiter := channel.Limiter()
+	if limiter == nil {
+		return true, 0
+	}
+
+	ok, action, wait := limiter.Reserve(msg.FixedHeader.RemainLength)
+	if ok {
+		return true, wait
+	}
+
+	switch action {
+	case limit.Drop:
+		// 丢弃的 qos1/qos2 消息仍需响应, 避免客户端重发; qos2 的 PUBREL 照常以 PUBCOMP 响应
+		switch msg.FixedHeader.Qos {
+		case 1:
+			variableHeader := msg.VariableHeader.(*message.MqttPublishVaribleHeader)
+			channel.Write(message.BuildPubAck(variableHeader.MessageId))
+		case 2:
+			variableHeader := msg.VariableHeader.(*message.MqttPublishVaribleHeader)
+			channel.Write(message.BuildPubRec(variableHeader.MessageId))
+		}
+	case limit.Disconnect:
+		log.Printf("客户端[%s]发布超限, 断开连接\n", channel.ClientId())
+		if err := channel.Close(); err != nil {
+			log.Printf("连接关闭异常: %v\n", err)
+		}
+	}
+	return false, 0
+}
 
-			// 保存 qos1/qos2 消息
-			channel0.SavePubMsg(messageId, msg)
-		case 2: // unsupported
-			panic("不支持 qos2 级别的消息")
+// 发布消息给单个订阅者.
+// 持久会话的 qos1/qos2 消息在发出前保存, 离线时进入离线队列, 重连后投递
+func publish0(shared *codec.SharedPublish, template func() persist.Message, clientId string, qos byte) {
+	cc := findChannel(clientId)
+	if cc == nil {
+		if qos > 0 && Persistence.HasSession(clientId) {
+			msg := template()
+			msg.Qos = qos
+			if err := Persistence.Enqueue(clientId, &msg); err != nil {
+				log.Printf("客户端[%s]离线消息入队失败: %v\n", clientId, err)
+			}
 		}
-		cc.Write(pubMsg)
+		return
+	}
+
+	if qos == 0 {
+		cc.WriteFrame(shared.Frame(0, 0))
+		return
 	}
 
+	messageId := cc.NextMessageId()
+	frame := shared.Frame(qos, messageId)
+	if !cc.CleanSession() {
+		msg := template()
+		msg.Id, msg.Qos = messageId, qos
+		logPersist(Persistence.SaveInflight(clientId, &msg))
+	}
+
+	// 保存 qos1/qos2 消息待确认, 与写出队列各持有一份引用
+	cc.SavePubMsg(messageId, frame.Retain())
+	cc.WriteFrame(frame)
+}
+
+// 发布遗嘱消息, 遗嘱仅发布一次 [MQTT-3.1.2-10]
+func publishWill(channel *channel.Channel) {
+	will := channel.Will()
+	if will == nil {
+		return
+	}
+	channel.SaveWill(nil)
+
+	variableHeader := will.VariableHeader.(*message.MqttPublishVaribleHeader)
+	log.Printf("客户端[%s]非正常断开, 发布遗嘱 topic: %s\n", channel.ClientId(), variableHeader.TopicName)
+	if err := Publish(variableHeader.TopicName, will.FixedHeader.Qos, will.FixedHeader.Retain, will.Payload.([]byte)); err != nil {
+		log.Printf("遗嘱消息投递失败: %v\n", err)
+	}
+}
+
+// 查找 client 当前的连接, 不在线时返回 nil
+func findChannel(clientId string) *channel.Channel {
+	value, ok := ClientChannelMap.Load(clientId)
+	if !ok {
+		return nil
+	}
+	clientChannel, ok := ChannelGroup.Load(value)
+	if !ok {
+		return nil
+	}
+	return clientChannel.(*channel.Channel)
 }
 
 // 处理 conn 报文
@@ -138,11 +347,22 @@ func HandlePubAck(channel *channel.Channel, msg *message.MqttMessage) {
 
 	// 移除 pubMsg
 	channel.RemovePubMsg(variableHeader.MessageId)
+	if !channel.CleanSession() {
+		logPersist(Persistence.DeleteInflight(channel.ClientId(), variableHeader.MessageId))
+	}
 }
 
 // 处理 PubRec 报文
 func HandlePubRec(channel *channel.Channel, msg *message.MqttMessage) {
+	header := msg.VariableHeader.(*message.MqttMessageIdVariableHeader)
 
+	// 丢弃已送达的 PUBLISH, 转为等待 PUBCOMP
+	rel := codec.EncodeFrame(message.BuildPubRel(header.MessageId))
+	if !channel.CleanSession() {
+		logPersist(Persistence.SaveInflight(channel.ClientId(), &persist.Message{Id: header.MessageId, Qos: 2, Released: true}))
+	}
+	channel.SavePubMsg(header.MessageId, rel)
+	channel.WriteFrame(rel)
 }
 
 // 处理 PubRel 报文
@@ -150,14 +370,20 @@ func HandlePubRel(channel *channel.Channel, msg *message.MqttMessage) {
 	header := msg.VariableHeader.(*message.MqttMessageIdVariableHeader)
 
 	log.Printf("收到 PUBREL 消息, id:%d\n", header.MessageId)
+	channel.RemovePubRel(header.MessageId)
 
 	ack := message.BuildPubComp(header.MessageId)
 	channel.Write(ack)
 }
 
-// 处理 PubRel 报文
+// 处理 PubComp 报文
 func HandlePubCom(channel *channel.Channel, msg *message.MqttMessage) {
+	header := msg.VariableHeader.(*message.MqttMessageIdVariableHeader)
 
+	channel.RemovePubMsg(header.MessageId)
+	if !channel.CleanSession() {
+		logPersist(Persistence.DeleteInflight(channel.ClientId(), header.MessageId))
+	}
 }
 
 // 订阅
@@ -167,6 +393,11 @@ func HandleSub(channel *channel.Channel, msg *message.MqttMessage) {
 
 	// 订阅
 	store.Store.Subscribe(channel.ClientId(), payload.Topics...)
+	if !channel.CleanSession() {
+		for _, topic := range payload.Topics {
+			logPersist(Persistence.Subscribe(channel.ClientId(), topic.Name, topic.Qos))
+		}
+	}
 
 	// 响应
 	resp := make([]byte, 0, 1)
@@ -175,6 +406,20 @@ func HandleSub(channel *channel.Channel, msg *message.MqttMessage) {
 	}
 	ack := message.BuildSubAck(header.MessageId, resp)
 	channel.Write(ack)
+
+	// 投递保留消息
+	for _, topic := range payload.Topics {
+		for _, retained := range Persistence.Retained(topic.Name) {
+			retained := retained
+			qos := retained.Qos
+			if qos > topic.Qos {
+				qos = topic.Qos
+			}
+			shared := codec.NewSharedPublish(retained.Topic, true, retained.Payload)
+			publish0(shared, func() persist.Message { return *retained }, channel.ClientId(), qos)
+			shared.Release()
+		}
+	}
 }
 
 // 解除订阅
@@ -184,6 +429,11 @@ func HandleUnSub(channel *channel.Channel, msg *message.MqttMessage) {
 
 	// 移除订阅
 	store.Store.RemoveSub(channel.ClientId(), payload...)
+	if !channel.CleanSession() {
+		for _, topic := range payload {
+			logPersist(Persistence.Unsubscribe(channel.ClientId(), topic))
+		}
+	}
 
 	// 响应
 	ack := message.BuildUnsubAck(header.MessageId)
@@ -198,9 +448,10 @@ func HandlePingReq(channel *channel.Channel, msg *message.MqttMessage) {
 
 // 连接断开
 func HandleDisconnect(channel *channel.Channel, msg *message.MqttMessage) {
+	// 正常断开, 丢弃遗嘱消息 [MQTT-3.14.4-3]
+	channel.SaveWill(nil)
+
 	if err := channel.Close(); err != nil {
 		log.Printf("连接关闭异常: %v\n", err)
 	}
-
-	store.Store.RemoveAllSub(channel.ClientId())
 }
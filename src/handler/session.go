@@ -0,0 +1,239 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"mqtt-go/src/channel"
+	"mqtt-go/src/codec"
+	"mqtt-go/src/message"
+	"mqtt-go/src/persist"
+	"mqtt-go/src/snapshot"
+	"mqtt-go/src/store"
+	"mqtt-go/src/timewheel"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 持久会话(cleanSession = false)断开后保留的时长, 到期移除订阅, 0 为永不过期
+var SessionExpiry = 2 * time.Hour
+
+// 持久会话、待确认及离线消息、保留消息的存储, 默认为内存实现
+var Persistence persist.Persistence = persist.NewMemory()
+
+// clientId -> 会话过期定时器
+var expiryTimers = struct {
+	lock   sync.Mutex
+	timers map[string]*timewheel.Timer
+}{timers: make(map[string]*timewheel.Timer)}
+
+// 启动时恢复持久会话的订阅及过期定时器, 并重新投递崩溃前未完成投递的消息.
+// 补发的消息在客户端重连时投递
+func Restore() {
+	now := time.Now()
+	sessions := Persistence.Sessions()
+	for _, s := range sessions {
+		restoreSession(s, now)
+	}
+
+	log.Printf("恢复持久会话: %d\n", len(sessions))
+
+	// 崩溃前已接收未完成投递的消息重新投递, 部分订阅者可能重复收到
+	unrouted := Persistence.Unrouted()
+	for _, msg := range unrouted {
+		if err := Publish(msg.Topic, msg.Qos, msg.Retain, msg.Payload); err != nil {
+			log.Printf("消息重新投递失败: %v\n", err)
+		}
+		logPersist(Persistence.Routed(msg.Seq))
+	}
+	if len(unrouted) > 0 {
+		log.Printf("重新投递未完成的消息: %d\n", len(unrouted))
+	}
+}
+
+// 恢复单个持久会话的订阅及过期定时器
+func restoreSession(s *persist.Session, now time.Time) {
+	for topic, qos := range s.Subs {
+		store.Store.Subscribe(s.ClientId, &message.Topic{Name: topic, Qos: qos})
+	}
+
+	// 停机时仍在线的会话从此刻起算过期
+	disconnected := s.Disconnected
+	if disconnected.IsZero() {
+		disconnected = now
+		logPersist(Persistence.SaveSession(s.ClientId, now))
+	}
+	if SessionExpiry <= 0 {
+		return
+	}
+	if left := SessionExpiry - now.Sub(disconnected); left > 0 {
+		scheduleExpiry(s.ClientId, left)
+	} else {
+		expire(s.ClientId)
+	}
+}
+
+// 导入快照到运行中的 broker, 同名会话被替换; 快照中的客户端在线时拒绝导入.
+// dryRun 为 true 时仅校验并统计
+func Import(snap *snapshot.Snapshot, dryRun bool) (*snapshot.Summary, error) {
+	if err := snap.Validate(); err != nil {
+		return nil, err
+	}
+	online := make([]string, 0)
+	for _, s := range snap.Sessions {
+		if _, ok := ClientChannelMap.Load(s.ClientId); ok {
+			online = append(online, s.ClientId)
+		}
+	}
+	if len(online) > 0 {
+		return nil, errors.New(fmt.Sprintf("客户端在线, 无法导入: %s", strings.Join(online, ",")))
+	}
+	if dryRun {
+		return snap.Apply(Persistence, true)
+	}
+
+	for _, s := range snap.Sessions {
+		cancelExpiry(s.ClientId)
+		store.Store.RemoveAllSub(s.ClientId)
+	}
+	summary, err := snap.Apply(Persistence, false)
+
+	// 导入失败时未替换的会话保留原状态, 同样恢复订阅及过期定时器
+	now := time.Now()
+	for _, s := range snap.Sessions {
+		if session := Persistence.Session(s.ClientId); session != nil {
+			restoreSession(session, now)
+		}
+	}
+	if err != nil {
+		return summary, err
+	}
+	log.Printf("导入快照, 会话: %d, 保留消息: %d\n", summary.Sessions, summary.Retained)
+	return summary, nil
+}
+
+// 客户端连接, 返回是否存在旧会话
+func openSession(clientId string, clean bool) bool {
+	cancelExpiry(clientId)
+
+	// 清理会话丢弃旧订阅及消息
+	if clean {
+		store.Store.RemoveAllSub(clientId)
+		logPersist(Persistence.DeleteSession(clientId))
+		return false
+	}
+
+	present := Persistence.HasSession(clientId)
+	logPersist(Persistence.SaveSession(clientId, time.Time{}))
+	return present
+}
+
+// 补发持久会话中未确认的消息, 随后投递离线消息
+func resumeSession(channel *channel.Channel) {
+	clientId := channel.ClientId()
+	s := Persistence.Session(clientId)
+	if s == nil {
+		return
+	}
+
+	ids := make([]int, 0, len(s.Inflight))
+	for id := range s.Inflight {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		sendStored(channel, s.Inflight[uint16(id)], true)
+	}
+
+	for _, msg := range s.Queued {
+		m := *msg
+		m.Id = channel.NextMessageId()
+		logPersist(Persistence.SaveInflight(clientId, &m))
+		sendStored(channel, &m, false)
+	}
+	logPersist(Persistence.DeleteQueued(clientId, len(s.Queued)))
+}
+
+// 发送已持久化的 qos1/qos2 消息并等待确认
+func sendStored(channel *channel.Channel, msg *persist.Message, dup bool) {
+	var frame *codec.Frame
+	if msg.Released {
+		frame = codec.EncodeFrame(message.BuildPubRel(msg.Id))
+	} else {
+		shared := codec.NewSharedPublish(msg.Topic, msg.Retain, msg.Payload)
+		frame = shared.Frame(msg.Qos, msg.Id)
+		shared.Release()
+		if dup {
+			origin := frame
+			frame = origin.Dup()
+			origin.Release()
+		}
+	}
+
+	channel.SavePubMsg(msg.Id, frame.Retain())
+	channel.WriteFrame(frame)
+}
+
+// 连接断开后结束会话, 清理会话立即移除订阅, 持久会话在 SessionExpiry 后移除
+func endSession(clientId string, clean bool) {
+	if clean {
+		store.Store.RemoveAllSub(clientId)
+		return
+	}
+
+	logPersist(Persistence.SaveSession(clientId, time.Now()))
+	if SessionExpiry > 0 {
+		scheduleExpiry(clientId, SessionExpiry)
+	}
+}
+
+func scheduleExpiry(clientId string, d time.Duration) {
+	expiryTimers.lock.Lock()
+	defer expiryTimers.lock.Unlock()
+
+	if old := expiryTimers.timers[clientId]; old != nil {
+		old.Stop()
+	}
+	var timer *timewheel.Timer
+	timer = timewheel.Default.AfterFunc(d, func() {
+		// 移除会话涉及持久化写入, 不在时间轮 goroutine 中执行
+		go func() {
+			expiryTimers.lock.Lock()
+			defer expiryTimers.lock.Unlock()
+
+			// 已被重连取消或替换
+			if expiryTimers.timers[clientId] != timer {
+				return
+			}
+			delete(expiryTimers.timers, clientId)
+			expire(clientId)
+		}()
+	})
+	expiryTimers.timers[clientId] = timer
+}
+
+// 会话过期, 移除订阅及消息
+func expire(clientId string) {
+	log.Printf("客户端[%s]会话过期, 移除订阅\n", clientId)
+	store.Store.RemoveAllSub(clientId)
+	logPersist(Persistence.DeleteSession(clientId))
+}
+
+// 客户端重连, 取消会话过期
+func cancelExpiry(clientId string) {
+	expiryTimers.lock.Lock()
+	defer expiryTimers.lock.Unlock()
+
+	if timer := expiryTimers.timers[clientId]; timer != nil {
+		timer.Stop()
+		delete(expiryTimers.timers, clientId)
+	}
+}
+
+func logPersist(err error) {
+	if err != nil {
+		log.Printf("持久化失败: %v\n", err)
+	}
+}
@@ -0,0 +1,94 @@
+// 限流工具
+
+package limit
+
+import (
+	"sync"
+	"time"
+)
+
+// 令牌桶, 以固定速率补充令牌, 容量为 burst
+type TokenBucket struct {
+	lock sync.Mutex
+
+	// 每秒补充的令牌数
+	rate float64
+
+	// 桶容量
+	burst float64
+
+	// 当前令牌数, 预支后可能为负
+	tokens float64
+
+	// 上次补充时间
+	last time.Time
+}
+
+// 构建令牌桶, 初始为满桶
+func NewTokenBucket(rate float64, burst float64) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// 尝试取走 n 个令牌, 令牌不足时不扣减并返回 false.
+// n 超过桶容量时满桶即可取走, 避免大消息永远无法通过
+func (this *TokenBucket) Allow(n float64) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if !this.available(n) {
+		return false
+	}
+	this.tokens -= n
+	return true
+}
+
+// 令牌是否足以取走 n 个, 不扣减
+func (this *TokenBucket) Available(n float64) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.available(n)
+}
+
+func (this *TokenBucket) available(n float64) bool {
+	this.refill(time.Now())
+	need := n
+	if need > this.burst {
+		need = this.burst
+	}
+	return this.tokens >= need
+}
+
+// 预支 n 个令牌, 返回令牌补足前需要等待的时长
+func (this *TokenBucket) Reserve(n float64) time.Duration {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.refill(time.Now())
+	this.tokens -= n
+	if this.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-this.tokens / this.rate * float64(time.Second))
+}
+
+func (this *TokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(this.last).Seconds()
+	this.last = now
+	if elapsed <= 0 {
+		return
+	}
+
+	this.tokens += elapsed * this.rate
+	if this.tokens > this.burst {
+		this.tokens = this.burst
+	}
+}
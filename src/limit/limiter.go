@@ -0,0 +1,238 @@
+package limit
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 超限后的处理方式
+type Action byte
+
+const (
+	// 暂停读取 socket, 等待令牌补足(背压)
+	Pause Action = iota
+
+	// 丢弃报文
+	Drop
+
+	// 断开连接
+	Disconnect
+)
+
+func (this Action) String() string {
+	switch this {
+	case Pause:
+		return "pause"
+	case Drop:
+		return "drop"
+	case Disconnect:
+		return "disconnect"
+	default:
+		return fmt.Sprintf("Action(%d)", byte(this))
+	}
+}
+
+func ParseAction(s string) (Action, error) {
+	switch s {
+	case "pause":
+		return Pause, nil
+	case "drop":
+		return Drop, nil
+	case "disconnect":
+		return Disconnect, nil
+	default:
+		return 0, errors.New(fmt.Sprintf("非法的限流动作: %s", s))
+	}
+}
+
+// 限流规则, 速率为 0 表示不限制
+type Rule struct {
+	// 每秒消息数
+	Msgs       float64
+	MsgsAction Action
+
+	// 每秒字节数
+	Bytes       float64
+	BytesAction Action
+}
+
+var (
+	// 全局默认规则
+	Default Rule
+
+	// 按用户名指定的规则, 优先于 Default
+	Users = make(map[string]Rule)
+)
+
+// 解析按用户名配置的规则, 格式:
+//
+//	user=msgs[/action][:bytes[/action]],user2=...
+//
+// 未指定的部分沿用 def
+func ParseUsers(s string, def Rule) (map[string]Rule, error) {
+	rules := make(map[string]Rule)
+	if s == "" {
+		return rules, nil
+	}
+
+	for _, item := range strings.Split(s, ",") {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errors.New(fmt.Sprintf("非法的限流配置: %s", item))
+		}
+
+		rule, parts := def, strings.SplitN(kv[1], ":", 2)
+		var err error
+		if rule.Msgs, rule.MsgsAction, err = parseLimit(parts[0], def.Msgs, def.MsgsAction); err != nil {
+			return nil, err
+		}
+		if len(parts) == 2 {
+			if rule.Bytes, rule.BytesAction, err = parseLimit(parts[1], def.Bytes, def.BytesAction); err != nil {
+				return nil, err
+			}
+		}
+		rules[kv[0]] = rule
+	}
+
+	return rules, nil
+}
+
+// 解析 rate[/action]
+func parseLimit(s string, rate float64, action Action) (float64, Action, error) {
+	parts := strings.SplitN(s, "/", 2)
+	if parts[0] != "" {
+		v, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil || v < 0 {
+			return 0, 0, errors.New(fmt.Sprintf("非法的限流速率: %s", parts[0]))
+		}
+		rate = v
+	}
+	if len(parts) == 2 {
+		a, err := ParseAction(parts[1])
+		if err != nil {
+			return 0, 0, err
+		}
+		action = a
+	}
+	return rate, action, nil
+}
+
+// 返回用户适用的限流器, 无限制时返回 nil
+func For(username string) *Limiter {
+	rule, ok := Users[username]
+	if !ok {
+		rule = Default
+	}
+	if rule.Msgs <= 0 && rule.Bytes <= 0 {
+		return nil
+	}
+
+	l := &Limiter{rule: rule}
+	if rule.Msgs > 0 {
+		l.msgs = NewTokenBucket(rule.Msgs, rule.Msgs)
+	}
+	if rule.Bytes > 0 {
+		l.bytes = NewTokenBucket(rule.Bytes, rule.Bytes)
+	}
+	return l
+}
+
+// 单个客户端的发布限流器
+type Limiter struct {
+	rule Rule
+
+	msgs  *TokenBucket
+	bytes *TokenBucket
+
+	// 计数
+	passed       uint64
+	paused       uint64
+	dropped      uint64
+	disconnected uint64
+	pausedNanos  int64
+}
+
+// 限流器统计信息
+type Stats struct {
+	Msgs         float64 `json:"msgs"`
+	MsgsAction   string  `json:"msgsAction"`
+	Bytes        float64 `json:"bytes"`
+	BytesAction  string  `json:"bytesAction"`
+	Passed       uint64  `json:"passed"`
+	Paused       uint64  `json:"paused"`
+	PausedMillis int64   `json:"pausedMillis"`
+	Dropped      uint64  `json:"dropped"`
+	Disconnected uint64  `json:"disconnected"`
+}
+
+// 为一条大小为 n 字节的消息申请配额, 不阻塞.
+// 动作为 Pause 时预留配额并返回需等待的时长, 调用方应在此期间停止读取该连接;
+// 返回 false 时调用方需执行返回的动作(Drop/Disconnect), 此时不扣减任何配额
+func (this *Limiter) Reserve(n int) (bool, Action, time.Duration) {
+	// 先检查两个桶, 任一不足时被丢弃或断开的消息不计入另一个桶
+	if !this.check(this.msgs, 1, this.rule.MsgsAction) {
+		return false, this.rule.MsgsAction, 0
+	}
+	if !this.check(this.bytes, float64(n), this.rule.BytesAction) {
+		return false, this.rule.BytesAction, 0
+	}
+
+	msgsWait := this.take(this.msgs, 1, this.rule.MsgsAction)
+	bytesWait := this.take(this.bytes, float64(n), this.rule.BytesAction)
+	atomic.AddUint64(&this.passed, 1)
+	if bytesWait > msgsWait {
+		return true, Pause, bytesWait
+	}
+	return true, Pause, msgsWait
+}
+
+// 检查配额是否充足, 动作为 Pause 时总是充足
+func (this *Limiter) check(bucket *TokenBucket, n float64, action Action) bool {
+	if bucket == nil || action == Pause || bucket.Available(n) {
+		return true
+	}
+	if action == Drop {
+		atomic.AddUint64(&this.dropped, 1)
+	} else {
+		atomic.AddUint64(&this.disconnected, 1)
+	}
+	return false
+}
+
+// 扣减已检查过的配额, 返回需等待的时长
+func (this *Limiter) take(bucket *TokenBucket, n float64, action Action) time.Duration {
+	if bucket == nil {
+		return 0
+	}
+
+	if action == Pause {
+		wait := bucket.Reserve(n)
+		if wait > 0 {
+			atomic.AddUint64(&this.paused, 1)
+			atomic.AddInt64(&this.pausedNanos, int64(wait))
+		}
+		return wait
+	}
+
+	// 同一连接的报文由单个 goroutine 顺序处理, 检查之后令牌只增不减
+	bucket.Allow(n)
+	return 0
+}
+
+func (this *Limiter) Stats() Stats {
+	return Stats{
+		Msgs:         this.rule.Msgs,
+		MsgsAction:   this.rule.MsgsAction.String(),
+		Bytes:        this.rule.Bytes,
+		BytesAction:  this.rule.BytesAction.String(),
+		Passed:       atomic.LoadUint64(&this.passed),
+		Paused:       atomic.LoadUint64(&this.paused),
+		PausedMillis: time.Duration(atomic.LoadInt64(&this.pausedNanos)).Milliseconds(),
+		Dropped:      atomic.LoadUint64(&this.dropped),
+		Disconnected: atomic.LoadUint64(&this.disconnected),
+	}
+}
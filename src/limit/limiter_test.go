@@ -0,0 +1,114 @@
+package limit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseAction(t *testing.T) {
+	for _, action := range []Action{Pause, Drop, Disconnect} {
+		if a, err := ParseAction(action.String()); err != nil || a != action {
+			t.Fatalf("%s: %v %v", action, a, err)
+		}
+	}
+	if _, err := ParseAction("block"); err == nil {
+		t.Fatal("应拒绝未知的动作")
+	}
+}
+
+func TestParseUsers(t *testing.T) {
+	def := Rule{Msgs: 100, MsgsAction: Pause, Bytes: 1024, BytesAction: Drop}
+	rules, err := ParseUsers("alice=10/drop:4096,bob=0,carol=:/disconnect,dave=/disconnect", def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Rule{
+		"alice": {Msgs: 10, MsgsAction: Drop, Bytes: 4096, BytesAction: Drop},
+		"bob":   {Msgs: 0, MsgsAction: Pause, Bytes: 1024, BytesAction: Drop},
+		"carol": {Msgs: 100, MsgsAction: Pause, Bytes: 1024, BytesAction: Disconnect},
+		"dave":  {Msgs: 100, MsgsAction: Disconnect, Bytes: 1024, BytesAction: Drop},
+	}
+	if len(rules) != len(want) {
+		t.Fatalf("规则: %+v", rules)
+	}
+	for user, rule := range want {
+		if rules[user] != rule {
+			t.Fatalf("%s: %+v, 应为 %+v", user, rules[user], rule)
+		}
+	}
+
+	if rules, err := ParseUsers("", def); err != nil || len(rules) != 0 {
+		t.Fatalf("空配置: %v %v", rules, err)
+	}
+	for _, s := range []string{"alice", "=10", "alice=x", "alice=-1", "alice=10/block", "alice=10:x"} {
+		if _, err := ParseUsers(s, def); err == nil {
+			t.Fatalf("应拒绝: %s", s)
+		}
+	}
+}
+
+// 字节桶不足而丢弃时不扣减消息桶
+func TestReserveDropKeepsOtherBucket(t *testing.T) {
+	l := &Limiter{
+		rule:  Rule{Msgs: 2, MsgsAction: Drop, Bytes: 10, BytesAction: Drop},
+		msgs:  NewTokenBucket(2, 2),
+		bytes: NewTokenBucket(10, 10),
+	}
+
+	if ok, _, _ := l.Reserve(8); !ok {
+		t.Fatal("首条消息应通过")
+	}
+	// 字节不足, 消息桶仍剩 1 个令牌
+	if ok, action, _ := l.Reserve(8); ok || action != Drop {
+		t.Fatalf("应因字节数丢弃: %v %v", ok, action)
+	}
+	if ok, _, _ := l.Reserve(1); !ok {
+		t.Fatal("消息桶不应被丢弃的消息扣减")
+	}
+	if ok, _, _ := l.Reserve(1); ok {
+		t.Fatal("消息桶应已耗尽")
+	}
+
+	stats := l.Stats()
+	if stats.Passed != 2 || stats.Dropped != 2 {
+		t.Fatalf("统计: %+v", stats)
+	}
+}
+
+// 消息桶超限断开时不扣减字节桶
+func TestReserveDisconnect(t *testing.T) {
+	l := &Limiter{
+		rule:  Rule{Msgs: 1, MsgsAction: Disconnect, Bytes: 100, BytesAction: Drop},
+		msgs:  NewTokenBucket(1, 1),
+		bytes: NewTokenBucket(100, 100),
+	}
+	l.Reserve(10)
+	if ok, action, _ := l.Reserve(10); ok || action != Disconnect {
+		t.Fatalf("应断开: %v %v", ok, action)
+	}
+	if !l.bytes.Available(90) {
+		t.Fatal("字节桶不应被拒绝的消息扣减")
+	}
+}
+
+// 暂停动作预支配额, 返回两个桶中较长的等待时长
+func TestReservePause(t *testing.T) {
+	l := &Limiter{
+		rule:  Rule{Msgs: 1000, MsgsAction: Pause, Bytes: 100, BytesAction: Pause},
+		msgs:  NewTokenBucket(1000, 1000),
+		bytes: NewTokenBucket(100, 100),
+	}
+	if ok, _, wait := l.Reserve(100); !ok || wait != 0 {
+		t.Fatalf("满桶: %v %v", ok, wait)
+	}
+	ok, action, wait := l.Reserve(50)
+	if !ok || action != Pause {
+		t.Fatalf("应暂停: %v %v", ok, action)
+	}
+	if wait < 400*time.Millisecond || wait > 500*time.Millisecond {
+		t.Fatalf("等待时长: %v", wait)
+	}
+	if stats := l.Stats(); stats.Paused != 1 || stats.Passed != 2 {
+		t.Fatalf("统计: %+v", stats)
+	}
+}
@@ -0,0 +1,77 @@
+package message
+
+import (
+	"fmt"
+	"mqtt-go/src/utils"
+)
+
+// 报文类型名称
+var typeNames = [...]string{
+	CONNECT:     "CONNECT",
+	CONNACK:     "CONNACK",
+	PUBLISH:     "PUBLISH",
+	PUBACK:      "PUBACK",
+	PUBREC:      "PUBREC",
+	PUBREL:      "PUBREL",
+	PUBCOMP:     "PUBCOMP",
+	SUBSCRIBE:   "SUBSCRIBE",
+	SUBACK:      "SUBACK",
+	UNSUBSCRIBE: "UNSUBSCRIBE",
+	UNSUBACK:    "UNSUBACK",
+	PINGREQ:     "PINGREQ",
+	PINGRESP:    "PINGRESP",
+	DISCONNECT:  "DISCONNECT",
+}
+
+// 报文类型名称, 非法类型返回其数值
+func TypeName(packetType byte) string {
+	if int(packetType) < len(typeNames) && typeNames[packetType] != "" {
+		return typeNames[packetType]
+	}
+	return fmt.Sprintf("TYPE(%d)", packetType)
+}
+
+// 协议错误, 解码非法报文时返回
+type ProtocolError struct {
+	// 报文类型
+	PacketType byte
+
+	// 违反的规范条目, 如 MQTT-3.8.3-3; 超出解码限制等非规范要求时为空
+	Ref string
+
+	Reason string
+
+	// 底层错误, 可为空
+	Err error
+}
+
+func NewProtocolError(packetType byte, ref string, reason string) *ProtocolError {
+	return &ProtocolError{PacketType: packetType, Ref: ref, Reason: reason}
+}
+
+// 包装底层错误
+func WrapProtocolError(packetType byte, ref string, err error) *ProtocolError {
+	return &ProtocolError{PacketType: packetType, Ref: ref, Reason: err.Error(), Err: err}
+}
+
+// 包装字符串字段的解码错误, UTF-8 非法时改用 MQTT-1.5.3 的条目
+func WrapStringError(packetType byte, ref string, err error) *ProtocolError {
+	switch err {
+	case utils.ErrInvalidUtf8:
+		ref = "MQTT-1.5.3-1"
+	case utils.ErrNullChar:
+		ref = "MQTT-1.5.3-2"
+	}
+	return WrapProtocolError(packetType, ref, err)
+}
+
+func (this *ProtocolError) Error() string {
+	if this.Ref == "" {
+		return fmt.Sprintf("%s 报文非法: %s", TypeName(this.PacketType), this.Reason)
+	}
+	return fmt.Sprintf("%s 报文非法: %s [%s]", TypeName(this.PacketType), this.Reason, this.Ref)
+}
+
+func (this *ProtocolError) Unwrap() error {
+	return this.Err
+}
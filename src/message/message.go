@@ -2,7 +2,6 @@ package message
 
 import (
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"mqtt-go/src/utils"
 	"time"
@@ -35,12 +34,50 @@ type MqttMessage struct {
 
 	// 载荷
 	Payload interface{}
+
+	// 报文所在的池化缓冲.
+	// 非空时 PUBLISH 的 Payload 引用池化内存, 处理完毕后由解码方调用 Release 归还,
+	// 处理过程之外仍需持有 payload 的一方必须自行复制
+	buf Releaser
+}
+
+// 可归还的池化资源
+type Releaser interface {
+	Release()
+}
+
+// 绑定报文所在的池化缓冲
+func (this *MqttMessage) Attach(buf Releaser) {
+	this.buf = buf
+}
+
+// 归还报文引用的池化缓冲, 此后不能再访问 Payload
+func (this *MqttMessage) Release() {
+	if this.buf != nil {
+		this.buf.Release()
+		this.buf = nil
+	}
 }
 
 func (this *MqttMessage) String() string {
 	return fmt.Sprintf("fixedHeader: %v variableHeader: %v payload: %v", *this.FixedHeader, this.VariableHeader, this.Payload)
 }
 
+// 构建 CONNECT 报文, 遗嘱及用户名/密码按 header 中的标志编码
+func BuildConnect(header *MqttConnVariableHeader, payload *MqttConnPayload) *MqttMessage {
+	return &MqttMessage{
+		FixedHeader: &MqttFixedHeader{
+			MessageType:  CONNECT,
+			Qos:          0,
+			Dup:          false,
+			Retain:       false,
+			RemainLength: 0,
+		},
+		VariableHeader: header,
+		Payload:        payload,
+	}
+}
+
 func BuildConnAck(sessionPresent bool, code byte) *MqttMessage {
 	msg := &MqttMessage{
 		FixedHeader: &MqttFixedHeader{
@@ -110,6 +147,34 @@ func BuildSubAck(messageId uint16, resp []byte) *MqttMessage {
 	return msg
 }
 
+func BuildSubscribe(messageId uint16, topics ...*Topic) *MqttMessage {
+	return &MqttMessage{
+		FixedHeader: &MqttFixedHeader{
+			MessageType:  SUBSCRIBE,
+			Qos:          1,
+			Dup:          false,
+			Retain:       false,
+			RemainLength: 0,
+		},
+		VariableHeader: &MqttMessageIdVariableHeader{MessageId: messageId},
+		Payload:        &MqttSubscribePayload{Topics: topics},
+	}
+}
+
+func BuildUnsubscribe(messageId uint16, topics ...string) *MqttMessage {
+	return &MqttMessage{
+		FixedHeader: &MqttFixedHeader{
+			MessageType:  UNSUBSCRIBE,
+			Qos:          1,
+			Dup:          false,
+			Retain:       false,
+			RemainLength: 0,
+		},
+		VariableHeader: &MqttMessageIdVariableHeader{MessageId: messageId},
+		Payload:        topics,
+	}
+}
+
 func BuildUnsubAck(messageId uint16) *MqttMessage {
 	return buildMsgWithMessageId(messageId, UNSUBACK)
 }
@@ -168,10 +233,24 @@ func buildMsgWithMessageId(messageId uint16, messageType byte) *MqttMessage {
 	return msg
 }
 
+func BuildPingReq() *MqttMessage {
+	return buildEmpty(PINGREQ)
+}
+
 func BuildPingAck() *MqttMessage {
+	return buildEmpty(PINGRESP)
+}
+
+func BuildDisconnect() *MqttMessage {
+	return buildEmpty(DISCONNECT)
+}
+
+// 构建仅含固定头的报文
+// 支持 PINGREQ, PINGRESP, DISCONNECT
+func buildEmpty(messageType byte) *MqttMessage {
 	msg := &MqttMessage{
 		FixedHeader: &MqttFixedHeader{
-			MessageType:  PINGRESP,
+			MessageType:  messageType,
 			Qos:          0,
 			Dup:          false,
 			Retain:       false,
@@ -197,36 +276,6 @@ type MqttFixedHeader struct {
 	RemainLength int
 }
 
-// 从完整的报文读取固定头
-func (this *MqttFixedHeader) readFrom(buf []byte) ([]byte, error) {
-	this.MessageType = buf[0] >> 4
-	this.Qos = (buf[0] & 0b0110) >> 1
-	this.Retain = (buf[0] & 0b1) == 1
-	this.Dup = ((buf[0] & 0b1000) >> 1) == 1
-
-	multiplier, loops, value := 1, 1, 0
-	var encodedByte int
-	for {
-		encodedByte = int(buf[loops])
-		value += (encodedByte & 127) * multiplier
-		multiplier *= 128
-		loops++
-		if encodedByte&128 != 0 && loops < 5 {
-			continue
-		} else {
-			break
-		}
-	}
-
-	// MQTT protocol limits Remaining Length to 4 bytes
-	if loops == 4 && encodedByte == 128 {
-		return nil, errors.New("remain length 超过了规定的四个字节")
-	}
-	this.RemainLength = value
-
-	return buf[loops:], nil
-}
-
 /*             variable header                  */
 
 type MqttConnVariableHeader struct {
@@ -262,23 +311,46 @@ func (this *MqttConnAckVariableHeader) ToBytes() []byte {
 	return buf
 }
 
+func (this *MqttConnAckVariableHeader) ParseFrom(buf []byte, start int) (int, error) {
+	if len(buf)-start != 2 {
+		return 0, NewProtocolError(CONNACK, "MQTT-3.2.2", fmt.Sprintf("可变头长度 %d, 应为 2", len(buf)-start))
+	}
+
+	// Byte 1 is the "Connect Acknowledge Flags". Bits 7-1 are reserved and MUST be set to 0.
+	if buf[start]&0b11111110 != 0 {
+		return 0, NewProtocolError(CONNACK, "MQTT-3.2.2.1", "保留字段非法")
+	}
+	this.SessionPresent = buf[start] == 1
+	this.Code = buf[start+1]
+	return start + 2, nil
+}
+
 func ReadFrom(buf []byte) (result *MqttConnVariableHeader, _ error) {
 
 	// 校验协议名称
-	if name, _ := utils.DecodeMqttString(buf, 0); name != "MQTT" {
-		return nil, errors.New(fmt.Sprintf("非法的协议名:%s\n", name))
+	name, index, err := utils.DecodeMqttString(buf, 0)
+	if err != nil {
+		return nil, WrapStringError(CONNECT, "MQTT-3.1.2-1", err)
+	}
+	if name != "MQTT" {
+		return nil, NewProtocolError(CONNECT, "MQTT-3.1.2-1", fmt.Sprintf("非法的协议名:%s", name))
+	}
+
+	// 协议级别, 连接标志, 心跳
+	if len(buf)-index < 4 {
+		return nil, WrapProtocolError(CONNECT, "MQTT-3.1.2", utils.ErrShortBuffer)
 	}
 
 	// src v3.1.1 版本值为 4
 	if buf[6] != 4 {
-		return nil, errors.New(fmt.Sprintf("不支持版本: %d", buf[6]))
+		return nil, NewProtocolError(CONNECT, "MQTT-3.1.2-2", fmt.Sprintf("不支持版本: %d", buf[6]))
 	}
 
 	// conn flags
 	// 先检查保留字段
 	connectFlags := buf[7]
 	if connectFlags&0b1 != 0 {
-		return nil, errors.New("conn flag 保留字段非法！")
+		return nil, NewProtocolError(CONNECT, "MQTT-3.1.2-3", "conn flag 保留字段非法")
 	}
 	result = new(MqttConnVariableHeader)
 	result.CleanSession = (connectFlags&0b10)>>1 == 1
@@ -293,6 +365,20 @@ func ReadFrom(buf []byte) (result *MqttConnVariableHeader, _ error) {
 	if result.WillFlag {
 		result.WillQos = (connectFlags & 0b11000) >> 3
 		result.WillRetain = (connectFlags&0b10_0000)>>5 == 1
+
+		// If the Will Flag is set to 1, the value of Will QoS can be 0, 1 or 2. It MUST NOT be 3 [MQTT-3.1.2-14].
+		if result.WillQos == 3 {
+			return nil, NewProtocolError(CONNECT, "MQTT-3.1.2-14", "非法的遗嘱 Qos:3")
+		}
+	} else if connectFlags&0b11_1000 != 0 {
+		// If the Will Flag is set to 0, then the Will QoS MUST be set to 0 [MQTT-3.1.2-13]
+		// and the Will Retain Flag MUST be set to 0 [MQTT-3.1.2-15].
+		return nil, NewProtocolError(CONNECT, "MQTT-3.1.2-13", "未设置遗嘱时遗嘱 Qos 及 Retain 须为 0")
+	}
+
+	// If the User Name Flag is set to 0, the Password Flag MUST be set to 0 [MQTT-3.1.2-22].
+	if result.PasswordFlag && !result.UsernameFlag {
+		return nil, NewProtocolError(CONNECT, "MQTT-3.1.2-22", "设置密码时须设置用户名")
 	}
 
 	// keep alive
@@ -309,13 +395,19 @@ type MqttPublishVaribleHeader struct {
 }
 
 func (this *MqttPublishVaribleHeader) ParseFrom(buf []byte, qos byte, start int) (int, error) {
-	this.TopicName, start = utils.DecodeMqttString(buf, start)
+	var err error
+	if this.TopicName, start, err = utils.DecodeMqttString(buf, start); err != nil {
+		return 0, WrapStringError(PUBLISH, "MQTT-3.3.2-1", err)
+	}
 	if qos == 0 {
 		return start, nil
 	}
+	if len(buf)-start < 2 {
+		return 0, NewProtocolError(PUBLISH, "MQTT-2.3.1-1", "缺少 packetId")
+	}
 	this.MessageId = binary.BigEndian.Uint16(buf[start:])
 	if this.MessageId == 0 {
-		return 0, errors.New("非法的 packageId:0")
+		return 0, NewProtocolError(PUBLISH, "MQTT-2.3.1-1", "非法的 packetId:0")
 	}
 	return start + 2, nil
 }
@@ -325,10 +417,13 @@ type MqttMessageIdVariableHeader struct {
 	MessageId uint16
 }
 
-func (this *MqttMessageIdVariableHeader) ParseFrom(buf []byte, start int) (int, error) {
+func (this *MqttMessageIdVariableHeader) ParseFrom(buf []byte, packetType byte, start int) (int, error) {
+	if len(buf)-start < 2 {
+		return 0, NewProtocolError(packetType, "MQTT-2.3.1-1", "缺少 packetId")
+	}
 	msgId := binary.BigEndian.Uint16(buf[start:])
 	if msgId == 0 {
-		return 0, errors.New("非法的 packageId:0")
+		return 0, NewProtocolError(packetType, "MQTT-2.3.1-1", "非法的 packetId:0")
 	}
 
 	this.MessageId = msgId
@@ -356,12 +451,18 @@ func (this *MqttSubscribePayload) ParseFrom(buf []byte, start int, messageLen in
 	topics := make([]*Topic, 0, 1)
 	topic, index := "", start
 	for {
-		topic, index = utils.DecodeMqttString(buf, index)
+		var err error
+		if topic, index, err = utils.DecodeMqttString(buf[:messageLen], index); err != nil {
+			return 0, WrapStringError(SUBSCRIBE, "MQTT-3.8.3-1", err)
+		}
+		if index >= messageLen {
+			return 0, NewProtocolError(SUBSCRIBE, "MQTT-3.8.3-1", "缺少订阅 Qos")
+		}
 
 		// The Server MUST treat a SUBSCRIBE packet as malformed and close the Network Connection
 		// if any of Reserved bits in the payload are non-zero, or QoS is not 0,1 or 2 [MQTT-3-8.3-4].
 		if buf[index]&0b11111100 != 0 || buf[index]&0b11 == 3 {
-			return 0, errors.New("非法的 SUBSCRIBE 报文")
+			return 0, NewProtocolError(SUBSCRIBE, "MQTT-3.8.3-4", fmt.Sprintf("非法的订阅 Qos:%d", buf[index]))
 		}
 		topics = append(topics, &Topic{
 			Name: topic,
@@ -369,12 +470,9 @@ func (this *MqttSubscribePayload) ParseFrom(buf []byte, start int, messageLen in
 		})
 		index++
 
-		// 需要防止非法数据导致的无限循环
 		if messageLen == index {
 			this.Topics = topics
 			return index, nil
-		} else if messageLen < index {
-			return 0, errors.New("非法的 SUBSCRIBE 报文")
 		}
 	}
 }
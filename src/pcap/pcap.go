@@ -0,0 +1,246 @@
+// 读取 libpcap 格式的抓包文件, 提取 TCP 报文段并按方向重组数据流.
+// 仅支持经典 pcap 格式(不支持 pcapng), 链路层支持 Ethernet, Linux cooked(SLL/SLL2), raw IP 及 loopback
+
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// 链路层类型
+const (
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkLoop     = 108
+	linkSLL      = 113
+	linkSLL2     = 276
+)
+
+// 链路层类型为 raw IP 的其他取值
+const linkRawAlt = 12
+
+// 单个报文最大长度, 超出视为文件损坏
+const maxSnapLen = 256 * 1024
+
+// 连接一端的地址
+type Endpoint struct {
+	IP   net.IP
+	Port uint16
+}
+
+func (this Endpoint) String() string {
+	return net.JoinHostPort(this.IP.String(), strconv.Itoa(int(this.Port)))
+}
+
+// TCP 报文段
+type Segment struct {
+	// 抓包时间
+	Time time.Time
+
+	Src Endpoint
+	Dst Endpoint
+
+	Seq uint32
+	SYN bool
+	FIN bool
+	RST bool
+
+	Payload []byte
+}
+
+// pcap 文件读取器
+type Reader struct {
+	r     io.Reader
+	order binary.ByteOrder
+
+	// 时间戳小数部分为纳秒, 否则为微秒
+	nano bool
+
+	linkType uint32
+}
+
+// 读取文件头, 构建读取器
+func NewReader(r io.Reader) (*Reader, error) {
+	var header [24]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, errors.New(fmt.Sprintf("读取 pcap 文件头失败: %v", err))
+	}
+
+	this := &Reader{r: r}
+	switch magic := binary.LittleEndian.Uint32(header[:4]); magic {
+	case 0xa1b2c3d4:
+		this.order = binary.LittleEndian
+	case 0xd4c3b2a1:
+		this.order = binary.BigEndian
+	case 0xa1b23c4d:
+		this.order, this.nano = binary.LittleEndian, true
+	case 0x4d3cb2a1:
+		this.order, this.nano = binary.BigEndian, true
+	case 0x0a0d0d0a:
+		return nil, errors.New("不支持 pcapng 格式, 请先转换为 pcap: editcap -F pcap in.pcapng out.pcap")
+	default:
+		return nil, errors.New(fmt.Sprintf("非法的 pcap 文件, magic: %08x", magic))
+	}
+
+	this.linkType = this.order.Uint32(header[20:24]) & 0x0fffffff
+	switch this.linkType {
+	case linkNull, linkEthernet, linkRaw, linkRawAlt, linkLoop, linkSLL, linkSLL2:
+	default:
+		return nil, errors.New(fmt.Sprintf("不支持的链路层类型: %d", this.linkType))
+	}
+	return this, nil
+}
+
+// 读取下一个 TCP 报文段, 跳过其他报文; 文件结束时返回 io.EOF
+func (this *Reader) Next() (*Segment, error) {
+	for {
+		var header [16]byte
+		if _, err := io.ReadFull(this.r, header[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil, errors.New("pcap 文件截断")
+			}
+			return nil, err
+		}
+
+		sec, frac := this.order.Uint32(header[0:4]), this.order.Uint32(header[4:8])
+		length := this.order.Uint32(header[8:12])
+		if length > maxSnapLen {
+			return nil, errors.New(fmt.Sprintf("非法的报文长度: %d", length))
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(this.r, data); err != nil {
+			return nil, errors.New("pcap 文件截断")
+		}
+
+		if !this.nano {
+			frac *= 1000
+		}
+		seg := this.parse(data)
+		if seg == nil {
+			continue
+		}
+		seg.Time = time.Unix(int64(sec), int64(frac))
+		return seg, nil
+	}
+}
+
+// 解析链路层, 非 TCP 报文返回 nil
+func (this *Reader) parse(data []byte) *Segment {
+	var etherType uint16
+	switch this.linkType {
+	case linkEthernet:
+		if len(data) < 14 {
+			return nil
+		}
+		etherType, data = binary.BigEndian.Uint16(data[12:14]), data[14:]
+
+		// 802.1Q VLAN
+		for etherType == 0x8100 && len(data) >= 4 {
+			etherType, data = binary.BigEndian.Uint16(data[2:4]), data[4:]
+		}
+	case linkSLL:
+		if len(data) < 16 {
+			return nil
+		}
+		etherType, data = binary.BigEndian.Uint16(data[14:16]), data[16:]
+	case linkSLL2:
+		if len(data) < 20 {
+			return nil
+		}
+		etherType, data = binary.BigEndian.Uint16(data[0:2]), data[20:]
+	case linkNull, linkLoop:
+		// 4 字节地址族, 字节序取决于抓包主机, 直接按 IP 版本号判断
+		if len(data) < 4 {
+			return nil
+		}
+		data = data[4:]
+	}
+
+	if etherType == 0 && len(data) > 0 {
+		switch data[0] >> 4 {
+		case 4:
+			etherType = 0x0800
+		case 6:
+			etherType = 0x86dd
+		}
+	}
+
+	switch etherType {
+	case 0x0800:
+		return parseIPv4(data)
+	case 0x86dd:
+		return parseIPv6(data)
+	}
+	return nil
+}
+
+func parseIPv4(data []byte) *Segment {
+	if len(data) < 20 {
+		return nil
+	}
+	headerLen, total := int(data[0]&0x0f)*4, int(binary.BigEndian.Uint16(data[2:4]))
+	if data[9] != 6 || headerLen < 20 || total < headerLen || total > len(data) {
+		return nil
+	}
+
+	// 分片的报文不重组
+	if flags := binary.BigEndian.Uint16(data[6:8]); flags&0x2000 != 0 || flags&0x1fff != 0 {
+		return nil
+	}
+	return parseTCP(net.IP(data[12:16]), net.IP(data[16:20]), data[headerLen:total])
+}
+
+func parseIPv6(data []byte) *Segment {
+	if len(data) < 40 {
+		return nil
+	}
+	total := 40 + int(binary.BigEndian.Uint16(data[4:6]))
+	if total > len(data) {
+		return nil
+	}
+	src, dst := net.IP(data[8:24]), net.IP(data[24:40])
+
+	// 跳过逐跳、路由及目的选项扩展头
+	next, data := data[6], data[40:total]
+	for next == 0 || next == 43 || next == 60 {
+		if len(data) < 8 {
+			return nil
+		}
+		n := 8 + int(data[1])*8
+		if n > len(data) {
+			return nil
+		}
+		next, data = data[0], data[n:]
+	}
+	if next != 6 {
+		return nil
+	}
+	return parseTCP(src, dst, data)
+}
+
+func parseTCP(src net.IP, dst net.IP, data []byte) *Segment {
+	if len(data) < 20 {
+		return nil
+	}
+	headerLen := int(data[12]>>4) * 4
+	if headerLen < 20 || headerLen > len(data) {
+		return nil
+	}
+	flags := data[13]
+	return &Segment{
+		Src:     Endpoint{IP: append(net.IP(nil), src...), Port: binary.BigEndian.Uint16(data[0:2])},
+		Dst:     Endpoint{IP: append(net.IP(nil), dst...), Port: binary.BigEndian.Uint16(data[2:4])},
+		Seq:     binary.BigEndian.Uint32(data[4:8]),
+		FIN:     flags&0x01 != 0,
+		SYN:     flags&0x02 != 0,
+		RST:     flags&0x04 != 0,
+		Payload: data[headerLen:],
+	}
+}
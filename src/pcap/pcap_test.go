@@ -0,0 +1,114 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// 构建 Ethernet + IPv4 + TCP 报文
+func frame(src Endpoint, dst Endpoint, seq uint32, flags byte, payload []byte) []byte {
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:2], src.Port)
+	binary.BigEndian.PutUint16(tcp[2:4], dst.Port)
+	binary.BigEndian.PutUint32(tcp[4:8], seq)
+	tcp[12], tcp[13] = 5<<4, flags
+	tcp = append(tcp, payload...)
+
+	ip := make([]byte, 20, 20+len(tcp))
+	ip[0], ip[9] = 0x45, 6
+	binary.BigEndian.PutUint16(ip[2:4], uint16(20+len(tcp)))
+	copy(ip[12:16], src.IP.To4())
+	copy(ip[16:20], dst.IP.To4())
+	ip = append(ip, tcp...)
+
+	eth := make([]byte, 14, 14+len(ip))
+	binary.BigEndian.PutUint16(eth[12:14], 0x0800)
+	return append(eth, ip...)
+}
+
+// 构建 pcap 文件
+func capture(frames ...[]byte) []byte {
+	var buf bytes.Buffer
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], 65535)
+	binary.LittleEndian.PutUint32(header[20:24], linkEthernet)
+	buf.Write(header)
+
+	for i, f := range frames {
+		record := make([]byte, 16)
+		binary.LittleEndian.PutUint32(record[0:4], 1700000000)
+		binary.LittleEndian.PutUint32(record[4:8], uint32(i))
+		binary.LittleEndian.PutUint32(record[8:12], uint32(len(f)))
+		binary.LittleEndian.PutUint32(record[12:16], uint32(len(f)))
+		buf.Write(record)
+		buf.Write(f)
+	}
+	return buf.Bytes()
+}
+
+func TestReassemble(t *testing.T) {
+	client := Endpoint{IP: net.IPv4(10, 0, 0, 1), Port: 50000}
+	server := Endpoint{IP: net.IPv4(10, 0, 0, 2), Port: 1883}
+	data := capture(
+		frame(client, server, 99, 0x02, nil),
+		frame(client, server, 100, 0x18, []byte("abc")),
+		// 乱序
+		frame(client, server, 106, 0x18, []byte("ghi")),
+		frame(server, client, 500, 0x18, []byte("xyz")),
+		frame(client, server, 103, 0x18, []byte("def")),
+		// 重传, 部分重叠
+		frame(client, server, 104, 0x18, []byte("efghij")),
+		// 空缺 110..112, 连接结束时跳过
+		frame(client, server, 113, 0x18, []byte("nop")),
+		frame(client, server, 116, 0x11, nil),
+	)
+
+	r, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAssembler()
+	streams := make(map[string][]byte)
+	gaps := 0
+	for {
+		seg, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seg.Time.Unix() != 1700000000 || seg.Time.Nanosecond()%int(time.Microsecond) != 0 {
+			t.Fatalf("时间戳: %v", seg.Time)
+		}
+		out, gap := a.Add(seg)
+		if gap {
+			gaps++
+		}
+		key := Key(seg.Src, seg.Dst)
+		streams[key] = append(streams[key], out...)
+	}
+
+	if got := string(streams[Key(client, server)]); got != "abcdefghijnop" {
+		t.Fatalf("客户端数据: %q", got)
+	}
+	if got := string(streams[Key(server, client)]); got != "xyz" {
+		t.Fatalf("服务端数据: %q", got)
+	}
+	if gaps != 1 {
+		t.Fatalf("空缺数: %d", gaps)
+	}
+}
+
+func TestPcapng(t *testing.T) {
+	if _, err := NewReader(bytes.NewReader([]byte{0x0a, 0x0d, 0x0d, 0x0a, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})); err == nil {
+		t.Fatal("应拒绝 pcapng")
+	}
+}
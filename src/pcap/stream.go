@@ -0,0 +1,110 @@
+package pcap
+
+// TCP 数据流重组, 按方向(源地址 -> 目的地址)维护序号, 丢弃重传数据, 缓存乱序到达的报文段
+type Assembler struct {
+	streams map[string]*stream
+}
+
+// 单方向数据流
+type stream struct {
+	// 下一个期望的序号
+	next    uint32
+	started bool
+
+	// 乱序到达的报文段, 序号 -> 数据
+	pending map[uint32][]byte
+}
+
+func NewAssembler() *Assembler {
+	return &Assembler{streams: make(map[string]*stream)}
+}
+
+// 数据流的方向标识
+func Key(src Endpoint, dst Endpoint) string {
+	return src.String() + " -> " + dst.String()
+}
+
+// 加入报文段, 返回按序新增的数据.
+// 连接结束(FIN/RST)时仍有未补齐的空缺则跳过空缺, 此时 gap 为 true, 空缺之后的数据可能无法解码
+func (this *Assembler) Add(seg *Segment) (data []byte, gap bool) {
+	key := Key(seg.Src, seg.Dst)
+	s := this.streams[key]
+	if s == nil {
+		s = &stream{pending: make(map[uint32][]byte)}
+		this.streams[key] = s
+	}
+
+	if seg.SYN {
+		s.next, s.started = seg.Seq+1, true
+		s.pending = make(map[uint32][]byte)
+		return nil, false
+	}
+
+	if len(seg.Payload) > 0 {
+		// 抓包开始于连接建立之后, 以首个报文段起算
+		if !s.started {
+			s.next, s.started = seg.Seq, true
+		}
+		data = s.accept(seg.Seq, seg.Payload, data)
+		data = s.drain(data)
+	}
+
+	if (seg.FIN || seg.RST) && len(s.pending) > 0 {
+		for len(s.pending) > 0 {
+			s.next = s.lowest()
+			data = s.drain(data)
+		}
+		gap = true
+	}
+	if seg.FIN || seg.RST {
+		delete(this.streams, key)
+	}
+	return data, gap
+}
+
+// 接收序号为 seq 的数据, 按序部分追加至 out, 超前的数据缓存
+func (this *stream) accept(seq uint32, payload []byte, out []byte) []byte {
+	d := int32(seq - this.next)
+	if d > 0 {
+		if _, ok := this.pending[seq]; !ok {
+			this.pending[seq] = append([]byte(nil), payload...)
+		}
+		return out
+	}
+
+	// 重传, 仅保留未收到的部分
+	if int(-d) >= len(payload) {
+		return out
+	}
+	payload = payload[-d:]
+	this.next += uint32(len(payload))
+	return append(out, payload...)
+}
+
+// 取出已可按序拼接的缓存数据
+func (this *stream) drain(out []byte) []byte {
+	for {
+		found := false
+		for seq, payload := range this.pending {
+			if int32(seq-this.next) <= 0 {
+				delete(this.pending, seq)
+				out = this.accept(seq, payload, out)
+				found = true
+			}
+		}
+		if !found {
+			return out
+		}
+	}
+}
+
+// 缓存中最小的序号
+func (this *stream) lowest() uint32 {
+	first, lowest := true, uint32(0)
+	for seq := range this.pending {
+		if first || int32(seq-lowest) < 0 {
+			first, lowest = false, seq
+		}
+	}
+	return lowest
+}
@@ -0,0 +1,424 @@
+package persist
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 落盘策略
+type SyncPolicy byte
+
+const (
+	// 预写日志、订阅变更及会话删除、替换返回前落盘, 并发写入共享一次 fsync.
+	// 待确认、离线、保留及延迟消息等其余记录不单独落盘, 随后续落盘写入
+	SyncAlways SyncPolicy = iota
+
+	// 每隔 SyncInterval 落盘一次, 崩溃时可能丢失最近一个间隔内已确认的消息
+	SyncBatch
+
+	// 不主动落盘, 由操作系统决定
+	SyncNever
+)
+
+func (this SyncPolicy) String() string {
+	switch this {
+	case SyncAlways:
+		return "always"
+	case SyncBatch:
+		return "batch"
+	case SyncNever:
+		return "never"
+	default:
+		return fmt.Sprintf("SyncPolicy(%d)", byte(this))
+	}
+}
+
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch s {
+	case "always":
+		return SyncAlways, nil
+	case "batch":
+		return SyncBatch, nil
+	case "never":
+		return SyncNever, nil
+	default:
+		return 0, errors.New(fmt.Sprintf("非法的落盘策略: %s", s))
+	}
+}
+
+var (
+	// 落盘策略
+	Sync = SyncAlways
+
+	// SyncBatch 策略的落盘间隔
+	SyncInterval = 10 * time.Millisecond
+
+	// 压缩检查间隔
+	CompactInterval = time.Minute
+
+	// 日志记录数超过此值且超过当前状态所需记录数两倍时压缩
+	CompactMin = 10000
+
+	// 单条记录最大字节数, 重放时超出即视为损坏; 0 为不限制.
+	// 载荷以 base64 编码, 须大于最大报文的 4/3
+	MaxRecordSize = 2 << 20
+)
+
+// 日志文件名
+const logName = "state.log"
+
+// 目录锁文件名, 防止多个进程同时写入同一目录
+const lockName = "lock"
+
+// 记录头: 4 字节长度 + 4 字节 crc32
+const headerSize = 8
+
+// 磁盘实现.
+// 全部状态保存在内存中, 每次变更先以 [长度][crc32][json] 追加到日志文件再应用;
+// 启动时重放日志恢复状态, 失效记录过多时以当前状态重写日志(压缩)
+type Disk struct {
+	*Memory
+
+	path string
+	file *os.File
+
+	// 目录锁, 关闭时释放
+	lockFile *os.File
+
+	// 日志中的记录数
+	logged int
+
+	// 已写入及已落盘的日志位置(字节)
+	written int64
+	synced  int64
+
+	// 落盘锁, 保护 synced 及落盘期间的文件切换
+	syncLock sync.Mutex
+
+	stop chan struct{}
+}
+
+// 打开 dir 下的日志并恢复状态
+func OpenDisk(dir string) (*Disk, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	lockFile, err := lockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Disk{
+		Memory:   NewMemory(),
+		path:     filepath.Join(dir, logName),
+		lockFile: lockFile,
+		stop:     make(chan struct{}),
+	}
+	if err := d.replay(); err != nil {
+		d.unlock()
+		return nil, err
+	}
+	file, err := os.OpenFile(d.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		d.unlock()
+		return nil, err
+	}
+	d.file = file
+	d.journal = d.append
+	d.commit = d.sync
+
+	go d.compactLoop()
+	if Sync == SyncBatch {
+		go d.syncLoop()
+	}
+	return d, nil
+}
+
+// 重放日志, 尾部不完整或损坏的记录(写入中途崩溃)被截断
+func (this *Disk) replay() error {
+	logged, err := replay(this.path, this.Memory, true)
+	if err != nil {
+		return err
+	}
+	this.logged = logged
+
+	log.Printf("持久化日志 %s 已恢复, 记录数: %d, 会话数: %d, 保留消息数: %d\n",
+		this.path, this.logged, len(this.sessions), len(this.retained))
+	return nil
+}
+
+// 只读加载 dir 下的日志, 不截断损坏的尾部, 供离线导出使用
+func LoadDisk(dir string) (*Memory, error) {
+	m := NewMemory()
+	if _, err := replay(filepath.Join(dir, logName), m, false); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// 将日志重放到 m, 返回有效记录数
+func replay(path string, m *Memory, truncate bool) (int, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	var offset int64
+	logged := 0
+	for {
+		rec, n, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if !truncate {
+				log.Printf("持久化日志 %s 于偏移 %d 处损坏, 忽略其后的记录: %v\n", path, offset, err)
+				break
+			}
+			log.Printf("持久化日志 %s 于偏移 %d 处损坏, 截断: %v\n", path, offset, err)
+			if err := os.Truncate(path, offset); err != nil {
+				return 0, err
+			}
+			break
+		}
+
+		m.mutate(rec)
+		logged++
+		offset += int64(n)
+	}
+	return logged, nil
+}
+
+// 读取一条记录, 返回记录及其占用的字节数
+func readRecord(r *bufio.Reader) (*record, int, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, errors.New("记录头不完整")
+		}
+		return nil, 0, err
+	}
+
+	// 长度损坏时避免按其分配内存
+	size := binary.BigEndian.Uint32(header[:4])
+	if MaxRecordSize > 0 && int64(size) > int64(MaxRecordSize) {
+		return nil, 0, errors.New(fmt.Sprintf("记录长度 %d 超出上限 %d", size, MaxRecordSize))
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, 0, errors.New("记录不完整")
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, 0, errors.New("记录校验失败")
+	}
+
+	rec := new(record)
+	if err := json.Unmarshal(body, rec); err != nil {
+		return nil, 0, err
+	}
+	return rec, headerSize + int(size), nil
+}
+
+// 编码一条记录
+func encodeRecord(r *record) ([]byte, error) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	if MaxRecordSize > 0 && len(body) > MaxRecordSize {
+		return nil, errors.New(fmt.Sprintf("记录长度 %d 超出上限 %d", len(body), MaxRecordSize))
+	}
+
+	buf := make([]byte, headerSize+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(len(body)))
+	binary.BigEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(body))
+	copy(buf[headerSize:], body)
+	return buf, nil
+}
+
+// 追加一条记录, 返回写入后的日志位置, 调用时持有写锁
+func (this *Disk) append(r *record) (int64, error) {
+	buf, err := encodeRecord(r)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := this.file.Write(buf); err != nil {
+		return 0, errors.New(fmt.Sprintf("持久化日志写入失败: %v", err))
+	}
+	this.logged++
+	return atomic.AddInt64(&this.written, int64(len(buf))), nil
+}
+
+// SyncAlways 策略下, 预写日志及订阅变更在返回前落盘.
+// 其余记录随后续落盘一并写入, 崩溃丢失时由未完成投递的预写日志重放补齐
+func (this *Disk) sync(r *record, pos int64) error {
+	if Sync != SyncAlways {
+		return nil
+	}
+	switch r.Op {
+	case opAccept, opSubscribe, opUnsubscribe, opDeleteSession, opReplaceSession:
+		return this.flush(pos)
+	}
+	return nil
+}
+
+// 落盘至少至 pos, 已被其他写入方的落盘覆盖时直接返回
+func (this *Disk) flush(pos int64) error {
+	this.syncLock.Lock()
+	defer this.syncLock.Unlock()
+
+	if this.synced >= pos {
+		return nil
+	}
+	written := atomic.LoadInt64(&this.written)
+	if err := this.file.Sync(); err != nil {
+		return errors.New(fmt.Sprintf("持久化日志落盘失败: %v", err))
+	}
+	this.synced = written
+	return nil
+}
+
+func (this *Disk) syncLoop() {
+	ticker := time.NewTicker(SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := this.flush(atomic.LoadInt64(&this.written)); err != nil {
+				log.Printf("%v\n", err)
+			}
+		case <-this.stop:
+			return
+		}
+	}
+}
+
+func (this *Disk) compactLoop() {
+	ticker := time.NewTicker(CompactInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := this.Compact(false); err != nil {
+				log.Printf("持久化日志压缩失败: %v\n", err)
+			}
+		case <-this.stop:
+			return
+		}
+	}
+}
+
+// 以当前状态重写日志, force 为 false 时仅在失效记录过多时执行.
+// 先写临时文件并落盘再替换, 压缩期间写入方阻塞
+func (this *Disk) Compact(force bool) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	live := 0
+	this.records(func(r *record) error {
+		live++
+		return nil
+	})
+	if !force && (this.logged <= CompactMin || this.logged <= 2*live) {
+		return nil
+	}
+
+	tmp := this.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	err = this.records(func(r *record) error {
+		buf, err := encodeRecord(r)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(buf)
+		return err
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, this.path); err != nil {
+		return err
+	}
+
+	// 新日志已落盘, 切换文件期间阻止落盘
+	syncDir(filepath.Dir(this.path))
+	newFile, err := os.OpenFile(this.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	this.syncLock.Lock()
+	this.file.Close()
+	this.file = newFile
+	this.synced = atomic.LoadInt64(&this.written)
+	this.syncLock.Unlock()
+
+	log.Printf("持久化日志已压缩, 记录数: %d -> %d\n", this.logged, live)
+	this.logged = live
+	return nil
+}
+
+func (this *Disk) Close() error {
+	close(this.stop)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	defer this.unlock()
+
+	if Sync != SyncNever {
+		if err := this.file.Sync(); err != nil {
+			return err
+		}
+	}
+	return this.file.Close()
+}
+
+// 释放目录锁
+func (this *Disk) unlock() {
+	if this.lockFile != nil {
+		this.lockFile.Close()
+	}
+}
+
+// 目录落盘, 保证重命名持久化
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
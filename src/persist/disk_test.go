@@ -0,0 +1,362 @@
+package persist
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	log.SetOutput(ioutil.Discard)
+	dir, err := ioutil.TempDir("", "persist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func openDisk(t *testing.T, dir string) *Disk {
+	t.Helper()
+	d, err := OpenDisk(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func msg(topic string, qos byte) *Message {
+	return &Message{Topic: topic, Qos: qos, Payload: []byte("payload-" + topic)}
+}
+
+// 覆盖全部操作类型的变更
+func mutate(t *testing.T, p Persistence) {
+	must(t, p.SaveSession("c1", time.Time{}))
+	must(t, p.Subscribe("c1", "a/b", 1))
+	must(t, p.Subscribe("c1", "a/#", 2))
+	must(t, p.Unsubscribe("c1", "a/b"))
+
+	m := msg("a/1", 1)
+	m.Id = 1
+	must(t, p.SaveInflight("c1", m))
+	m = msg("a/2", 2)
+	m.Id = 2
+	must(t, p.SaveInflight("c1", m))
+	must(t, p.DeleteInflight("c1", 1))
+	must(t, p.SaveInflight("c1", &Message{Id: 2, Qos: 2, Released: true}))
+
+	for _, topic := range []string{"q/1", "q/2", "q/3"} {
+		must(t, p.Enqueue("c1", msg(topic, 1)))
+	}
+	must(t, p.DeleteQueued("c1", 1))
+	must(t, p.SaveSession("c1", time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)))
+
+	must(t, p.SaveSession("c2", time.Time{}))
+	must(t, p.Subscribe("c2", "x", 0))
+	must(t, p.DeleteSession("c2"))
+
+	m = msg("z/1", 1)
+	m.Id = 7
+	must(t, p.ReplaceSession(&Session{ClientId: "c3", Subs: map[string]byte{"z": 1}}))
+	must(t, p.ReplaceSession(&Session{
+		ClientId: "c3",
+		Subs:     map[string]byte{"z/#": 2},
+		Inflight: map[uint16]*Message{7: m},
+		Queued:   []*Message{msg("z/2", 1)},
+	}))
+
+	r := msg("r/1", 1)
+	r.Retain = true
+	must(t, p.SaveRetained(r))
+	r = msg("r/2", 0)
+	r.Retain = true
+	must(t, p.SaveRetained(r))
+	must(t, p.DeleteRetained("r/1"))
+
+	seq, err := p.Accept(msg("w/1", 1))
+	must(t, err)
+	_, err = p.Accept(msg("w/2", 2))
+	must(t, err)
+	must(t, p.Routed(seq))
+
+	must(t, p.SaveDelayed(&Delayed{Id: 1, Deliver: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), Msg: msg("d/1", 0)}))
+	must(t, p.SaveDelayed(&Delayed{Id: 2, Deliver: time.Date(2026, 1, 1, 0, 0, 1, 0, time.UTC), Msg: msg("d/2", 1)}))
+	must(t, p.DeleteDelayed(1))
+}
+
+// 以 json 表示的全部状态, 用于比较
+func state(t *testing.T, p Persistence) string {
+	t.Helper()
+	data, err := json.Marshal(map[string]interface{}{
+		"sessions": p.Sessions(),
+		"retained": p.AllRetained(),
+		"unrouted": p.Unrouted(),
+		"delayed":  p.AllDelayed(),
+	})
+	must(t, err)
+	return string(data)
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	must(t, err)
+	return info.Size()
+}
+
+// 重放日志恢复的状态与内存实现一致
+func TestReplay(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	m := NewMemory()
+	mutate(t, m)
+	want := state(t, m)
+
+	d := openDisk(t, dir)
+	mutate(t, d)
+	if got := state(t, d); got != want {
+		t.Fatalf("磁盘实现状态:\n%s\n应为:\n%s", got, want)
+	}
+	must(t, d.Close())
+
+	d = openDisk(t, dir)
+	defer d.Close()
+	if got := state(t, d); got != want {
+		t.Fatalf("重放后状态:\n%s\n应为:\n%s", got, want)
+	}
+
+	s := d.Session("c1")
+	if !reflect.DeepEqual(s.Subs, map[string]byte{"a/#": 2}) {
+		t.Fatalf("订阅: %v", s.Subs)
+	}
+	if len(s.Inflight) != 1 || !s.Inflight[2].Released {
+		t.Fatalf("待确认消息: %v", s.Inflight)
+	}
+	if len(s.Queued) != 2 || s.Queued[0].Topic != "q/2" {
+		t.Fatalf("离线消息: %v", s.Queued)
+	}
+	if d.HasSession("c2") {
+		t.Fatal("已删除的会话不应恢复")
+	}
+	if s := d.Session("c3"); !reflect.DeepEqual(s.Subs, map[string]byte{"z/#": 2}) || len(s.Inflight) != 1 || len(s.Queued) != 1 {
+		t.Fatalf("替换的会话: %+v", s)
+	}
+}
+
+// 写入中途崩溃留下的不完整记录在重放时截断, 此后可继续追加
+func TestTornTail(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, logName)
+
+	d := openDisk(t, dir)
+	mutate(t, d)
+	want := state(t, d)
+	must(t, d.Close())
+	size := fileSize(t, path)
+
+	buf, err := encodeRecord(&record{Op: opRetain, Msg: msg("r/torn", 0)})
+	must(t, err)
+	for _, n := range []int{3, headerSize, len(buf) - 1} {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+		must(t, err)
+		_, err = file.Write(buf[:n])
+		must(t, err)
+		must(t, file.Close())
+
+		d = openDisk(t, dir)
+		if got := state(t, d); got != want {
+			t.Fatalf("截断 %d 字节后状态:\n%s\n应为:\n%s", n, got, want)
+		}
+		must(t, d.Close())
+		if got := fileSize(t, path); got != size {
+			t.Fatalf("截断后日志大小: %d, 应为 %d", got, size)
+		}
+	}
+
+	d = openDisk(t, dir)
+	must(t, d.SaveRetained(msg("r/after", 0)))
+	must(t, d.Close())
+	d = openDisk(t, dir)
+	defer d.Close()
+	if len(d.Retained("r/after")) != 1 {
+		t.Fatal("截断后追加的记录丢失")
+	}
+}
+
+// 校验失败的记录及其后的记录被丢弃; 只读加载不修改日志
+func TestCrcMismatch(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, logName)
+
+	d := openDisk(t, dir)
+	mutate(t, d)
+	want := state(t, d)
+	must(t, d.Close())
+	size := fileSize(t, path)
+
+	d = openDisk(t, dir)
+	must(t, d.SaveRetained(msg("r/bad", 0)))
+	must(t, d.SaveRetained(msg("r/next", 0)))
+	must(t, d.Close())
+
+	// 翻转第一条新记录中的一个字节
+	data, err := ioutil.ReadFile(path)
+	must(t, err)
+	data[size+headerSize+2] ^= 0xff
+	must(t, ioutil.WriteFile(path, data, 0644))
+
+	m, err := LoadDisk(dir)
+	must(t, err)
+	if got := state(t, m); got != want {
+		t.Fatalf("只读加载状态:\n%s\n应为:\n%s", got, want)
+	}
+	if got := fileSize(t, path); got != int64(len(data)) {
+		t.Fatal("只读加载不应截断日志")
+	}
+
+	d = openDisk(t, dir)
+	defer d.Close()
+	if got := state(t, d); got != want {
+		t.Fatalf("重放后状态:\n%s\n应为:\n%s", got, want)
+	}
+	if got := fileSize(t, path); got != size {
+		t.Fatalf("截断后日志大小: %d, 应为 %d", got, size)
+	}
+}
+
+// 压缩以当前状态重写日志, 压缩后的日志可重放并继续追加
+func TestCompact(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, logName)
+
+	d := openDisk(t, dir)
+	mutate(t, d)
+	for i := 0; i < 100; i++ {
+		must(t, d.Subscribe("c1", "churn", 1))
+		must(t, d.Unsubscribe("c1", "churn"))
+	}
+	want := state(t, d)
+	before := fileSize(t, path)
+
+	// 记录数未超过 CompactMin, 非强制压缩不执行
+	must(t, d.Compact(false))
+	if fileSize(t, path) != before {
+		t.Fatal("记录数未超过下限时不应压缩")
+	}
+
+	must(t, d.Compact(true))
+	if after := fileSize(t, path); after >= before/4 {
+		t.Fatalf("压缩后日志大小: %d, 压缩前: %d", after, before)
+	}
+	if got := state(t, d); got != want {
+		t.Fatalf("压缩后状态:\n%s\n应为:\n%s", got, want)
+	}
+
+	must(t, d.SaveRetained(msg("r/after", 0)))
+	must(t, d.Close())
+
+	d = openDisk(t, dir)
+	defer d.Close()
+	if len(d.Retained("r/after")) != 1 {
+		t.Fatal("压缩后追加的记录丢失")
+	}
+	must(t, d.DeleteRetained("r/after"))
+	if got := state(t, d); got != want {
+		t.Fatalf("压缩后重放状态:\n%s\n应为:\n%s", got, want)
+	}
+}
+
+// 未完成投递的消息按序号重放, 序号在重启及压缩后延续
+func TestAcceptRouted(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	d := openDisk(t, dir)
+	var seqs []uint64
+	for _, topic := range []string{"w/1", "w/2", "w/3"} {
+		seq, err := d.Accept(msg(topic, 1))
+		must(t, err)
+		seqs = append(seqs, seq)
+	}
+	if !reflect.DeepEqual(seqs, []uint64{1, 2, 3}) {
+		t.Fatalf("序号: %v", seqs)
+	}
+	must(t, d.Routed(2))
+	must(t, d.Close())
+
+	unrouted := func(d *Disk) []string {
+		var topics []string
+		for _, m := range d.Unrouted() {
+			topics = append(topics, m.Topic)
+		}
+		return topics
+	}
+
+	d = openDisk(t, dir)
+	if topics := unrouted(d); !reflect.DeepEqual(topics, []string{"w/1", "w/3"}) {
+		t.Fatalf("未完成投递: %v", topics)
+	}
+	if seq, err := d.Accept(msg("w/4", 1)); err != nil || seq != 4 {
+		t.Fatalf("重放后序号: %d %v", seq, err)
+	}
+	must(t, d.Routed(1))
+	must(t, d.Routed(3))
+	must(t, d.Compact(true))
+	must(t, d.Close())
+
+	d = openDisk(t, dir)
+	defer d.Close()
+	if topics := unrouted(d); !reflect.DeepEqual(topics, []string{"w/4"}) {
+		t.Fatalf("压缩后未完成投递: %v", topics)
+	}
+	if seq, err := d.Accept(msg("w/5", 1)); err != nil || seq != 5 {
+		t.Fatalf("压缩后序号: %d %v", seq, err)
+	}
+}
+
+// 离线队列已满时拒绝入队且不写入日志
+func TestQueueFull(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	origin := MaxQueued
+	MaxQueued = 2
+	defer func() { MaxQueued = origin }()
+
+	d := openDisk(t, dir)
+	must(t, d.SaveSession("c1", time.Time{}))
+	must(t, d.Enqueue("c1", msg("q/1", 1)))
+	must(t, d.Enqueue("c1", msg("q/2", 1)))
+	if err := d.Enqueue("c1", msg("q/3", 1)); err != ErrQueueFull {
+		t.Fatalf("应返回 ErrQueueFull: %v", err)
+	}
+
+	// 替换的会话超出上限时保留原会话
+	queued := []*Message{msg("q/1", 1), msg("q/2", 1), msg("q/3", 1)}
+	if err := d.ReplaceSession(&Session{ClientId: "c1", Queued: queued}); err != ErrQueueFull {
+		t.Fatalf("应返回 ErrQueueFull: %v", err)
+	}
+	logged := d.logged
+	must(t, d.Close())
+
+	d = openDisk(t, dir)
+	defer d.Close()
+	if d.logged != logged || len(d.Session("c1").Queued) != 2 {
+		t.Fatalf("记录数: %d, 离线消息: %d", d.logged, len(d.Session("c1").Queued))
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package persist
+
+import "os"
+
+// 不支持 flock 的平台不加锁, 由使用者保证同一目录仅被一个进程打开
+func lockDir(dir string) (*os.File, error) {
+	return nil, nil
+}
@@ -0,0 +1,408 @@
+package persist
+
+import (
+	"mqtt-go/src/utils"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 操作类型
+const (
+	opSession byte = iota + 1
+	opDeleteSession
+	opSubscribe
+	opUnsubscribe
+	opInflight
+	opDeleteInflight
+	opEnqueue
+	opDeleteQueued
+	opRetain
+	opDeleteRetain
+	opAccept
+	opRouted
+	opDelay
+	opDeleteDelay
+	opReplaceSession
+)
+
+// 一次状态变更, 内存实现直接应用, 磁盘实现先追加到日志
+type record struct {
+	Op       byte      `json:"op"`
+	ClientId string    `json:"c,omitempty"`
+	Topic    string    `json:"t,omitempty"`
+	Qos      byte      `json:"q,omitempty"`
+	Id       uint16    `json:"i,omitempty"`
+	N        int       `json:"n,omitempty"`
+	Seq      uint64    `json:"s,omitempty"`
+	Time     time.Time `json:"tm,omitempty"`
+	Msg      *Message  `json:"m,omitempty"`
+	Session  *Session  `json:"ss,omitempty"`
+}
+
+// 内存实现, 重启后丢失
+type Memory struct {
+	lock sync.RWMutex
+
+	sessions map[string]*Session
+	retained map[string]*Message
+
+	// id <--> 延迟消息
+	delayed map[uint64]*Delayed
+
+	// 已接收未投递的消息
+	accepted map[uint64]*Message
+	seq      uint64
+
+	// 变更应用前调用, 返回日志位置, 返回错误时放弃变更; 调用时持有写锁
+	journal func(r *record) (int64, error)
+
+	// 变更应用后在锁外调用, 等待 journal 返回的位置落盘
+	commit func(r *record, pos int64) error
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		sessions: make(map[string]*Session),
+		retained: make(map[string]*Message),
+		accepted: make(map[uint64]*Message),
+		delayed:  make(map[uint64]*Delayed),
+	}
+}
+
+func (this *Memory) HasSession(clientId string) bool {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	_, ok := this.sessions[clientId]
+	return ok
+}
+
+func (this *Memory) Session(clientId string) *Session {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	s := this.sessions[clientId]
+	if s == nil {
+		return nil
+	}
+	return s.copy()
+}
+
+func (this *Memory) Sessions() []*Session {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	sessions := make([]*Session, 0, len(this.sessions))
+	for _, s := range this.sessions {
+		sessions = append(sessions, s.copy())
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ClientId < sessions[j].ClientId })
+	return sessions
+}
+
+func (this *Memory) SaveSession(clientId string, disconnected time.Time) error {
+	return this.apply(&record{Op: opSession, ClientId: clientId, Time: disconnected})
+}
+
+func (this *Memory) DeleteSession(clientId string) error {
+	if !this.HasSession(clientId) {
+		return nil
+	}
+	return this.apply(&record{Op: opDeleteSession, ClientId: clientId})
+}
+
+func (this *Memory) ReplaceSession(s *Session) error {
+	return this.apply(&record{Op: opReplaceSession, ClientId: s.ClientId, Session: s.copy()})
+}
+
+func (this *Memory) Subscribe(clientId string, topic string, qos byte) error {
+	return this.apply(&record{Op: opSubscribe, ClientId: clientId, Topic: topic, Qos: qos})
+}
+
+func (this *Memory) Unsubscribe(clientId string, topic string) error {
+	return this.apply(&record{Op: opUnsubscribe, ClientId: clientId, Topic: topic})
+}
+
+func (this *Memory) SaveInflight(clientId string, msg *Message) error {
+	return this.apply(&record{Op: opInflight, ClientId: clientId, Msg: msg})
+}
+
+func (this *Memory) DeleteInflight(clientId string, id uint16) error {
+	return this.apply(&record{Op: opDeleteInflight, ClientId: clientId, Id: id})
+}
+
+func (this *Memory) Enqueue(clientId string, msg *Message) error {
+	return this.apply(&record{Op: opEnqueue, ClientId: clientId, Msg: msg})
+}
+
+func (this *Memory) DeleteQueued(clientId string, n int) error {
+	return this.apply(&record{Op: opDeleteQueued, ClientId: clientId, N: n})
+}
+
+func (this *Memory) Accept(msg *Message) (uint64, error) {
+	// 序号在锁内分配, 保证日志中有序
+	r := &record{Op: opAccept, Msg: msg}
+	if err := this.apply(r); err != nil {
+		return 0, err
+	}
+	return r.Seq, nil
+}
+
+func (this *Memory) Routed(seq uint64) error {
+	return this.apply(&record{Op: opRouted, Seq: seq})
+}
+
+func (this *Memory) Unrouted() []*Message {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	msgs := make([]*Message, 0, len(this.accepted))
+	for _, msg := range this.accepted {
+		msgs = append(msgs, msg)
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Seq < msgs[j].Seq })
+	return msgs
+}
+
+func (this *Memory) Retained(filter string) []*Message {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	if !strings.ContainsAny(filter, "+#") {
+		if msg := this.retained[filter]; msg != nil {
+			return []*Message{msg}
+		}
+		return nil
+	}
+
+	var msgs []*Message
+	for topic, msg := range this.retained {
+		if utils.Match(topic, filter) {
+			msgs = append(msgs, msg)
+		}
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Topic < msgs[j].Topic })
+	return msgs
+}
+
+func (this *Memory) AllRetained() []*Message {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	msgs := make([]*Message, 0, len(this.retained))
+	for _, msg := range this.retained {
+		msgs = append(msgs, msg)
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Topic < msgs[j].Topic })
+	return msgs
+}
+
+func (this *Memory) SaveRetained(msg *Message) error {
+	return this.apply(&record{Op: opRetain, Msg: msg})
+}
+
+func (this *Memory) DeleteRetained(topic string) error {
+	return this.apply(&record{Op: opDeleteRetain, Topic: topic})
+}
+
+func (this *Memory) SaveDelayed(d *Delayed) error {
+	return this.apply(&record{Op: opDelay, Seq: d.Id, Time: d.Deliver, Msg: d.Msg})
+}
+
+func (this *Memory) DeleteDelayed(id uint64) error {
+	return this.apply(&record{Op: opDeleteDelay, Seq: id})
+}
+
+func (this *Memory) AllDelayed() []*Delayed {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	delayed := make([]*Delayed, 0, len(this.delayed))
+	for _, d := range this.delayed {
+		delayed = append(delayed, d)
+	}
+	sort.Slice(delayed, func(i, j int) bool { return delayed[i].Id < delayed[j].Id })
+	return delayed
+}
+
+func (this *Memory) Close() error {
+	return nil
+}
+
+// 记录变更并应用
+func (this *Memory) apply(r *record) error {
+	pos, err := this.record(r)
+	if err != nil {
+		return err
+	}
+	if this.commit != nil {
+		return this.commit(r, pos)
+	}
+	return nil
+}
+
+func (this *Memory) record(r *record) (int64, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if err := this.check(r); err != nil {
+		return 0, err
+	}
+	if r.Op == opAccept {
+		r.Seq = this.seq + 1
+		msg := *r.Msg
+		msg.Seq = r.Seq
+		r.Msg = &msg
+	}
+
+	var pos int64
+	if this.journal != nil {
+		var err error
+		if pos, err = this.journal(r); err != nil {
+			return 0, err
+		}
+	}
+	this.mutate(r)
+	return pos, nil
+}
+
+// 校验变更, 调用方需持有锁
+func (this *Memory) check(r *record) error {
+	if r.Op == opEnqueue && MaxQueued > 0 {
+		if s := this.sessions[r.ClientId]; s != nil && len(s.Queued) >= MaxQueued {
+			return ErrQueueFull
+		}
+	}
+	if r.Op == opReplaceSession && MaxQueued > 0 && len(r.Session.Queued) > MaxQueued {
+		return ErrQueueFull
+	}
+	return nil
+}
+
+// 应用变更, 调用方需持有锁
+func (this *Memory) mutate(r *record) {
+	switch r.Op {
+	case opDeleteSession:
+		delete(this.sessions, r.ClientId)
+		return
+	case opReplaceSession:
+		// 记录中的会话为副本, 直接持有
+		this.sessions[r.ClientId] = r.Session
+		return
+	case opRetain:
+		this.retained[r.Msg.Topic] = r.Msg
+		return
+	case opDeleteRetain:
+		delete(this.retained, r.Topic)
+		return
+	case opAccept:
+		this.accepted[r.Msg.Seq] = r.Msg
+		if r.Msg.Seq > this.seq {
+			this.seq = r.Msg.Seq
+		}
+		return
+	case opRouted:
+		delete(this.accepted, r.Seq)
+		return
+	case opDelay:
+		this.delayed[r.Seq] = &Delayed{Id: r.Seq, Deliver: r.Time, Msg: r.Msg}
+		return
+	case opDeleteDelay:
+		delete(this.delayed, r.Seq)
+		return
+	}
+
+	s := this.sessions[r.ClientId]
+	if s == nil {
+		s = newSession(r.ClientId)
+		this.sessions[r.ClientId] = s
+	}
+	switch r.Op {
+	case opSession:
+		s.Disconnected = r.Time
+	case opSubscribe:
+		s.Subs[r.Topic] = r.Qos
+	case opUnsubscribe:
+		delete(s.Subs, r.Topic)
+	case opInflight:
+		s.Inflight[r.Msg.Id] = r.Msg
+	case opDeleteInflight:
+		delete(s.Inflight, r.Id)
+	case opEnqueue:
+		s.Queued = append(s.Queued, r.Msg)
+	case opDeleteQueued:
+		n := r.N
+		if n > len(s.Queued) {
+			n = len(s.Queued)
+		}
+		left := copy(s.Queued, s.Queued[n:])
+		for i := left; i < len(s.Queued); i++ {
+			s.Queued[i] = nil
+		}
+		s.Queued = s.Queued[:left]
+	}
+}
+
+// 以当前状态重建的最少变更, 用于日志压缩
+func (this *Memory) records(fn func(r *record) error) error {
+	for _, s := range this.sessions {
+		if err := fn(&record{Op: opSession, ClientId: s.ClientId, Time: s.Disconnected}); err != nil {
+			return err
+		}
+		for topic, qos := range s.Subs {
+			if err := fn(&record{Op: opSubscribe, ClientId: s.ClientId, Topic: topic, Qos: qos}); err != nil {
+				return err
+			}
+		}
+		for _, msg := range s.Inflight {
+			if err := fn(&record{Op: opInflight, ClientId: s.ClientId, Msg: msg}); err != nil {
+				return err
+			}
+		}
+		for _, msg := range s.Queued {
+			if err := fn(&record{Op: opEnqueue, ClientId: s.ClientId, Msg: msg}); err != nil {
+				return err
+			}
+		}
+	}
+	for _, msg := range this.retained {
+		if err := fn(&record{Op: opRetain, Msg: msg}); err != nil {
+			return err
+		}
+	}
+	for _, msg := range this.accepted {
+		if err := fn(&record{Op: opAccept, Msg: msg}); err != nil {
+			return err
+		}
+	}
+	for _, d := range this.delayed {
+		if err := fn(&record{Op: opDelay, Seq: d.Id, Time: d.Deliver, Msg: d.Msg}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newSession(clientId string) *Session {
+	return &Session{
+		ClientId: clientId,
+		Subs:     make(map[string]byte),
+		Inflight: make(map[uint16]*Message),
+	}
+}
+
+// 复制会话, 消息本身不可变, 仅复制容器
+func (this *Session) copy() *Session {
+	s := newSession(this.ClientId)
+	s.Disconnected = this.Disconnected
+	for topic, qos := range this.Subs {
+		s.Subs[topic] = qos
+	}
+	for id, msg := range this.Inflight {
+		s.Inflight[id] = msg
+	}
+	s.Queued = append(s.Queued, this.Queued...)
+	return s
+}
@@ -0,0 +1,122 @@
+// 持久化: 会话、订阅、待确认及离线消息、保留消息
+
+package persist
+
+import (
+	"errors"
+	"time"
+)
+
+// 离线消息队列已满
+var ErrQueueFull = errors.New("离线消息队列已满")
+
+// 单个会话最多保存的离线消息数, 0 为不限制
+var MaxQueued = 1000
+
+// 持久化消息, 保存后不再修改
+type Message struct {
+	// packetId, 仅待确认消息有效
+	Id uint16 `json:"id,omitempty"`
+
+	// 预写日志序号, 仅已接收待投递的消息有效
+	Seq uint64 `json:"seq,omitempty"`
+
+	Topic   string `json:"topic,omitempty"`
+	Qos     byte   `json:"qos"`
+	Retain  bool   `json:"retain,omitempty"`
+	Payload []byte `json:"payload,omitempty"`
+
+	// qos2 消息已收到 PUBREC, 等待 PUBCOMP
+	Released bool `json:"released,omitempty"`
+}
+
+// 延迟消息, 到期后投递
+type Delayed struct {
+	Id      uint64    `json:"id"`
+	Deliver time.Time `json:"deliver"`
+	Msg     *Message  `json:"msg"`
+}
+
+// 持久会话(cleanSession = false)
+type Session struct {
+	ClientId string `json:"clientId"`
+
+	// 断开时间, 在线时为零值
+	Disconnected time.Time `json:"disconnected"`
+
+	// topic <--> qos
+	Subs map[string]byte `json:"subs"`
+
+	// 已发出待确认的消息
+	Inflight map[uint16]*Message `json:"inflight"`
+
+	// 离线期间的 qos1/qos2 消息
+	Queued []*Message `json:"queued"`
+}
+
+// 持久化接口.
+// 写入方法返回后修改即已生效, 是否已落盘由实现决定; 读取方法返回的数据调用方不得修改
+type Persistence interface {
+	// 会话是否存在
+	HasSession(clientId string) bool
+
+	// 返回会话副本, 不存在时返回 nil
+	Session(clientId string) *Session
+
+	// 全部会话副本
+	Sessions() []*Session
+
+	// 创建会话或更新断开时间
+	SaveSession(clientId string, disconnected time.Time) error
+
+	// 删除会话及其订阅与消息
+	DeleteSession(clientId string) error
+
+	// 以完整的会话替换同名会话, 一次生效; 离线消息超出 MaxQueued 时返回 ErrQueueFull 且不做修改
+	ReplaceSession(s *Session) error
+
+	Subscribe(clientId string, topic string, qos byte) error
+
+	Unsubscribe(clientId string, topic string) error
+
+	// 保存已发出待确认的消息, 相同 Id 覆盖
+	SaveInflight(clientId string, msg *Message) error
+
+	DeleteInflight(clientId string, id uint16) error
+
+	// 离线消息入队, 超出 MaxQueued 时返回 ErrQueueFull
+	Enqueue(clientId string, msg *Message) error
+
+	// 移除最早的 n 条离线消息
+	DeleteQueued(clientId string, n int) error
+
+	// 预写日志: 记录已接收的 qos1/qos2 消息, 返回序号; 须在投递及响应发布方之前调用
+	Accept(msg *Message) (uint64, error)
+
+	// 消息已投递到全部订阅者(在线写出或已保存到持久会话)
+	Routed(seq uint64) error
+
+	// 已接收但未完成投递的消息, 按序号排序, 用于崩溃恢复
+	Unrouted() []*Message
+
+	// 返回匹配主题过滤器的保留消息, 按主题排序 [MQTT-3.3.1-6].
+	// 须与实时投递(store.Store.Search)同样以 utils.Match 判定匹配
+	Retained(filter string) []*Message
+
+	// 全部保留消息
+	AllRetained() []*Message
+
+	SaveRetained(msg *Message) error
+
+	DeleteRetained(topic string) error
+
+	// 保存延迟消息, 相同 Id 覆盖
+	SaveDelayed(d *Delayed) error
+
+	DeleteDelayed(id uint64) error
+
+	// 全部延迟消息, 按 Id 排序
+	AllDelayed() []*Delayed
+
+	Close() error
+}
@@ -0,0 +1,312 @@
+// 报文录制: 按 clientId 或来源 IP 选择连接, 在 Channel 的读写边界记录收发的每个报文及时间,
+// 每个连接一个 JSON Lines 文件, 供 mqtt-go replay 回放
+
+package record
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mqtt-go/src/utils"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 录制配置, 须在 broker 启动前设置
+var (
+	// 录制文件目录, 为空则不录制
+	Dir string
+
+	// 需录制的 clientId
+	Clients = make(map[string]bool)
+
+	// 需录制的来源 IP
+	IPs = make(map[string]bool)
+)
+
+// 识别 clientId 之前缓存的最大字节数, 超出则放弃录制该连接
+const maxPending = 64 * 1024
+
+// 记录类型
+const (
+	// 连接建立, 包含时间及来源地址
+	TypeOpen = "open"
+
+	// 收到 CONNECT, 包含 clientId
+	TypeClient = "client"
+
+	// 客户端发往 broker 的报文
+	TypeIn = "in"
+
+	// broker 发往客户端的报文
+	TypeOut = "out"
+
+	// 连接关闭
+	TypeClose = "close"
+)
+
+// 录制文件中的一条记录
+type Entry struct {
+	Type string `json:"type"`
+
+	// 距连接建立的时长
+	Offset time.Duration `json:"offset"`
+
+	// 连接建立时间, 仅 open 记录
+	Time string `json:"time,omitempty"`
+
+	Remote   string `json:"remote,omitempty"`
+	ClientId string `json:"clientId,omitempty"`
+
+	// 完整报文, remaining length 非法时为无法定界的剩余数据
+	Data []byte `json:"data,omitempty"`
+}
+
+// 解析逗号分隔的列表
+func ParseList(s string) map[string]bool {
+	result := make(map[string]bool)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			result[v] = true
+		}
+	}
+	return result
+}
+
+// 单个连接的录制
+type Session struct {
+	lock sync.Mutex
+
+	id     string
+	remote string
+	start  time.Time
+
+	// 录制文件, 等待识别 clientId 时为 nil
+	file    *os.File
+	encoder *json.Encoder
+
+	// 识别 clientId 之前的记录
+	pending      []*Entry
+	pendingBytes int
+
+	// 不再录制
+	done bool
+
+	// 按报文拆分收发的字节流
+	in, out framer
+}
+
+// 为新连接开始录制, 来源 IP 匹配时立即写入文件, 否则在配置了 clientId 时缓存至 CONNECT.
+// 无需录制时返回 nil
+func Open(remote net.Addr, id string) *Session {
+	if Dir == "" || (len(Clients) == 0 && len(IPs) == 0) {
+		return nil
+	}
+
+	host := remote.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	matched := IPs[host]
+	if !matched && len(Clients) == 0 {
+		return nil
+	}
+
+	this := &Session{id: id, remote: remote.String(), start: time.Now()}
+	this.write(&Entry{Type: TypeOpen, Time: this.start.Format(time.RFC3339Nano), Remote: this.remote})
+	if matched {
+		this.lock.Lock()
+		this.create(host)
+		this.lock.Unlock()
+	}
+	return this
+}
+
+// 收到 CONNECT, clientId 匹配时开始写入文件, 否则连接未按 IP 录制时放弃录制
+func (this *Session) Identify(clientId string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.done {
+		return
+	}
+	if this.file == nil {
+		if !Clients[clientId] {
+			this.discard()
+			return
+		}
+		this.create(clientId)
+	}
+	this.append(&Entry{Type: TypeClient, Offset: time.Since(this.start), ClientId: clientId})
+}
+
+// 记录收到的数据
+func (this *Session) Inbound(data []byte) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.done {
+		return
+	}
+	offset := time.Since(this.start)
+	for _, packet := range this.in.split(data) {
+		this.append(&Entry{Type: TypeIn, Offset: offset, Data: packet})
+	}
+}
+
+// 记录写出的数据
+func (this *Session) Outbound(bufs net.Buffers) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.done {
+		return
+	}
+	offset := time.Since(this.start)
+	for _, buf := range bufs {
+		for _, packet := range this.out.split(buf) {
+			this.append(&Entry{Type: TypeOut, Offset: offset, Data: packet})
+		}
+	}
+}
+
+// 连接关闭, 结束录制
+func (this *Session) Close() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.done || this.file == nil {
+		this.discard()
+		return
+	}
+	this.append(&Entry{Type: TypeClose, Offset: time.Since(this.start)})
+	if err := this.file.Close(); err != nil {
+		log.Printf("录制文件关闭失败: %v\n", err)
+	}
+	this.done = true
+}
+
+// 创建录制文件并写入缓存的记录, 调用方需持有锁
+func (this *Session) create(name string) {
+	path := filepath.Join(Dir, fmt.Sprintf("%s-%s-%s.jsonl", this.start.Format("20060102T150405.000"), safeName(name), this.id))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		log.Printf("创建录制文件失败: %v\n", err)
+		this.discard()
+		return
+	}
+	log.Printf("录制连接 [%s] 至 %s\n", this.remote, path)
+
+	this.file, this.encoder = file, json.NewEncoder(file)
+	for _, entry := range this.pending {
+		this.append(entry)
+	}
+	this.pending, this.pendingBytes = nil, 0
+}
+
+// 放弃录制, 调用方需持有锁
+func (this *Session) discard() {
+	this.done = true
+	this.pending, this.pendingBytes = nil, 0
+}
+
+func (this *Session) write(entry *Entry) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.append(entry)
+}
+
+// 写入一条记录, 未识别 clientId 时缓存; 调用方需持有锁
+func (this *Session) append(entry *Entry) {
+	if this.done {
+		return
+	}
+	if this.file == nil {
+		this.pendingBytes += len(entry.Data)
+		if this.pendingBytes > maxPending {
+			this.discard()
+			return
+		}
+		this.pending = append(this.pending, entry)
+		return
+	}
+
+	if err := this.encoder.Encode(entry); err != nil {
+		log.Printf("写入录制文件失败, 停止录制: %v\n", err)
+		this.file.Close()
+		this.done = true
+	}
+}
+
+// 文件名中只保留字母、数字及 - _ .
+func safeName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// 按 remaining length 将字节流拆分为完整报文
+type framer struct {
+	buf []byte
+
+	// remaining length 非法, 此后的数据不再拆分
+	broken bool
+}
+
+// 追加数据, 返回其中的完整报文
+func (this *framer) split(data []byte) [][]byte {
+	if this.broken {
+		return [][]byte{append([]byte(nil), data...)}
+	}
+
+	this.buf = append(this.buf, data...)
+	var packets [][]byte
+	for len(this.buf) >= 2 {
+		remainingLen, digits, err := utils.DecodeRemainLength(this.buf[1:])
+		if err != nil {
+			packets = append(packets, this.buf)
+			this.buf, this.broken = nil, true
+			break
+		}
+		n := 1 + digits + remainingLen
+		if digits == 0 || len(this.buf) < n {
+			break
+		}
+		packets = append(packets, append([]byte(nil), this.buf[:n]...))
+		this.buf = this.buf[n:]
+	}
+	if len(this.buf) == 0 {
+		this.buf = nil
+	}
+	return packets
+}
+
+// 读取录制文件
+func Read(r io.Reader) ([]*Entry, error) {
+	decoder := json.NewDecoder(r)
+	entries := make([]*Entry, 0, 64)
+	for {
+		entry := new(Entry)
+		if err := decoder.Decode(entry); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, errors.New(fmt.Sprintf("非法的录制文件, 第 %d 条记录: %v", len(entries)+1, err))
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 || entries[0].Type != TypeOpen {
+		return nil, errors.New("非法的录制文件, 缺少 open 记录")
+	}
+	return entries, nil
+}
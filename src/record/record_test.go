@@ -0,0 +1,91 @@
+package record
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	var f framer
+	connect := []byte{0x10, 0x02, 0x00, 0x04}
+	publish := []byte{0x30, 0x03, 0x00, 0x01, 'a'}
+
+	// 报文跨越多次读取
+	var packets [][]byte
+	data := append(append([]byte(nil), connect...), publish...)
+	for _, chunk := range [][]byte{data[:1], data[1:5], data[5:]} {
+		packets = append(packets, f.split(chunk)...)
+	}
+	if len(packets) != 2 || !bytes.Equal(packets[0], connect) || !bytes.Equal(packets[1], publish) {
+		t.Fatalf("拆分结果: %x", packets)
+	}
+
+	// remaining length 非法后不再拆分
+	if packets = f.split([]byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01}); len(packets) != 1 || len(packets[0]) != 6 {
+		t.Fatalf("非法 remaining length: %x", packets)
+	}
+	if packets = f.split([]byte{0xe0, 0x00}); len(packets) != 1 {
+		t.Fatalf("非法之后的数据: %x", packets)
+	}
+}
+
+func TestSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	Dir, Clients = dir, map[string]bool{"c1": true}
+	defer func() { Dir, Clients = "", make(map[string]bool) }()
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+
+	// clientId 不匹配, 不录制
+	s := Open(remote, "1")
+	s.Inbound([]byte{0x10, 0x00})
+	s.Identify("c2")
+	s.Outbound(net.Buffers{{0x20, 0x02, 0x00, 0x00}})
+	s.Close()
+
+	// clientId 匹配, 写入 CONNECT 之前缓存的记录
+	s = Open(remote, "2")
+	s.Inbound([]byte{0x10, 0x00, 0x30})
+	s.Identify("c1")
+	s.Outbound(net.Buffers{{0x20, 0x02}, {0x00, 0x00}})
+	s.Inbound([]byte{0x02, 0x00, 0x00, 0xe0, 0x00})
+	s.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 1 {
+		t.Fatalf("录制文件: %v", files)
+	}
+	file, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	entries, err := Read(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types := []string{TypeOpen, TypeIn, TypeClient, TypeOut, TypeIn, TypeIn, TypeClose}
+	if len(entries) != len(types) {
+		t.Fatalf("记录数: %d", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.Type != types[i] {
+			t.Fatalf("第 %d 条记录类型: %s", i, entry.Type)
+		}
+	}
+	if entries[0].Remote != remote.String() || entries[2].ClientId != "c1" {
+		t.Fatalf("记录内容: %+v %+v", entries[0], entries[2])
+	}
+	if !bytes.Equal(entries[3].Data, []byte{0x20, 0x02, 0x00, 0x00}) || !bytes.Equal(entries[4].Data, []byte{0x30, 0x02, 0x00, 0x00}) {
+		t.Fatalf("报文: %x %x", entries[3].Data, entries[4].Data)
+	}
+}
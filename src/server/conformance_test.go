@@ -0,0 +1,810 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mqtt-go/src/codec"
+	"mqtt-go/src/message"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// MQTT 3.1.1 一致性测试, 每个子测试以其验证的规范条目命名, 可按条目运行:
+//
+//	go test ./src/server -run 'TestConformance/MQTT-3.1.0-1'
+func TestConformance(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	run++
+
+	runConformance(t)
+}
+
+// 以当前的 dial 并行运行全部规范条目
+func runConformance(t *testing.T) {
+	for _, c := range conformance {
+		c := c
+		t.Run(c.ref, func(t *testing.T) {
+			t.Parallel()
+			t.Log(c.desc)
+			c.test(t)
+		})
+	}
+}
+
+// 规范条目及其测试
+var conformance = []struct {
+	ref  string
+	desc string
+	test func(t *testing.T)
+}{
+	// CONNECT / CONNACK
+	{"MQTT-3.1.0-1", "首个报文须为 CONNECT", testFirstPacketConnect},
+	{"MQTT-3.1.0-2", "重复的 CONNECT 断开连接", testSecondConnect},
+	{"MQTT-3.1.2-1", "非法的协议名断开连接", testProtocolName},
+	{"MQTT-3.1.2-3", "连接标志保留位非 0 断开连接", testConnectReserved},
+	{"MQTT-3.1.2-6", "清理会话丢弃之前的会话", testCleanSessionDiscard},
+	{"MQTT-3.1.3-6", "清理会话且 clientId 为空时由服务端分配", testEmptyClientId},
+	{"MQTT-3.1.3-8", "不清理会话且 clientId 为空时以 0x02 拒绝并断开", testEmptyClientIdPersistent},
+	{"MQTT-3.1.4-2", "相同 clientId 连接时断开旧连接, 不发布其遗嘱", testTakeOver},
+	{"MQTT-3.2.0-1", "服务端首个报文为 CONNACK", testConnAckFirst},
+	{"MQTT-3.2.2-1", "清理会话的 CONNACK sessionPresent 为 0", testSessionPresentClean},
+	{"MQTT-3.2.2-2", "恢复会话的 CONNACK sessionPresent 为 1", testSessionPresentResumed},
+	{"MQTT-3.2.2-3", "新建会话的 CONNACK sessionPresent 为 0", testSessionPresentNew},
+
+	// QoS 流程
+	{"MQTT-3.3.4-1", "按 Qos 响应 PUBLISH", testPublishResponse},
+	{"MQTT-4.3.2-1", "qos1 投递使用未占用的非 0 packetId, dup 为 0", testQos1Delivery},
+	{"MQTT-4.3.3-1", "qos2 投递收到 PUBREC 后发送 PUBREL", testQos2Delivery},
+	{"MQTT-4.3.3-2", "收到 PUBREL 前重复的 qos2 PUBLISH 不再投递", testQos2Once},
+	{"MQTT-3.6.4-1", "以相同 packetId 的 PUBCOMP 响应 PUBREL", testPubRelResponse},
+
+	// 订阅
+	{"MQTT-3.8.4-1", "以 SUBACK 响应 SUBSCRIBE, packetId 相同", testSubAck},
+	{"MQTT-3.8.4-5", "SUBACK 为每个主题过滤器返回一个返回码", testSubAckCodes},
+	{"MQTT-3.8.4-6", "投递 Qos 取发布 Qos 与授予 Qos 的较小值", testDowngrade},
+	{"MQTT-3.10.4-2", "取消订阅后不再投递", testUnsubscribe},
+	{"MQTT-3.10.4-4", "以 UNSUBACK 响应 UNSUBSCRIBE, packetId 相同", testUnsubAck},
+	{"MQTT-3.10.4-5", "未匹配任何订阅的 UNSUBSCRIBE 仍响应 UNSUBACK", testUnsubAckNoMatch},
+
+	// 心跳
+	{"MQTT-3.12.4-1", "以 PINGRESP 响应 PINGREQ", testPing},
+	{"MQTT-3.1.2-24", "1.5 倍心跳周期内未收到报文断开连接", testKeepAlive},
+
+	// 保留消息
+	{"MQTT-3.3.1-5", "保留消息投递给新的订阅者", testRetained},
+	{"MQTT-3.3.1-6", "新订阅收到的保留消息 retain 为 1", testRetainedFlag},
+	{"MQTT-3.3.1-9", "转发给已有订阅的消息 retain 为 0", testRetainCleared},
+	{"MQTT-3.3.1-10", "空载荷的保留消息清除该主题的保留消息", testRetainedDelete},
+	{"MQTT-4.7.2-1", "通配符过滤器匹配保留消息, 但不匹配以 $ 开头的主题", testRetainedWildcard},
+	{"MQTT-4.7.1-2", "保留消息与实时投递按相同规则匹配主题过滤器", testRetainedMatchLive},
+	{"MQTT-4.7.1-3", "通配符过滤器匹配实时投递", testWildcardLive},
+
+	// 遗嘱
+	{"MQTT-3.1.2-8", "连接非正常断开时发布遗嘱", testWill},
+	{"MQTT-3.1.2-17", "Will Retain 为 1 时遗嘱作为保留消息发布", testWillRetain},
+	{"MQTT-3.14.4-3", "收到 DISCONNECT 后丢弃遗嘱", testWillDisconnect},
+
+	// 非法报文
+	{"MQTT-2.2.2-2", "固定头保留位非法断开连接", testInvalidFlags},
+	{"MQTT-2.3.1-1", "packetId 为 0 断开连接", testZeroPacketId},
+	{"MQTT-1.5.3-1", "非法的 UTF-8 字符串断开连接", testInvalidUtf8},
+	{"MQTT-3.3.2-2", "发布主题包含通配符断开连接", testPublishWildcard},
+	{"MQTT-3.3.1-4", "PUBLISH Qos 为 3 断开连接", testPublishQos3},
+	{"MQTT-3.8.3-3", "SUBSCRIBE 无主题过滤器断开连接", testSubscribeEmpty},
+	{"MQTT-3.8.3-4", "订阅 Qos 非法断开连接", testSubscribeQos3},
+}
+
+// 等待报文的超时时间
+const waitTimeout = 2 * time.Second
+
+// 经 net.Pipe 连接 broker 的测试客户端
+type pipeClient struct {
+	t    *testing.T
+	conn net.Conn
+
+	// 收到的报文
+	in chan *message.MqttMessage
+
+	// 连接断开时关闭
+	done chan struct{}
+}
+
+// 建立内存连接, 服务端以 HandleConn 处理; epoll 模式的测试替换为经事件循环处理的 TCP 连接
+var dial = func(t *testing.T) *pipeClient {
+	return dialWrap(t, func(conn net.Conn) net.Conn { return conn })
+}
+
+// 建立内存连接, 服务端连接经 wrap 包装后以 HandleConn 处理
+func dialWrap(t *testing.T, wrap func(net.Conn) net.Conn) *pipeClient {
+	client, server := net.Pipe()
+	go HandleConn(wrap(server))
+	return newPipeClient(t, client)
+}
+
+// 以客户端连接构建测试客户端, 并开始读取服务端报文
+func newPipeClient(t *testing.T, client net.Conn) *pipeClient {
+	c := &pipeClient{
+		t:    t,
+		conn: client,
+		in:   make(chan *message.MqttMessage, 64),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(c.done)
+		decoder := codec.NewClientDecoder(client, 512)
+		for {
+			msg, err := decoder.ReadMessage()
+			if err != nil {
+				return
+			}
+			c.in <- msg
+		}
+	}()
+	t.Cleanup(func() { client.Close() })
+	return c
+}
+
+// 建立连接并完成 CONNECT, 返回 CONNACK 的 sessionPresent
+func connect(t *testing.T, clientId string, clean bool) (*pipeClient, bool) {
+	c := dial(t)
+	c.send(connectPacket(clientId, clean, 0, nil))
+	return c, c.connAck()
+}
+
+// 构建 CONNECT, will 非空时设置遗嘱
+func connectPacket(clientId string, clean bool, keepAlive time.Duration, will *message.MqttMessage) *message.MqttMessage {
+	header := &message.MqttConnVariableHeader{CleanSession: clean, KeepAlive: keepAlive}
+	payload := &message.MqttConnPayload{ClientId: clientId}
+	if will != nil {
+		header.WillFlag, header.WillQos, header.WillRetain = true, will.FixedHeader.Qos, will.FixedHeader.Retain
+		payload.WillTopic = will.VariableHeader.(*message.MqttPublishVaribleHeader).TopicName
+		payload.WillMessage = will.Payload.([]byte)
+	}
+	return message.BuildConnect(header, payload)
+}
+
+// 运行序号, 同一进程内多次运行(-count)时会话及保留消息仍在
+var run int
+
+// 以测试名及运行序号生成互不冲突的 clientId 及主题
+func unique(t *testing.T, name string) string {
+	return fmt.Sprintf("%s-%d-%s", strings.ReplaceAll(t.Name(), "/", "-"), run, name)
+}
+
+func (this *pipeClient) send(msg *message.MqttMessage) {
+	this.sendRaw(codec.Encode(msg))
+}
+
+// 写出原始字节, 连接已断开时忽略错误
+func (this *pipeClient) sendRaw(data []byte) {
+	this.conn.SetWriteDeadline(time.Now().Add(waitTimeout))
+	this.conn.Write(data)
+}
+
+// 等待下一个报文, 须为 packetType
+func (this *pipeClient) expect(packetType byte) *message.MqttMessage {
+	this.t.Helper()
+	select {
+	case msg := <-this.in:
+		if msg.FixedHeader.MessageType != packetType {
+			this.t.Fatalf("期望 %s, 收到 %s", message.TypeName(packetType), message.TypeName(msg.FixedHeader.MessageType))
+		}
+		return msg
+	case <-this.done:
+		this.t.Fatalf("期望 %s, 连接已断开", message.TypeName(packetType))
+	case <-time.After(waitTimeout):
+		this.t.Fatalf("等待 %s 超时", message.TypeName(packetType))
+	}
+	return nil
+}
+
+// 等待 CONNACK 并校验返回码, 返回 sessionPresent
+func (this *pipeClient) connAck() bool {
+	this.t.Helper()
+	header := this.expect(message.CONNACK).VariableHeader.(*message.MqttConnAckVariableHeader)
+	if header.Code != 0 {
+		this.t.Fatalf("CONNACK 返回码: %d", header.Code)
+	}
+	return header.SessionPresent
+}
+
+// 等待 PUBLISH, 校验主题及载荷
+func (this *pipeClient) expectPublish(topic string, payload string) *message.MqttMessage {
+	this.t.Helper()
+	msg := this.expect(message.PUBLISH)
+	header := msg.VariableHeader.(*message.MqttPublishVaribleHeader)
+	if header.TopicName != topic || string(msg.Payload.([]byte)) != payload {
+		this.t.Fatalf("收到 topic: %s 载荷: %s", header.TopicName, msg.Payload)
+	}
+	return msg
+}
+
+// d 时间内不应收到报文
+func (this *pipeClient) expectNone(d time.Duration) {
+	this.t.Helper()
+	select {
+	case msg := <-this.in:
+		this.t.Fatalf("不应收到 %s", message.TypeName(msg.FixedHeader.MessageType))
+	case <-time.After(d):
+	}
+}
+
+// 服务端应关闭连接, 且此前不发送任何报文
+func (this *pipeClient) expectClosed() {
+	this.t.Helper()
+	select {
+	case msg := <-this.in:
+		this.t.Fatalf("期望连接断开, 收到 %s", message.TypeName(msg.FixedHeader.MessageType))
+	case <-this.done:
+	case <-time.After(waitTimeout):
+		this.t.Fatal("等待连接断开超时")
+	}
+}
+
+// 订阅并等待 SUBACK, 返回授予的 Qos
+func (this *pipeClient) subscribe(id uint16, topics ...*message.Topic) []byte {
+	this.t.Helper()
+	this.send(message.BuildSubscribe(id, topics...))
+	ack := this.expect(message.SUBACK)
+	if got := ack.VariableHeader.(*message.MqttMessageIdVariableHeader).MessageId; got != id {
+		this.t.Fatalf("SUBACK packetId: %d, 应为 %d", got, id)
+	}
+	return ack.Payload.([]byte)
+}
+
+// 发布 qos0 消息并以 PINGREQ 确认 broker 已处理
+func (this *pipeClient) publish(retain bool, topic string, payload string) {
+	this.t.Helper()
+	this.send(message.BuildPublish(false, retain, 0, topic, 0, []byte(payload)))
+	this.send(message.BuildPingReq())
+	this.expect(message.PINGRESP)
+}
+
+// 报文的 packetId
+func messageId(msg *message.MqttMessage) uint16 {
+	switch header := msg.VariableHeader.(type) {
+	case *message.MqttPublishVaribleHeader:
+		return header.MessageId
+	case *message.MqttMessageIdVariableHeader:
+		return header.MessageId
+	}
+	return 0
+}
+
+func testFirstPacketConnect(t *testing.T) {
+	c := dial(t)
+	c.send(message.BuildPingReq())
+	c.expectClosed()
+}
+
+func testSecondConnect(t *testing.T) {
+	c, _ := connect(t, unique(t, "c"), true)
+	c.send(connectPacket(unique(t, "c"), true, 0, nil))
+	c.expectClosed()
+}
+
+func testProtocolName(t *testing.T) {
+	c := dial(t)
+	data := codec.Encode(connectPacket(unique(t, "c"), true, 0, nil))
+	copy(data[4:8], "MQIs")
+	c.sendRaw(data)
+	c.expectClosed()
+}
+
+func testConnectReserved(t *testing.T) {
+	c := dial(t)
+	data := codec.Encode(connectPacket(unique(t, "c"), true, 0, nil))
+	data[9] |= 0b1
+	c.sendRaw(data)
+	c.expectClosed()
+}
+
+func testCleanSessionDiscard(t *testing.T) {
+	clientId, topic := unique(t, "c"), unique(t, "t")
+	c, _ := connect(t, clientId, false)
+	c.subscribe(1, &message.Topic{Name: topic, Qos: 1})
+	c.send(message.BuildDisconnect())
+	c.expectClosed()
+
+	c, present := connect(t, clientId, true)
+	if present {
+		t.Fatal("清理会话的 sessionPresent 应为 0")
+	}
+	pub, _ := connect(t, unique(t, "pub"), true)
+	pub.publish(false, topic, "m")
+	c.expectNone(100 * time.Millisecond)
+}
+
+func testEmptyClientId(t *testing.T) {
+	c1, _ := connect(t, "", true)
+	c2, _ := connect(t, "", true)
+
+	// 分配的 clientId 互不相同, 后连接的不会取代前者
+	topic := unique(t, "t")
+	c1.subscribe(1, &message.Topic{Name: topic, Qos: 0})
+	c2.publish(false, topic, "m")
+	c1.expectPublish(topic, "m")
+}
+
+func testEmptyClientIdPersistent(t *testing.T) {
+	c := dial(t)
+	c.send(connectPacket("", false, 0, nil))
+	header := c.expect(message.CONNACK).VariableHeader.(*message.MqttConnAckVariableHeader)
+	if header.Code != 2 || header.SessionPresent {
+		t.Fatalf("CONNACK 返回码: %d sessionPresent: %v", header.Code, header.SessionPresent)
+	}
+	c.expectClosed()
+}
+
+func testTakeOver(t *testing.T) {
+	clientId, topic, willTopic := unique(t, "c"), unique(t, "t"), unique(t, "will")
+	sub, _ := connect(t, unique(t, "sub"), true)
+	sub.subscribe(1, &message.Topic{Name: willTopic, Qos: 0})
+
+	old := dial(t)
+	old.send(connectPacket(clientId, false, 0, message.BuildPublish(false, false, 0, willTopic, 0, []byte("gone"))))
+	old.connAck()
+	old.subscribe(1, &message.Topic{Name: topic, Qos: 0})
+
+	c, present := connect(t, clientId, false)
+	if !present {
+		t.Fatal("sessionPresent 应为 1")
+	}
+	old.expectClosed()
+	sub.expectNone(100 * time.Millisecond)
+
+	// 会话由新连接继续
+	pub, _ := connect(t, unique(t, "pub"), true)
+	pub.publish(false, topic, "m")
+	c.expectPublish(topic, "m")
+}
+
+func testConnAckFirst(t *testing.T) {
+	c := dial(t)
+	c.send(connectPacket(unique(t, "c"), true, 0, nil))
+	c.send(message.BuildPingReq())
+	c.connAck()
+	c.expect(message.PINGRESP)
+}
+
+func testSessionPresentClean(t *testing.T) {
+	clientId := unique(t, "c")
+	c, _ := connect(t, clientId, false)
+	c.send(message.BuildDisconnect())
+	c.expectClosed()
+
+	if _, present := connect(t, clientId, true); present {
+		t.Fatal("sessionPresent 应为 0")
+	}
+}
+
+func testSessionPresentResumed(t *testing.T) {
+	clientId := unique(t, "c")
+	c, _ := connect(t, clientId, false)
+	c.send(message.BuildDisconnect())
+	c.expectClosed()
+
+	if _, present := connect(t, clientId, false); !present {
+		t.Fatal("sessionPresent 应为 1")
+	}
+}
+
+func testSessionPresentNew(t *testing.T) {
+	if _, present := connect(t, unique(t, "c"), false); present {
+		t.Fatal("sessionPresent 应为 0")
+	}
+}
+
+func testPublishResponse(t *testing.T) {
+	c, _ := connect(t, unique(t, "c"), true)
+	topic := unique(t, "t")
+
+	c.send(message.BuildPublish(false, false, 1, topic, 7, []byte("q1")))
+	if id := messageId(c.expect(message.PUBACK)); id != 7 {
+		t.Fatalf("PUBACK packetId: %d", id)
+	}
+	c.send(message.BuildPublish(false, false, 2, topic, 8, []byte("q2")))
+	if id := messageId(c.expect(message.PUBREC)); id != 8 {
+		t.Fatalf("PUBREC packetId: %d", id)
+	}
+}
+
+func testQos1Delivery(t *testing.T) {
+	topic := unique(t, "t")
+	sub, _ := connect(t, unique(t, "sub"), true)
+	sub.subscribe(1, &message.Topic{Name: topic, Qos: 1})
+
+	pub, _ := connect(t, unique(t, "pub"), true)
+	pub.send(message.BuildPublish(false, false, 1, topic, 1, []byte("a")))
+	pub.send(message.BuildPublish(false, false, 1, topic, 2, []byte("b")))
+
+	first, second := sub.expectPublish(topic, "a"), sub.expectPublish(topic, "b")
+	for _, msg := range []*message.MqttMessage{first, second} {
+		if msg.FixedHeader.Qos != 1 || msg.FixedHeader.Dup || messageId(msg) == 0 {
+			t.Fatalf("qos: %d dup: %v packetId: %d", msg.FixedHeader.Qos, msg.FixedHeader.Dup, messageId(msg))
+		}
+	}
+	if messageId(first) == messageId(second) {
+		t.Fatalf("未确认的消息使用了相同的 packetId: %d", messageId(first))
+	}
+	sub.send(message.BuildPubAck(messageId(first)))
+	sub.send(message.BuildPubAck(messageId(second)))
+}
+
+func testQos2Delivery(t *testing.T) {
+	topic := unique(t, "t")
+	sub, _ := connect(t, unique(t, "sub"), true)
+	sub.subscribe(1, &message.Topic{Name: topic, Qos: 2})
+
+	pub, _ := connect(t, unique(t, "pub"), true)
+	pub.send(message.BuildPublish(false, false, 2, topic, 1, []byte("m")))
+	pub.expect(message.PUBREC)
+	pub.send(message.BuildPubRel(1))
+	pub.expect(message.PUBCOMP)
+
+	msg := sub.expectPublish(topic, "m")
+	if msg.FixedHeader.Qos != 2 || messageId(msg) == 0 {
+		t.Fatalf("qos: %d packetId: %d", msg.FixedHeader.Qos, messageId(msg))
+	}
+	sub.send(message.BuildPubRec(messageId(msg)))
+	if id := messageId(sub.expect(message.PUBREL)); id != messageId(msg) {
+		t.Fatalf("PUBREL packetId: %d, 应为 %d", id, messageId(msg))
+	}
+	sub.send(message.BuildPubComp(messageId(msg)))
+}
+
+func testQos2Once(t *testing.T) {
+	topic := unique(t, "t")
+	sub, _ := connect(t, unique(t, "sub"), true)
+	sub.subscribe(1, &message.Topic{Name: topic, Qos: 0})
+
+	pub, _ := connect(t, unique(t, "pub"), true)
+	pub.send(message.BuildPublish(false, false, 2, topic, 9, []byte("m")))
+	pub.expect(message.PUBREC)
+	pub.send(message.BuildPublish(true, false, 2, topic, 9, []byte("m")))
+	pub.expect(message.PUBREC)
+
+	sub.expectPublish(topic, "m")
+	sub.expectNone(100 * time.Millisecond)
+
+	// 收到 PUBREL 后相同 packetId 视为新消息
+	pub.send(message.BuildPubRel(9))
+	pub.expect(message.PUBCOMP)
+	pub.send(message.BuildPublish(false, false, 2, topic, 9, []byte("n")))
+	pub.expect(message.PUBREC)
+	sub.expectPublish(topic, "n")
+}
+
+func testPubRelResponse(t *testing.T) {
+	c, _ := connect(t, unique(t, "c"), true)
+	c.send(message.BuildPublish(false, false, 2, unique(t, "t"), 3, []byte("m")))
+	c.expect(message.PUBREC)
+	c.send(message.BuildPubRel(3))
+	if id := messageId(c.expect(message.PUBCOMP)); id != 3 {
+		t.Fatalf("PUBCOMP packetId: %d", id)
+	}
+}
+
+func testSubAck(t *testing.T) {
+	c, _ := connect(t, unique(t, "c"), true)
+	c.subscribe(42, &message.Topic{Name: unique(t, "t"), Qos: 1})
+}
+
+func testSubAckCodes(t *testing.T) {
+	c, _ := connect(t, unique(t, "c"), true)
+	granted := c.subscribe(1,
+		&message.Topic{Name: unique(t, "a"), Qos: 2},
+		&message.Topic{Name: unique(t, "b"), Qos: 0},
+		&message.Topic{Name: unique(t, "c"), Qos: 1},
+	)
+	if string(granted) != string([]byte{2, 0, 1}) {
+		t.Fatalf("SUBACK 返回码: %v", granted)
+	}
+}
+
+func testDowngrade(t *testing.T) {
+	topic := unique(t, "t")
+	sub, _ := connect(t, unique(t, "sub"), true)
+	sub.subscribe(1, &message.Topic{Name: topic, Qos: 1})
+
+	pub, _ := connect(t, unique(t, "pub"), true)
+	pub.send(message.BuildPublish(false, false, 2, topic, 1, []byte("m")))
+	pub.expect(message.PUBREC)
+	if msg := sub.expectPublish(topic, "m"); msg.FixedHeader.Qos != 1 {
+		t.Fatalf("投递 Qos: %d, 应为 1", msg.FixedHeader.Qos)
+	}
+
+	pub.publish(false, topic, "n")
+	if msg := sub.expectPublish(topic, "n"); msg.FixedHeader.Qos != 0 {
+		t.Fatalf("投递 Qos: %d, 应为 0", msg.FixedHeader.Qos)
+	}
+}
+
+func testUnsubscribe(t *testing.T) {
+	topic := unique(t, "t")
+	sub, _ := connect(t, unique(t, "sub"), true)
+	sub.subscribe(1, &message.Topic{Name: topic, Qos: 0})
+
+	pub, _ := connect(t, unique(t, "pub"), true)
+	pub.publish(false, topic, "before")
+	sub.expectPublish(topic, "before")
+
+	sub.send(message.BuildUnsubscribe(2, topic))
+	sub.expect(message.UNSUBACK)
+	pub.publish(false, topic, "after")
+	sub.expectNone(100 * time.Millisecond)
+}
+
+func testUnsubAck(t *testing.T) {
+	c, _ := connect(t, unique(t, "c"), true)
+	topic := unique(t, "t")
+	c.subscribe(1, &message.Topic{Name: topic, Qos: 0})
+	c.send(message.BuildUnsubscribe(77, topic))
+	if id := messageId(c.expect(message.UNSUBACK)); id != 77 {
+		t.Fatalf("UNSUBACK packetId: %d", id)
+	}
+}
+
+func testUnsubAckNoMatch(t *testing.T) {
+	c, _ := connect(t, unique(t, "c"), true)
+	c.send(message.BuildUnsubscribe(5, unique(t, "none")))
+	if id := messageId(c.expect(message.UNSUBACK)); id != 5 {
+		t.Fatalf("UNSUBACK packetId: %d", id)
+	}
+}
+
+func testPing(t *testing.T) {
+	c, _ := connect(t, unique(t, "c"), true)
+	c.send(message.BuildPingReq())
+	c.expect(message.PINGRESP)
+}
+
+func testKeepAlive(t *testing.T) {
+	c := dial(t)
+	c.send(connectPacket(unique(t, "c"), true, time.Second, nil))
+	c.connAck()
+
+	// 心跳周期内的报文推迟断开
+	start := time.Now()
+	time.Sleep(700 * time.Millisecond)
+	c.send(message.BuildPingReq())
+	c.expect(message.PINGRESP)
+	last := time.Now()
+
+	select {
+	case <-c.done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("超过 1.5 倍心跳周期未断开连接")
+	}
+	if idle := time.Since(last); idle < 1400*time.Millisecond {
+		t.Fatalf("空闲 %v 即断开连接, 连接建立于 %v 前", idle, time.Since(start))
+	}
+}
+
+func testRetained(t *testing.T) {
+	topic := unique(t, "t")
+	pub, _ := connect(t, unique(t, "pub"), true)
+	pub.publish(true, topic, "r")
+
+	sub, _ := connect(t, unique(t, "sub"), true)
+	sub.subscribe(1, &message.Topic{Name: topic, Qos: 0})
+	sub.expectPublish(topic, "r")
+}
+
+func testRetainedFlag(t *testing.T) {
+	topic := unique(t, "t")
+	pub, _ := connect(t, unique(t, "pub"), true)
+	pub.publish(true, topic, "r")
+
+	sub, _ := connect(t, unique(t, "sub"), true)
+	sub.subscribe(1, &message.Topic{Name: topic, Qos: 0})
+	if msg := sub.expectPublish(topic, "r"); !msg.FixedHeader.Retain {
+		t.Fatal("retain 应为 1")
+	}
+}
+
+func testRetainCleared(t *testing.T) {
+	topic := unique(t, "t")
+	sub, _ := connect(t, unique(t, "sub"), true)
+	sub.subscribe(1, &message.Topic{Name: topic, Qos: 0})
+
+	pub, _ := connect(t, unique(t, "pub"), true)
+	pub.publish(true, topic, "r")
+	if msg := sub.expectPublish(topic, "r"); msg.FixedHeader.Retain {
+		t.Fatal("retain 应为 0")
+	}
+}
+
+func testRetainedDelete(t *testing.T) {
+	topic := unique(t, "t")
+	pub, _ := connect(t, unique(t, "pub"), true)
+	pub.publish(true, topic, "r")
+	pub.publish(true, topic, "")
+
+	sub, _ := connect(t, unique(t, "sub"), true)
+	sub.subscribe(1, &message.Topic{Name: topic, Qos: 0})
+	sub.expectNone(100 * time.Millisecond)
+}
+
+func testRetainedWildcard(t *testing.T) {
+	level := unique(t, "t")
+	pub, _ := connect(t, unique(t, "pub"), true)
+	pub.publish(true, "a/"+level+"/x", "a")
+	pub.publish(true, "b/"+level+"/y/z", "b")
+	pub.publish(true, "$c/"+level+"/x", "c")
+
+	sub, _ := connect(t, unique(t, "sub"), true)
+	sub.subscribe(1, &message.Topic{Name: "+/" + level + "/x", Qos: 0})
+	sub.expectPublish("a/"+level+"/x", "a")
+	sub.expectNone(100 * time.Millisecond)
+
+	sub.subscribe(2, &message.Topic{Name: "b/" + level + "/#", Qos: 0})
+	sub.expectPublish("b/"+level+"/y/z", "b")
+}
+
+func testRetainedMatchLive(t *testing.T) {
+	level := unique(t, "t")
+	topics := []string{"a/" + level + "/x", "a/" + level, "a/" + level + "/x/y", "b/" + level + "/x", "$c/" + level + "/x", "$c/" + level}
+	filters := []string{"+/" + level + "/+", "a/" + level + "/#", "$c/" + level + "/+"}
+	want := map[string]bool{topics[0]: true, topics[1]: true, topics[2]: true, topics[3]: true, topics[4]: true}
+
+	pub, _ := connect(t, unique(t, "pub"), true)
+	for _, topic := range topics {
+		pub.publish(true, topic, "retained")
+	}
+
+	sub, _ := connect(t, unique(t, "sub"), true)
+	subs := make([]*message.Topic, 0, len(filters))
+	for _, filter := range filters {
+		subs = append(subs, &message.Topic{Name: filter, Qos: 0})
+	}
+	sub.subscribe(1, subs...)
+	if retained := sub.collectTopics(); !reflect.DeepEqual(retained, want) {
+		t.Fatalf("保留消息匹配: %v, 应为 %v", retained, want)
+	}
+
+	for _, topic := range topics {
+		pub.publish(false, topic, "live")
+	}
+	if live := sub.collectTopics(); !reflect.DeepEqual(live, want) {
+		t.Fatalf("实时投递匹配: %v, 应为 %v", live, want)
+	}
+}
+
+func testWildcardLive(t *testing.T) {
+	level := unique(t, "t")
+	sub, _ := connect(t, unique(t, "sub"), true)
+	sub.subscribe(1, &message.Topic{Name: "zz/+/" + level, Qos: 0}, &message.Topic{Name: level + "/#", Qos: 0})
+
+	pub, _ := connect(t, unique(t, "pub"), true)
+	pub.publish(false, "zz/a/"+level, "a")
+	sub.expectPublish("zz/a/"+level, "a")
+	pub.publish(false, level, "b")
+	sub.expectPublish(level, "b")
+	pub.publish(false, level+"/x/y", "c")
+	sub.expectPublish(level+"/x/y", "c")
+
+	// + 只匹配一层
+	pub.publish(false, "zz/a/b/"+level, "d")
+	pub.publish(false, "zz/"+level, "e")
+	sub.expectNone(100 * time.Millisecond)
+}
+
+// 收集 200ms 内收到的 PUBLISH 的主题
+func (this *pipeClient) collectTopics() map[string]bool {
+	this.t.Helper()
+	topics := make(map[string]bool)
+	for {
+		select {
+		case msg := <-this.in:
+			if msg.FixedHeader.MessageType != message.PUBLISH {
+				this.t.Fatalf("不应收到 %s", message.TypeName(msg.FixedHeader.MessageType))
+			}
+			topics[msg.VariableHeader.(*message.MqttPublishVaribleHeader).TopicName] = true
+		case <-time.After(200 * time.Millisecond):
+			return topics
+		}
+	}
+}
+
+// 连接并设置遗嘱
+func connectWill(t *testing.T, topic string, retain bool) *pipeClient {
+	c := dial(t)
+	c.send(connectPacket(unique(t, "will"), true, 0, message.BuildPublish(false, retain, 0, topic, 0, []byte("gone"))))
+	c.connAck()
+	return c
+}
+
+func testWill(t *testing.T) {
+	topic := unique(t, "t")
+	sub, _ := connect(t, unique(t, "sub"), true)
+	sub.subscribe(1, &message.Topic{Name: topic, Qos: 0})
+
+	c := connectWill(t, topic, false)
+	c.conn.Close()
+	if msg := sub.expectPublish(topic, "gone"); msg.FixedHeader.Retain {
+		t.Fatal("retain 应为 0")
+	}
+}
+
+func testWillRetain(t *testing.T) {
+	topic := unique(t, "t")
+	c := connectWill(t, topic, true)
+	c.conn.Close()
+	<-c.done
+
+	// 遗嘱发布后订阅, 以保留消息收到
+	deadline := time.Now().Add(waitTimeout)
+	for {
+		sub, _ := connect(t, unique(t, "sub"), true)
+		sub.subscribe(1, &message.Topic{Name: topic, Qos: 0})
+		select {
+		case msg := <-sub.in:
+			if string(msg.Payload.([]byte)) != "gone" || !msg.FixedHeader.Retain {
+				t.Fatalf("收到载荷: %s retain: %v", msg.Payload, msg.FixedHeader.Retain)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("未收到保留的遗嘱消息")
+		}
+	}
+}
+
+func testWillDisconnect(t *testing.T) {
+	topic := unique(t, "t")
+	sub, _ := connect(t, unique(t, "sub"), true)
+	sub.subscribe(1, &message.Topic{Name: topic, Qos: 0})
+
+	c := connectWill(t, topic, false)
+	c.send(message.BuildDisconnect())
+	c.expectClosed()
+	sub.expectNone(100 * time.Millisecond)
+}
+
+func testInvalidFlags(t *testing.T) {
+	c, _ := connect(t, unique(t, "c"), true)
+	c.sendRaw([]byte{0xc1, 0x00})
+	c.expectClosed()
+}
+
+func testZeroPacketId(t *testing.T) {
+	c, _ := connect(t, unique(t, "c"), true)
+	c.sendRaw([]byte{0x40, 0x02, 0x00, 0x00})
+	c.expectClosed()
+}
+
+func testInvalidUtf8(t *testing.T) {
+	c, _ := connect(t, unique(t, "c"), true)
+	c.sendRaw([]byte{0x30, 0x05, 0x00, 0x02, 0xc3, 0x28, 'm'})
+	c.expectClosed()
+}
+
+func testPublishWildcard(t *testing.T) {
+	c, _ := connect(t, unique(t, "c"), true)
+	c.send(message.BuildPublish(false, false, 0, "a/+", 0, []byte("m")))
+	c.expectClosed()
+}
+
+func testPublishQos3(t *testing.T) {
+	c, _ := connect(t, unique(t, "c"), true)
+	c.sendRaw([]byte{0x36, 0x06, 0x00, 0x01, 'a', 0x00, 0x01, 'm'})
+	c.expectClosed()
+}
+
+func testSubscribeEmpty(t *testing.T) {
+	c, _ := connect(t, unique(t, "c"), true)
+	c.sendRaw([]byte{0x82, 0x02, 0x00, 0x01})
+	c.expectClosed()
+}
+
+func testSubscribeQos3(t *testing.T) {
+	c, _ := connect(t, unique(t, "c"), true)
+	c.sendRaw([]byte{0x82, 0x06, 0x00, 0x01, 0x00, 0x01, 'a', 0x03})
+	c.expectClosed()
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"io"
+	"log"
+	"mqtt-go/src/channel"
+	"mqtt-go/src/codec"
+	"mqtt-go/src/handler"
+	"mqtt-go/src/message"
+	"mqtt-go/src/record"
+	"mqtt-go/src/timewheel"
+	"net"
+	"sync"
+	"time"
+)
+
+// 连接读缓冲大小
+const readBufferSize = 512
+
+// 处理新建立的连接, 阻塞直至连接断开
+func HandleConn(conn net.Conn) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("panic info:%v\n", err)
+		}
+	}()
+
+	log.Printf("remote: [%s]", conn.RemoteAddr().String())
+	wrapConn := channel.NewChannel(conn, Heartbeat)
+	attachRecorder(wrapConn)
+	handler.ChannelActive(wrapConn)
+
+	// 释放资源并广播连接断开事件
+	defer func() {
+		err := wrapConn.Close()
+		if err != nil {
+			log.Printf("连接关闭异常：%v", err)
+		}
+		log.Printf("客户端[%s]连接断开", wrapConn.Id)
+		handler.ChannelInactive(wrapConn)
+	}()
+
+	// 心跳
+	idle := watchIdle(wrapConn, ConnectTimeout)
+
+	// 启动写入 goroutine
+	go startWriter(wrapConn)
+
+	// 开始处理数据流
+	startReader(wrapConn, idle)
+}
+
+func startReader(channel *channel.Channel, idle *timewheel.Timer) {
+	decoder := codec.NewDecoder(channel, readBufferSize)
+	for {
+		mqttMessage, err := decoder.ReadMessage()
+		if err != nil {
+			if _, ok := err.(net.Error); ok || err == io.EOF || err == io.ErrUnexpectedEOF {
+				log.Printf("连接断开: %s\n", err.Error())
+			} else {
+				log.Printf("解码错误: %s\n", err.Error())
+			}
+			return
+		}
+
+		// 记录报文到达时间, CONNECT 之前由 ConnectTimeout 约束
+		if decoder.Connected() {
+			channel.Touch()
+		}
+
+		handler.ChannelRead(channel, mqttMessage)
+
+		// 发布限流可能暂停了读取, 暂停结束时重新起算心跳
+		if decoder.Connected() {
+			channel.Touch()
+		}
+
+		// CONNECT 之后改以心跳周期检测
+		if mqttMessage.FixedHeader.MessageType == message.CONNECT {
+			idle.Reset(channel.Heartbeat())
+		}
+
+		// 处理完毕, 归还报文缓冲
+		mqttMessage.Release()
+		if channel.IsClosed() {
+			return
+		}
+	}
+}
+
+// 将写出队列中已积压的报文合并为一次 writev 写出, 写失败或超时即关闭连接
+func startWriter(channel *channel.Channel) {
+	w := newBatchWriter()
+	for {
+		select {
+		case <-channel.Out.Notify():
+		case <-channel.Stop:
+			return
+		}
+
+		if _, err := w.flush(channel); err != nil {
+			return
+		}
+	}
+}
+
+// 按需启动的写出 goroutine, 队列写空即退出, 空闲连接不占用 goroutine
+func drainWriter(channel *channel.Channel) {
+	w := batchWriters.Get().(*batchWriter)
+	defer batchWriters.Put(w)
+
+	for {
+		if n, err := w.flush(channel); n == 0 || err != nil {
+			return
+		}
+	}
+}
+
+var batchWriters = sync.Pool{New: func() interface{} {
+	return newBatchWriter()
+}}
+
+// 批量写出缓冲
+type batchWriter struct {
+	frames []*codec.Frame
+	bufs   net.Buffers
+}
+
+func newBatchWriter() *batchWriter {
+	batch := WriteBatch
+	if batch < 1 {
+		batch = 1
+	}
+	return &batchWriter{
+		frames: make([]*codec.Frame, 0, batch),
+		bufs:   make(net.Buffers, 0, 3*batch),
+	}
+}
+
+// 取出已积压的报文写出, 返回写出的报文数, 写失败即关闭连接
+func (this *batchWriter) flush(channel *channel.Channel) (int, error) {
+	this.frames = channel.Out.Pop(this.frames[:0], cap(this.frames))
+	n := len(this.frames)
+	if n == 0 {
+		return 0, nil
+	}
+
+	this.bufs = this.bufs[:0]
+	for _, frame := range this.frames {
+		this.bufs = frame.AppendBuffers(this.bufs)
+	}
+	_, err := channel.Write0(this.bufs, WriteTimeout)
+	for i, frame := range this.frames {
+		frame.Release()
+		this.frames[i] = nil
+	}
+	if err != nil {
+		log.Printf("写入失败, 关闭连接: %s\n", err)
+		if err := channel.Close(); err != nil {
+			log.Printf("连接关闭异常: %v\n", err)
+		}
+		return n, err
+	}
+	return n, nil
+}
+
+// 心跳检测, 在共享时间轮上按需检查, 不为每个连接常驻 goroutine.
+// 收到 CONNECT 前以连接建立时间起算 ConnectTimeout, 此后以最近一次收到报文起算心跳周期.
+// 处理 CONNECT 后须以心跳周期 Reset 返回的定时任务, 心跳周期短于 ConnectTimeout 时方能按时断开 [MQTT-3.1.2-24]
+func watchIdle(channel *channel.Channel, d time.Duration) *timewheel.Timer {
+	var timer *timewheel.Timer
+	timer = timewheel.Default.NewTimer(func() {
+		if channel.IsClosed() {
+			return
+		}
+
+		var idle, timeout time.Duration
+		if !channel.Connected() {
+			idle, timeout = time.Since(channel.Created()), ConnectTimeout
+		} else {
+			idle, timeout = time.Since(channel.LastRead()), channel.Heartbeat()
+		}
+		if idle < timeout {
+			timer.Reset(timeout - idle)
+			return
+		}
+
+		// 关闭连接会写出剩余报文、发布遗嘱及持久化会话, 不在时间轮 goroutine 中执行
+		go func() {
+			log.Printf("客户端[%s]心跳超时, 关闭连接\n", channel.Id)
+			if err := channel.Close(); err != nil {
+				log.Printf("连接关闭异常: %v\n", err)
+			}
+		}()
+	})
+	timer.Reset(d)
+	return timer
+}
+
+// 按配置录制连接收发的报文
+func attachRecorder(channel *channel.Channel) {
+	if session := record.Open(channel.Conn().RemoteAddr(), channel.Id); session != nil {
+		channel.SetRecorder(session)
+	}
+}
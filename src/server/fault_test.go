@@ -0,0 +1,82 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mqtt-go/src/fault"
+	"mqtt-go/src/message"
+	"net"
+	"testing"
+	"time"
+)
+
+// 劣质网络下的 broker 行为, 服务端连接经 fault.Conn 注入故障; 失败时按日志中的种子复现
+func TestFaultyNetwork(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	run++
+
+	t.Run("分片及延迟", testFaultChunks)
+	t.Run("随机断开", testFaultDisconnect)
+}
+
+// 以 config 包装服务端连接
+func dialFault(t *testing.T, config fault.Config) *pipeClient {
+	return dialWrap(t, func(conn net.Conn) net.Conn {
+		c := fault.Wrap(conn, config)
+		t.Logf("种子: %d", c.Seed())
+		return c
+	})
+}
+
+// 报文被拆分为极小的片段并伴随延迟, qos1 消息仍应按序送达
+func testFaultChunks(t *testing.T) {
+	topic := unique(t, "t")
+	config := fault.Config{Seed: 1, Jitter: time.Millisecond, Bandwidth: 64 * 1024, ReadChunk: 3, WriteChunk: 2}
+
+	sub := dialFault(t, config)
+	sub.send(connectPacket(unique(t, "sub"), true, 0, nil))
+	sub.connAck()
+	sub.subscribe(1, &message.Topic{Name: topic, Qos: 1})
+
+	config.Seed = 2
+	pub := dialFault(t, config)
+	pub.send(connectPacket(unique(t, "pub"), true, 0, nil))
+	pub.connAck()
+
+	for i := 1; i <= 20; i++ {
+		pub.send(message.BuildPublish(false, false, 1, topic, uint16(i), []byte(fmt.Sprintf("m%d", i))))
+		if id := messageId(pub.expect(message.PUBACK)); id != uint16(i) {
+			t.Fatalf("PUBACK packetId: %d, 应为 %d", id, i)
+		}
+	}
+	for i := 1; i <= 20; i++ {
+		msg := sub.expectPublish(topic, fmt.Sprintf("m%d", i))
+		sub.send(message.BuildPubAck(messageId(msg)))
+	}
+}
+
+// 连接在读写中途被断开, 应发布遗嘱
+func testFaultDisconnect(t *testing.T) {
+	topic := unique(t, "t")
+	sub, _ := connect(t, unique(t, "sub"), true)
+	sub.subscribe(1, &message.Topic{Name: topic, Qos: 0})
+
+	// 该种子下 CONNECT 完成之后断开
+	c := dialFault(t, fault.Config{Seed: 6, ReadChunk: 4, Disconnect: 0.02})
+	c.send(connectPacket(unique(t, "will"), true, 0, message.BuildPublish(false, false, 0, topic, 0, []byte("gone"))))
+	c.connAck()
+
+	deadline := time.After(waitTimeout)
+	for closed := false; !closed; {
+		c.send(message.BuildPingReq())
+		select {
+		case <-c.done:
+			closed = true
+		case <-c.in:
+		case <-deadline:
+			t.Fatal("等待注入的断开超时")
+		}
+	}
+	sub.expectPublish(topic, "gone")
+}
@@ -0,0 +1,366 @@
+//go:build linux
+// +build linux
+
+// epoll 网络模式: 少量事件循环读取就绪连接并就地解码、处理报文,
+// 写出 goroutine 仅在有待写报文时存在, 心跳由时间轮检测, 空闲连接不占用 goroutine 及读缓冲
+
+package server
+
+import (
+	"io"
+	"log"
+	"mqtt-go/src/channel"
+	"mqtt-go/src/codec"
+	"mqtt-go/src/handler"
+	"mqtt-go/src/message"
+	"mqtt-go/src/timewheel"
+	"mqtt-go/src/utils"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// 事件循环共享读缓冲大小
+const pollReadSize = 64 * 1024
+
+// 读事件
+const readEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP
+
+// 事件循环
+type poller struct {
+	epfd int
+
+	// fd <--> 连接
+	lock  sync.Mutex
+	conns map[int]*pollConn
+
+	// 读缓冲, 由事件循环独占
+	buf []byte
+}
+
+// 由事件循环处理的连接
+type pollConn struct {
+	lock sync.Mutex
+
+	fd  int
+	raw syscall.RawConn
+
+	channel *channel.Channel
+	decoder *codec.Decoder
+	poller  *poller
+
+	// 尚未处理的数据, 仅在报文不完整或暂停读取时持有, 否则为 nil
+	pending []byte
+
+	// pending 中首个报文的总长度, 数据不足时不再尝试解码; 长度字段不完整时为 0
+	need int
+
+	// 发布限流暂停读取, 或报文正由 worker 处理
+	paused bool
+
+	// 报文交由 worker 处理, 见 PollOffload
+	offload bool
+
+	// 心跳检测
+	idle *timewheel.Timer
+}
+
+var (
+	pollers []*poller
+
+	// 轮询分配事件循环
+	pollSeq uint32
+)
+
+// 启动 n 个事件循环
+func startPollers(n int) error {
+	if n < 1 {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
+		epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+		if err != nil {
+			return err
+		}
+		p := &poller{
+			epfd:  epfd,
+			conns: make(map[int]*pollConn),
+			buf:   make([]byte, pollReadSize),
+		}
+		pollers = append(pollers, p)
+		go p.loop()
+	}
+
+	if PollOffload {
+		log.Printf("epoll 模式, 事件循环数: %d, 报文由 worker 处理", n)
+	} else {
+		log.Printf("epoll 模式, 事件循环数: %d", n)
+	}
+	return nil
+}
+
+// 将连接交由事件循环处理, 连接不支持时返回 false, 由调用方以 goroutine 模式处理
+func poll(conn net.Conn, done func()) bool {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	fd := -1
+	if err := raw.Control(func(v uintptr) { fd = int(v) }); err != nil || fd < 0 {
+		return false
+	}
+
+	log.Printf("remote: [%s]", conn.RemoteAddr().String())
+	p := pollers[atomic.AddUint32(&pollSeq, 1)%uint32(len(pollers))]
+	wrapConn := channel.NewChannel(conn, Heartbeat)
+	attachRecorder(wrapConn)
+	pc := &pollConn{
+		fd:      fd,
+		raw:     raw,
+		channel: wrapConn,
+		decoder: &codec.Decoder{},
+		poller:  p,
+		offload: PollOffload,
+	}
+
+	// 写出 goroutine 按需启动
+	wrapConn.Out.SetReady(func() { go drainWriter(wrapConn) })
+
+	// 在 fd 关闭之前移出事件循环, 避免 fd 复用后误删新连接
+	wrapConn.OnClose(func() {
+		p.remove(pc)
+		log.Printf("客户端[%s]连接断开", wrapConn.Id)
+		handler.ChannelInactive(wrapConn)
+		done()
+	})
+
+	handler.ChannelActive(wrapConn)
+	pc.idle = watchIdle(wrapConn, ConnectTimeout)
+
+	p.lock.Lock()
+	p.conns[fd] = pc
+	p.lock.Unlock()
+	if err := syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{Events: readEvents, Fd: int32(fd)}); err != nil {
+		log.Printf("epoll 注册失败: %v\n", err)
+		pc.close()
+	}
+	return true
+}
+
+func (this *poller) loop() {
+	events := make([]syscall.EpollEvent, 256)
+	for {
+		n, err := syscall.EpollWait(this.epfd, events, -1)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			log.Fatalf("epoll 等待失败: %v\n", err)
+		}
+
+		for i := 0; i < n; i++ {
+			this.lock.Lock()
+			pc := this.conns[int(events[i].Fd)]
+			this.lock.Unlock()
+
+			if pc != nil {
+				pc.read(this.buf)
+			}
+		}
+	}
+}
+
+// 修改连接关注的事件, 连接已移除时忽略
+func (this *poller) modify(pc *pollConn, events uint32) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.conns[pc.fd] != pc {
+		return
+	}
+	if err := syscall.EpollCtl(this.epfd, syscall.EPOLL_CTL_MOD, pc.fd, &syscall.EpollEvent{Events: events, Fd: int32(pc.fd)}); err != nil {
+		log.Printf("epoll 修改失败: %v\n", err)
+	}
+}
+
+func (this *poller) remove(pc *pollConn) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.conns[pc.fd] != pc {
+		return
+	}
+	delete(this.conns, pc.fd)
+	syscall.EpollCtl(this.epfd, syscall.EPOLL_CTL_DEL, pc.fd, nil)
+}
+
+// 读取就绪数据并处理, buf 为事件循环共享的读缓冲
+func (this *pollConn) read(buf []byte) {
+	defer this.recover()
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.paused || this.channel.IsClosed() {
+		return
+	}
+
+	// 经由 RawConn 读取, 保证读取期间 fd 不会被关闭复用
+	var n int
+	var readErr error
+	if err := this.raw.Read(func(fd uintptr) bool {
+		n, readErr = syscall.Read(int(fd), buf)
+		return true
+	}); err != nil {
+		readErr = err
+	}
+	if readErr == syscall.EAGAIN || readErr == syscall.EINTR {
+		return
+	}
+	if readErr == nil && n == 0 {
+		readErr = io.EOF
+	}
+	if readErr != nil {
+		log.Printf("连接断开: %s\n", readErr.Error())
+		this.close()
+		return
+	}
+
+	data := buf[:n]
+	if recorder := this.channel.Recorder(); recorder != nil {
+		recorder.Inbound(data)
+	}
+	if len(this.pending) > 0 {
+		// 大报文分多次到达时, 仅追加而不重复解码
+		this.pending = append(this.pending, data...)
+		if len(this.pending) < this.need {
+			return
+		}
+		data = this.pending
+	}
+
+	// 交由 worker 处理, 已知报文不完整时继续等待
+	if this.offload {
+		this.keep(data)
+		if this.need == 0 || len(this.pending) >= this.need {
+			this.paused = true
+			this.poller.modify(this, syscall.EPOLLONESHOT)
+			go this.resume()
+		}
+		return
+	}
+	this.process(data)
+}
+
+// 解码并处理 data 中的完整报文, 剩余数据保留至下次读取, 调用方需持有锁
+func (this *pollConn) process(data []byte) {
+	for {
+		msg, left, err := this.decoder.Decode(data)
+		if err != nil {
+			log.Printf("解码错误: %s\n", err.Error())
+			this.close()
+			return
+		}
+		if msg == nil {
+			break
+		}
+
+		// 记录报文到达时间, CONNECT 之前由 ConnectTimeout 约束
+		if this.decoder.Connected() {
+			this.channel.Touch()
+		}
+
+		wait := handler.ChannelReadNoWait(this.channel, msg)
+
+		// CONNECT 之后改以心跳周期检测
+		if msg.FixedHeader.MessageType == message.CONNECT {
+			this.idle.Reset(this.channel.Heartbeat())
+		}
+		msg.Release()
+		data = left
+		if this.channel.IsClosed() {
+			return
+		}
+
+		// 发布限流, 暂停读取该连接
+		if wait > 0 {
+			this.keep(data)
+			this.pause(wait)
+			return
+		}
+	}
+	this.keep(data)
+}
+
+// 保留未处理的数据, 须复制出共享读缓冲; data 即为 pending 时不复制
+func (this *pollConn) keep(data []byte) {
+	this.need = packetLen(data)
+	if len(data) == 0 {
+		this.pending = nil
+		return
+	}
+	if len(this.pending) > 0 && &data[0] == &this.pending[0] {
+		this.pending = data
+		return
+	}
+	if cap(this.pending) >= len(data) {
+		this.pending = this.pending[:copy(this.pending[:cap(this.pending)], data)]
+		return
+	}
+	this.pending = append(make([]byte, 0, len(data)), data...)
+}
+
+// data 中首个报文的总长度, 长度字段不完整或非法时返回 0
+func packetLen(data []byte) int {
+	if len(data) < 2 {
+		return 0
+	}
+	remainingLen, digits, err := utils.DecodeRemainLength(data[1:])
+	if err != nil || digits == 0 {
+		return 0
+	}
+	return 1 + digits + remainingLen
+}
+
+// 暂停读取, wait 之后恢复并处理已读取的数据
+func (this *pollConn) pause(wait time.Duration) {
+	this.paused = true
+	this.poller.modify(this, syscall.EPOLLONESHOT)
+	time.AfterFunc(wait, this.resume)
+}
+
+// 恢复读取, 处理已读取的数据; 由暂停定时器或 worker goroutine 调用
+func (this *pollConn) resume() {
+	defer this.recover()
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.channel.IsClosed() {
+		return
+	}
+	this.paused = false
+	this.process(this.pending)
+	if !this.paused && !this.channel.IsClosed() {
+		this.poller.modify(this, readEvents)
+	}
+}
+
+func (this *pollConn) recover() {
+	if err := recover(); err != nil {
+		log.Printf("panic info:%v\n", err)
+		this.close()
+	}
+}
+
+func (this *pollConn) close() {
+	if err := this.channel.Close(); err != nil {
+		log.Printf("连接关闭异常：%v", err)
+	}
+}
@@ -0,0 +1,135 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mqtt-go/src/codec"
+	"mqtt-go/src/message"
+	"net"
+	"testing"
+	"time"
+)
+
+// epoll 模式: 服务端连接由事件循环处理, 经 TCP 连接运行一致性测试及拆包测试
+func TestEpoll(t *testing.T) {
+	defer listenEpoll(t)()
+
+	runEpoll(t)
+}
+
+// epoll 模式下报文交由 worker goroutine 处理
+func TestEpollOffload(t *testing.T) {
+	PollOffload = true
+	defer func() { PollOffload = false }()
+	defer listenEpoll(t)()
+
+	runEpoll(t)
+}
+
+func runEpoll(t *testing.T) {
+	t.Run("一致性", runConformance)
+	t.Run("逐字节到达", testEpollBytewise)
+	t.Run("大报文分片", testEpollLarge)
+	t.Run("单次读取多个报文", testEpollBatch)
+}
+
+// 启动由事件循环处理连接的监听并替换 dial, 返回的函数关闭监听并还原 dial
+func listenEpoll(t *testing.T) func() {
+	log.SetOutput(ioutil.Discard)
+	run++
+
+	if len(pollers) == 0 {
+		if err := startPollers(2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if !poll(conn, func() {}) {
+				conn.Close()
+			}
+		}
+	}()
+
+	origin := dial
+	dial = func(t *testing.T) *pipeClient {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return newPipeClient(t, conn)
+	}
+	return func() {
+		dial = origin
+		l.Close()
+		<-done
+	}
+}
+
+// 报文逐字节到达, 每个字节单独读取
+func testEpollBytewise(t *testing.T) {
+	c, _ := connect(t, unique(t, "c"), true)
+	for _, b := range codec.Encode(message.BuildPublish(false, false, 1, unique(t, "t"), 7, []byte("bytewise"))) {
+		c.sendRaw([]byte{b})
+		time.Sleep(time.Millisecond)
+	}
+	if id := messageId(c.expect(message.PUBACK)); id != 7 {
+		t.Fatalf("PUBACK packetId: %d", id)
+	}
+}
+
+// 超过事件循环读缓冲的报文分多次到达
+func testEpollLarge(t *testing.T) {
+	topic := unique(t, "t")
+	sub, _ := connect(t, unique(t, "sub"), true)
+	sub.subscribe(1, &message.Topic{Name: topic, Qos: 0})
+
+	pub, _ := connect(t, unique(t, "pub"), true)
+	payload := bytes.Repeat([]byte("0123456789"), 30*1024)
+	data := codec.Encode(message.BuildPublish(false, false, 1, topic, 1, payload))
+	for len(data) > 0 {
+		n := 4096
+		if n > len(data) {
+			n = len(data)
+		}
+		pub.sendRaw(data[:n])
+		data = data[n:]
+	}
+	pub.expect(message.PUBACK)
+	sub.expectPublish(topic, string(payload))
+}
+
+// 一次写出多个报文及下一个报文的开头
+func testEpollBatch(t *testing.T) {
+	c, _ := connect(t, unique(t, "c"), true)
+	topic := unique(t, "t")
+
+	var data []byte
+	for i := 1; i <= 10; i++ {
+		data = append(data, codec.Encode(message.BuildPublish(false, false, 1, topic, uint16(i), []byte(fmt.Sprintf("m%d", i))))...)
+	}
+	tail := codec.Encode(message.BuildPingReq())
+	c.sendRaw(append(data, tail[0]))
+	for i := 1; i <= 10; i++ {
+		if id := messageId(c.expect(message.PUBACK)); id != uint16(i) {
+			t.Fatalf("PUBACK packetId: %d, 应为 %d", id, i)
+		}
+	}
+	c.sendRaw(tail[1:])
+	c.expect(message.PINGRESP)
+}
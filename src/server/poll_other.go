@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+func startPollers(n int) error {
+	return errors.New("epoll 模式仅支持 linux")
+}
+
+func poll(conn net.Conn, done func()) bool {
+	return false
+}
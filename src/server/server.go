@@ -0,0 +1,188 @@
+// mqtt 连接服务
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"mqtt-go/src/limit"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// 默认心跳周期, 客户端 CONNECT 未指定 keepalive 时使用
+	Heartbeat = time.Minute
+
+	// 连接建立后须在此时间内完成 CONNECT
+	ConnectTimeout = 10 * time.Second
+
+	// 全局最大连接数, 0 为不限制
+	MaxConns int
+
+	// 单个监听器最大连接数, 0 为不限制
+	ListenerMaxConns int
+
+	// 单个来源 IP 每秒新建连接数上限, 0 为不限制
+	IpConnRate float64
+
+	// 单个来源 IP 新建连接的突发上限
+	IpConnBurst = 10
+
+	// 写超时, 超时视为连接失效, 0 为不限制
+	WriteTimeout = 30 * time.Second
+
+	// 单次 writev 最多合并的报文数
+	WriteBatch = 64
+
+	// 网络模式, 见 ModeGoroutine 与 ModeEpoll
+	Mode = ModeGoroutine
+
+	// epoll 模式下的事件循环数
+	PollLoops = runtime.NumCPU()
+
+	// epoll 模式下报文交由 worker goroutine 处理, 处理期间暂停读取该连接.
+	// 处理报文可能阻塞时(如 -fsync always 时等待落盘)开启, 避免阻塞事件循环上的其他连接
+	PollOffload = false
+)
+
+const (
+	// 每个连接独立的读写 goroutine
+	ModeGoroutine = "goroutine"
+
+	// 少量事件循环读取就绪连接, 写出 goroutine 按需启动, 仅支持 linux
+	ModeEpoll = "epoll"
+)
+
+// 全局连接数
+var conns int32
+
+// 来源 IP 建连限流
+var ipLimiter = &connRateLimiter{buckets: make(map[string]*ipBucket)}
+
+// 在监听器上接受连接, 阻塞直至监听器关闭
+func Serve(l net.Listener) error {
+	log.Printf("监听: %s", l.Addr().String())
+
+	// 当前监听器连接数
+	var listenerConns int32
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Printf("连接建立失败: %s", err.Error())
+				continue
+			}
+			return err
+		}
+
+		if !ipLimiter.allow(conn.RemoteAddr()) {
+			log.Printf("来源 [%s] 建连过于频繁, 拒绝连接", conn.RemoteAddr().String())
+			conn.Close()
+			continue
+		}
+		if n := atomic.AddInt32(&conns, 1); MaxConns > 0 && int(n) > MaxConns {
+			atomic.AddInt32(&conns, -1)
+			log.Printf("连接数达到全局上限 %d, 拒绝连接 [%s]", MaxConns, conn.RemoteAddr().String())
+			conn.Close()
+			continue
+		}
+		if n := atomic.AddInt32(&listenerConns, 1); ListenerMaxConns > 0 && int(n) > ListenerMaxConns {
+			atomic.AddInt32(&listenerConns, -1)
+			atomic.AddInt32(&conns, -1)
+			log.Printf("连接数达到监听器 [%s] 上限 %d, 拒绝连接 [%s]", l.Addr().String(), ListenerMaxConns, conn.RemoteAddr().String())
+			conn.Close()
+			continue
+		}
+
+		done := func() {
+			atomic.AddInt32(&listenerConns, -1)
+			atomic.AddInt32(&conns, -1)
+		}
+		if Mode == ModeEpoll && poll(conn, done) {
+			continue
+		}
+		go func(conn net.Conn) {
+			defer done()
+
+			HandleConn(conn)
+		}(conn)
+	}
+}
+
+// 校验网络模式并启动所需的事件循环, 须在 Serve 之前调用
+func Init() error {
+	switch Mode {
+	case ModeGoroutine:
+		return nil
+	case ModeEpoll:
+		return startPollers(PollLoops)
+	default:
+		return errors.New(fmt.Sprintf("非法的网络模式: %s", Mode))
+	}
+}
+
+// 当前全局连接数
+func Conns() int {
+	return int(atomic.LoadInt32(&conns))
+}
+
+type ipBucket struct {
+	bucket *limit.TokenBucket
+
+	// 最近一次建连时间
+	last time.Time
+}
+
+// 按来源 IP 限制建连速率
+type connRateLimiter struct {
+	lock    sync.Mutex
+	buckets map[string]*ipBucket
+
+	// 最近一次清理时间
+	cleaned time.Time
+}
+
+func (this *connRateLimiter) allow(addr net.Addr) bool {
+	if IpConnRate <= 0 {
+		return true
+	}
+
+	ip := addr.String()
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		ip = tcpAddr.IP.String()
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := time.Now()
+	this.clean(now)
+
+	b := this.buckets[ip]
+	if b == nil {
+		b = &ipBucket{bucket: limit.NewTokenBucket(IpConnRate, float64(IpConnBurst))}
+		this.buckets[ip] = b
+	}
+	b.last = now
+	return b.bucket.Allow(1)
+}
+
+// 移除长时间未建连的 IP, 此时其令牌桶必然已满
+func (this *connRateLimiter) clean(now time.Time) {
+	if now.Sub(this.cleaned) < time.Minute {
+		return
+	}
+	this.cleaned = now
+
+	idle := time.Duration(float64(IpConnBurst)/IpConnRate*float64(time.Second)) + time.Second
+	for ip, b := range this.buckets {
+		if now.Sub(b.last) > idle {
+			delete(this.buckets, ip)
+		}
+	}
+}
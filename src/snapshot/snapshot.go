@@ -0,0 +1,309 @@
+// 状态快照, 用于在主机及版本之间迁移 broker 状态.
+// 快照为自描述的 json 文件, 包含持久会话(订阅、待确认及离线消息)与保留消息
+
+package snapshot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mqtt-go/src/codec"
+	"mqtt-go/src/persist"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// 快照格式标识
+	Format = "mqtt-go-snapshot"
+
+	// 当前快照版本, 导入时接受不高于此版本的快照
+	Version = 1
+)
+
+// 快照文件
+type Snapshot struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+
+	// payload 编码方式, 固定为 base64
+	PayloadEncoding string `json:"payloadEncoding"`
+
+	Sessions []*Session `json:"sessions"`
+	Retained []*Message `json:"retained"`
+}
+
+// 持久会话
+type Session struct {
+	ClientId string `json:"clientId"`
+
+	// 断开时间, 导出时在线则为零值
+	Disconnected time.Time `json:"disconnected"`
+
+	Subscriptions []*Subscription `json:"subscriptions"`
+
+	// 已发出待确认的消息, 导入后客户端重连时补发
+	Inflight []*Message `json:"inflight"`
+
+	// 离线消息
+	Queued []*Message `json:"queued"`
+}
+
+type Subscription struct {
+	Topic string `json:"topic"`
+	Qos   byte   `json:"qos"`
+}
+
+type Message struct {
+	Id       uint16 `json:"id,omitempty"`
+	Topic    string `json:"topic,omitempty"`
+	Qos      byte   `json:"qos"`
+	Retain   bool   `json:"retain,omitempty"`
+	Released bool   `json:"released,omitempty"`
+	Payload  []byte `json:"payload,omitempty"`
+}
+
+// 导入结果
+type Summary struct {
+	DryRun        bool `json:"dryRun"`
+	Sessions      int  `json:"sessions"`
+	Subscriptions int  `json:"subscriptions"`
+	Inflight      int  `json:"inflight"`
+	Queued        int  `json:"queued"`
+	Retained      int  `json:"retained"`
+
+	// 目标中已存在, 导入时被替换的会话
+	Replaced []string `json:"replaced"`
+}
+
+// 导出持久化中的全部状态.
+// topics 返回 client 当前的订阅, 为 nil 时使用持久化中的订阅
+func Export(p persist.Persistence, topics func(clientId string) map[string]byte) *Snapshot {
+	snap := &Snapshot{
+		Format:          Format,
+		Version:         Version,
+		Created:         time.Now(),
+		PayloadEncoding: "base64",
+		Sessions:        make([]*Session, 0),
+		Retained:        make([]*Message, 0),
+	}
+
+	for _, s := range p.Sessions() {
+		subs := s.Subs
+		if topics != nil {
+			subs = topics(s.ClientId)
+		}
+		session := &Session{
+			ClientId:      s.ClientId,
+			Disconnected:  s.Disconnected,
+			Subscriptions: make([]*Subscription, 0, len(subs)),
+			Inflight:      make([]*Message, 0, len(s.Inflight)),
+			Queued:        make([]*Message, 0, len(s.Queued)),
+		}
+		for topic, qos := range subs {
+			session.Subscriptions = append(session.Subscriptions, &Subscription{Topic: topic, Qos: qos})
+		}
+		sort.Slice(session.Subscriptions, func(i, j int) bool {
+			return session.Subscriptions[i].Topic < session.Subscriptions[j].Topic
+		})
+		for _, msg := range s.Inflight {
+			session.Inflight = append(session.Inflight, fromPersist(msg))
+		}
+		sort.Slice(session.Inflight, func(i, j int) bool { return session.Inflight[i].Id < session.Inflight[j].Id })
+		for _, msg := range s.Queued {
+			session.Queued = append(session.Queued, fromPersist(msg))
+		}
+		snap.Sessions = append(snap.Sessions, session)
+	}
+	for _, msg := range p.AllRetained() {
+		snap.Retained = append(snap.Retained, fromPersist(msg))
+	}
+	return snap
+}
+
+// 读取并校验快照
+func Read(r io.Reader) (*Snapshot, error) {
+	snap := new(Snapshot)
+	if err := json.NewDecoder(r).Decode(snap); err != nil {
+		return nil, errors.New(fmt.Sprintf("快照解析失败: %v", err))
+	}
+	if err := snap.Validate(); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// 写出快照
+func (this *Snapshot) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(this)
+}
+
+// 校验快照格式、版本及内容, 返回全部问题
+func (this *Snapshot) Validate() error {
+	if this.Format != Format {
+		return errors.New(fmt.Sprintf("非快照文件, format: %q", this.Format))
+	}
+	if this.Version < 1 || this.Version > Version {
+		return errors.New(fmt.Sprintf("不支持的快照版本: %d, 当前支持 1~%d", this.Version, Version))
+	}
+	if this.PayloadEncoding != "" && this.PayloadEncoding != "base64" {
+		return errors.New(fmt.Sprintf("不支持的 payload 编码: %s", this.PayloadEncoding))
+	}
+
+	var problems []string
+	clientIds := make(map[string]bool, len(this.Sessions))
+	for i, s := range this.Sessions {
+		where := fmt.Sprintf("sessions[%d]", i)
+		if s == nil || s.ClientId == "" {
+			problems = append(problems, where+": clientId 为空")
+			continue
+		}
+		where = fmt.Sprintf("sessions[%s]", s.ClientId)
+		if clientIds[s.ClientId] {
+			problems = append(problems, where+": clientId 重复")
+		}
+		clientIds[s.ClientId] = true
+
+		for _, sub := range s.Subscriptions {
+			if sub == nil || sub.Qos > 2 {
+				problems = append(problems, where+": 非法的订阅")
+				continue
+			}
+			if err := codec.ValidateTopicFilter(sub.Topic); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: 非法的订阅 %q: %v", where, sub.Topic, err))
+			}
+		}
+		ids := make(map[uint16]bool, len(s.Inflight))
+		for _, msg := range s.Inflight {
+			if msg == nil || msg.Id == 0 || ids[msg.Id] {
+				problems = append(problems, where+": 待确认消息 id 为空或重复")
+				continue
+			}
+			ids[msg.Id] = true
+			if err := msg.validate(!msg.Released); err != nil {
+				problems = append(problems, where+": "+err.Error())
+			}
+		}
+		for _, msg := range s.Queued {
+			if err := msg.validate(true); err != nil {
+				problems = append(problems, where+": "+err.Error())
+			}
+		}
+		if persist.MaxQueued > 0 && len(s.Queued) > persist.MaxQueued {
+			problems = append(problems, fmt.Sprintf("%s: 离线消息数 %d 超出上限 %d", where, len(s.Queued), persist.MaxQueued))
+		}
+	}
+	topics := make(map[string]bool, len(this.Retained))
+	for _, msg := range this.Retained {
+		if err := msg.validate(true); err != nil {
+			problems = append(problems, "retained: "+err.Error())
+			continue
+		}
+		if topics[msg.Topic] {
+			problems = append(problems, fmt.Sprintf("retained[%s]: 主题重复", msg.Topic))
+		}
+		topics[msg.Topic] = true
+	}
+
+	if len(problems) > 0 {
+		return errors.New(fmt.Sprintf("快照校验失败:\n  %s", strings.Join(problems, "\n  ")))
+	}
+	return nil
+}
+
+func (this *Message) validate(publish bool) error {
+	if this == nil {
+		return errors.New("消息为空")
+	}
+	if this.Qos > 2 {
+		return errors.New(fmt.Sprintf("非法的 Qos:%d", this.Qos))
+	}
+	if !publish {
+		return nil
+	}
+	if err := codec.ValidateTopicName(this.Topic); err != nil {
+		return errors.New(fmt.Sprintf("非法的消息主题 %q: %v", this.Topic, err))
+	}
+	return nil
+}
+
+// 将快照写入持久化, 已存在的同名会话被替换; dryRun 为 true 时仅统计不写入.
+// 每个会话完整构建后一次替换, 失败时原会话保留. 调用方须在此之前校验快照
+func (this *Snapshot) Apply(p persist.Persistence, dryRun bool) (*Summary, error) {
+	summary := &Summary{DryRun: dryRun, Replaced: make([]string, 0)}
+	for _, s := range this.Sessions {
+		summary.Sessions++
+		summary.Subscriptions += len(s.Subscriptions)
+		summary.Inflight += len(s.Inflight)
+		summary.Queued += len(s.Queued)
+		if p.HasSession(s.ClientId) {
+			summary.Replaced = append(summary.Replaced, s.ClientId)
+		}
+		if dryRun {
+			continue
+		}
+
+		if err := p.ReplaceSession(s.toPersist()); err != nil {
+			return summary, errors.New(fmt.Sprintf("会话 %s 导入失败: %v", s.ClientId, err))
+		}
+	}
+
+	summary.Retained = len(this.Retained)
+	if !dryRun {
+		for _, msg := range this.Retained {
+			m := msg.toPersist()
+			m.Retain = true
+			if err := p.SaveRetained(m); err != nil {
+				return summary, err
+			}
+		}
+	}
+	return summary, nil
+}
+
+func (this *Session) toPersist() *persist.Session {
+	s := &persist.Session{
+		ClientId:     this.ClientId,
+		Disconnected: this.Disconnected,
+		Subs:         make(map[string]byte, len(this.Subscriptions)),
+		Inflight:     make(map[uint16]*persist.Message, len(this.Inflight)),
+		Queued:       make([]*persist.Message, 0, len(this.Queued)),
+	}
+	for _, sub := range this.Subscriptions {
+		s.Subs[sub.Topic] = sub.Qos
+	}
+	for _, msg := range this.Inflight {
+		s.Inflight[msg.Id] = msg.toPersist()
+	}
+	for _, msg := range this.Queued {
+		s.Queued = append(s.Queued, msg.toPersist())
+	}
+	return s
+}
+
+func fromPersist(msg *persist.Message) *Message {
+	return &Message{
+		Id:       msg.Id,
+		Topic:    msg.Topic,
+		Qos:      msg.Qos,
+		Retain:   msg.Retain,
+		Released: msg.Released,
+		Payload:  msg.Payload,
+	}
+}
+
+func (this *Message) toPersist() *persist.Message {
+	return &persist.Message{
+		Id:       this.Id,
+		Topic:    this.Topic,
+		Qos:      this.Qos,
+		Retain:   this.Retain,
+		Released: this.Released,
+		Payload:  this.Payload,
+	}
+}
@@ -0,0 +1,172 @@
+package snapshot
+
+import (
+	"bytes"
+	"mqtt-go/src/persist"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 构建包含会话、订阅、待确认、离线及保留消息的状态
+func testState(t *testing.T) *persist.Memory {
+	m := persist.NewMemory()
+	disconnected := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	steps := []error{
+		m.SaveSession("c1", disconnected),
+		m.Subscribe("c1", "a/b", 1),
+		m.Subscribe("c1", "a/c", 2),
+		m.SaveInflight("c1", &persist.Message{Id: 1, Topic: "a/b", Qos: 1, Payload: []byte("in1")}),
+		m.SaveInflight("c1", &persist.Message{Id: 2, Qos: 2, Released: true}),
+		m.Enqueue("c1", &persist.Message{Topic: "a/c", Qos: 2, Payload: []byte("q1")}),
+		m.Enqueue("c1", &persist.Message{Topic: "a/b", Qos: 1, Payload: []byte{0, 1, 2}}),
+		m.SaveSession("c2", time.Time{}),
+		m.Subscribe("c2", "x", 0),
+		m.SaveRetained(&persist.Message{Topic: "r/1", Qos: 1, Retain: true, Payload: []byte("r1")}),
+		m.SaveRetained(&persist.Message{Topic: "r/2", Retain: true, Payload: []byte("r2")}),
+	}
+	for _, err := range steps {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return m
+}
+
+// Export -> Write -> Read -> Apply 到新的状态后再次导出, 内容相同
+func TestRoundTrip(t *testing.T) {
+	snap := Export(testState(t), nil)
+
+	var buf bytes.Buffer
+	if err := snap.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	read, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := read.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	target := persist.NewMemory()
+	summary, err := read.Apply(target, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Summary{Sessions: 2, Subscriptions: 3, Inflight: 2, Queued: 2, Retained: 2, Replaced: []string{}}
+	if !reflect.DeepEqual(summary, want) {
+		t.Fatalf("导入结果: %+v", summary)
+	}
+
+	again := Export(target, nil)
+	if !reflect.DeepEqual(again.Sessions, snap.Sessions) || !reflect.DeepEqual(again.Retained, snap.Retained) {
+		t.Fatalf("导入后的状态不同:\n%+v\n%+v", again.Sessions, snap.Sessions)
+	}
+
+	// 再次导入替换已存在的会话
+	if summary, err = read.Apply(target, false); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(summary.Replaced, []string{"c1", "c2"}) {
+		t.Fatalf("替换的会话: %v", summary.Replaced)
+	}
+	if again = Export(target, nil); !reflect.DeepEqual(again.Sessions, snap.Sessions) {
+		t.Fatalf("重复导入后的状态不同: %+v", again.Sessions)
+	}
+}
+
+// dry-run 仅统计, 不修改目标
+func TestDryRun(t *testing.T) {
+	snap := Export(testState(t), nil)
+
+	target := persist.NewMemory()
+	if err := target.SaveSession("c1", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	before := Export(target, nil)
+
+	summary, err := snap.Apply(target, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !summary.DryRun || summary.Sessions != 2 || summary.Retained != 2 || !reflect.DeepEqual(summary.Replaced, []string{"c1"}) {
+		t.Fatalf("导入结果: %+v", summary)
+	}
+
+	after := Export(target, nil)
+	if !reflect.DeepEqual(after.Sessions, before.Sessions) || len(after.Retained) != 0 {
+		t.Fatalf("dry-run 修改了状态: %+v %+v", after.Sessions, after.Retained)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	snap := Export(testState(t), nil)
+	snap.Sessions = append(snap.Sessions, &Session{ClientId: "c1"}, &Session{})
+	snap.Retained = append(snap.Retained, &Message{Qos: 3})
+
+	err := snap.Validate()
+	if err == nil {
+		t.Fatal("应校验失败")
+	}
+	for _, s := range []string{"clientId 重复", "clientId 为空", "非法的 Qos:3"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Fatalf("缺少问题 %q: %v", s, err)
+		}
+	}
+
+	// 主题过滤器及主题按报文的规则校验
+	snap = Export(testState(t), nil)
+	for _, filter := range []string{"a#", "a/#/b", "+x", "a/\xff", "a\x00", ""} {
+		snap.Sessions[0].Subscriptions = append(snap.Sessions[0].Subscriptions, &Subscription{Topic: filter})
+	}
+	snap.Sessions[0].Queued = append(snap.Sessions[0].Queued, &Message{Topic: "a/+", Qos: 1})
+	snap.Retained = append(snap.Retained, &Message{Topic: "r/\x00", Retain: true})
+	err = snap.Validate()
+	if err == nil {
+		t.Fatal("应校验失败")
+	}
+	for _, s := range []string{`"a#"`, `"a/#/b"`, `"+x"`, `"a/\xff"`, `"a\x00"`, `""`, `"a/+"`, `"r/\x00"`} {
+		if !strings.Contains(err.Error(), s) {
+			t.Fatalf("缺少问题 %s: %v", s, err)
+		}
+	}
+
+	// 离线消息数超出上限
+	snap = Export(testState(t), nil)
+	origin := persist.MaxQueued
+	persist.MaxQueued = 1
+	defer func() { persist.MaxQueued = origin }()
+	if err := snap.Validate(); err == nil || !strings.Contains(err.Error(), "超出上限") {
+		t.Fatalf("应拒绝超出上限的离线消息: %v", err)
+	}
+	persist.MaxQueued = origin
+
+	snap = Export(persist.NewMemory(), nil)
+	snap.Version = Version + 1
+	if err := snap.Validate(); err == nil {
+		t.Fatal("应拒绝更高的版本")
+	}
+}
+
+// 会话导入失败时保留原会话, 不留下部分导入的状态
+func TestApplyKeepsSession(t *testing.T) {
+	snap := Export(testState(t), nil)
+	target := testState(t)
+	if err := target.Unsubscribe("c1", "a/c"); err != nil {
+		t.Fatal(err)
+	}
+	before := Export(target, nil)
+
+	// 校验之后上限被调低
+	origin := persist.MaxQueued
+	persist.MaxQueued = 1
+	defer func() { persist.MaxQueued = origin }()
+	if _, err := snap.Apply(target, false); err == nil {
+		t.Fatal("应导入失败")
+	}
+	if after := Export(target, nil); !reflect.DeepEqual(after.Sessions, before.Sessions) {
+		t.Fatalf("导入失败后会话被修改:\n%+v\n%+v", after.Sessions, before.Sessions)
+	}
+}
@@ -2,99 +2,298 @@ package store
 
 import (
 	"mqtt-go/src/message"
+	"mqtt-go/src/utils"
+	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 const PlaceHolder = true
 
-var Store = &store{
-	allTopics:    make(map[string]bool),
-	topicClients: make(map[string]map[string]byte),
-	clientTopics: make(map[string]map[string]byte),
-}
+// 分片数
+const shardCount = 64
+
+// 匹配结果最多缓存的主题数, 超出后清空
+const cacheSize = 10000
+
+var Store = newStore()
 
-// 存储服务
+// 存储服务.
+// 每个过滤器的订阅者保存在 map 中, 订阅变更为 O(1); 含通配符的过滤器另有只读索引, 增删过滤器时复制后整体替换.
+// 发布主题的匹配结果(精确过滤器及匹配的通配符过滤器的订阅者)按主题缓存,
+// 热点主题发布时无锁读取且无需分配, 订阅变更时仅失效受影响主题的缓存.
+// 写入方按过滤器及 clientId 分片加锁, 不同过滤器的订阅变更互不阻塞
 type store struct {
-	// 全部主题, set 集合
-	allTopics map[string]bool
-	lock0     sync.RWMutex
+	// filter(one) <--> *filterEntry
+	filters sync.Map
+
+	// 过滤器锁分片
+	filterShards [shardCount]sync.Mutex
+
+	// 含通配符的过滤器, []string, 只读
+	wildcards    atomic.Value
+	wildcardLock sync.Mutex
+
+	// topic(one) <--> []*message.ClientSub, 匹配结果缓存, 只读
+	cache  sync.Map
+	cached int64
+
+	// 订阅变更计数, 匹配期间发生变更的结果不缓存
+	version uint64
+
+	// client(one) <--> topic(many), 按 clientId 分片
+	clientShards [shardCount]clientShard
+}
 
-	// topic(one) <--> clientId(many)
-	topicClients map[string]map[string]byte
+// 单个过滤器的订阅者
+type filterEntry struct {
+	// clientId <--> qos, 由过滤器所在分片的锁保护
+	subs map[string]byte
+}
 
-	// client(one) <--> topic(many)
-	clientTopics map[string]map[string]byte
+type clientShard struct {
+	lock   sync.Mutex
+	topics map[string]map[string]byte
 }
 
-// 获取订阅指定 topic 的 client 集合
+func newStore() *store {
+	s := &store{}
+	for i := range s.clientShards {
+		s.clientShards[i].topics = make(map[string]map[string]byte)
+	}
+	return s
+}
+
+// FNV-1a 取分片
+func shard(key string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % shardCount)
+}
+
+// 获取订阅者与 topic 匹配的 client 集合, 同一 client 的多个订阅匹配时取最大 qos.
+// 返回的切片为共享快照, 调用方不得修改
 func (this *store) Search(topic string) []*message.ClientSub {
-	this.lock0.RLock()
-	defer this.lock0.RUnlock()
+	if v, ok := this.cache.Load(topic); ok {
+		return v.([]*message.ClientSub)
+	}
 
-	m := this.topicClients[topic]
-	if m == nil {
-		return nil
+	version := atomic.LoadUint64(&this.version)
+	subs := this.match(topic)
+	this.remember(topic, subs, version)
+	return subs
+}
+
+// 匹配精确过滤器及含通配符的过滤器 [MQTT-4.7]
+func (this *store) match(topic string) []*message.ClientSub {
+	var subs []*message.ClientSub
+
+	// clientId <--> subs 下标
+	var seen map[string]int
+	add := func(filter string) {
+		v, ok := this.filters.Load(filter)
+		if !ok {
+			return
+		}
+		lock := &this.filterShards[shard(filter)]
+		lock.Lock()
+		defer lock.Unlock()
+
+		if seen == nil {
+			seen = make(map[string]int, len(v.(*filterEntry).subs))
+		}
+		for clientId, qos := range v.(*filterEntry).subs {
+			if i, ok := seen[clientId]; ok {
+				if qos > subs[i].Qos {
+					subs[i] = &message.ClientSub{Qos: qos, ClientId: clientId}
+				}
+				continue
+			}
+			seen[clientId] = len(subs)
+			subs = append(subs, &message.ClientSub{Qos: qos, ClientId: clientId})
+		}
 	}
-	clientIds := make([]*message.ClientSub, 0, len(m))
-	for k, v := range m {
-		clientIds = append(clientIds, &message.ClientSub{
-			Qos:      v,
-			ClientId: k,
-		})
+
+	add(topic)
+	for _, filter := range this.loadWildcards() {
+		if utils.Match(topic, filter) {
+			add(filter)
+		}
 	}
+	return subs
+}
 
-	return clientIds
+// 缓存匹配结果, 匹配期间订阅发生变更时丢弃.
+// 先写入后检查, 与 invalidate 先变更计数后删除配合, 不会留下过期的结果
+func (this *store) remember(topic string, subs []*message.ClientSub, version uint64) {
+	if _, loaded := this.cache.LoadOrStore(topic, subs); !loaded {
+		if atomic.AddInt64(&this.cached, 1) > cacheSize {
+			// 主题过多时清空, 由仍在发布的热点主题重新填充
+			this.cache.Range(func(key, _ interface{}) bool {
+				this.forget(key.(string))
+				return true
+			})
+			return
+		}
+	}
+	if atomic.LoadUint64(&this.version) != version {
+		this.forget(topic)
+	}
+}
+
+func (this *store) forget(topic string) {
+	if _, ok := this.cache.LoadAndDelete(topic); ok {
+		atomic.AddInt64(&this.cached, -1)
+	}
+}
+
+// 失效与过滤器匹配的主题的缓存
+func (this *store) invalidate(filter string) {
+	atomic.AddUint64(&this.version, 1)
+	if !isWildcard(filter) {
+		this.forget(filter)
+		return
+	}
+	this.cache.Range(func(key, _ interface{}) bool {
+		if topic := key.(string); utils.Match(topic, filter) {
+			this.forget(topic)
+		}
+		return true
+	})
+}
+
+func isWildcard(filter string) bool {
+	return strings.ContainsAny(filter, "+#")
+}
+
+func (this *store) loadWildcards() []string {
+	filters, _ := this.wildcards.Load().([]string)
+	return filters
+}
+
+// 增删含通配符的过滤器, 复制后整体替换索引
+func (this *store) updateWildcards(filter string, remove bool) {
+	this.wildcardLock.Lock()
+	defer this.wildcardLock.Unlock()
+
+	old := this.loadWildcards()
+	filters := make([]string, 0, len(old)+1)
+	for _, f := range old {
+		if f != filter {
+			filters = append(filters, f)
+		}
+	}
+	if !remove {
+		filters = append(filters, filter)
+	}
+	this.wildcards.Store(filters)
+}
+
+// 返回 client 订阅的 topic 集合副本
+func (this *store) Topics(clientId string) map[string]byte {
+	cs := &this.clientShards[shard(clientId)]
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	topics := make(map[string]byte, len(cs.topics[clientId]))
+	for topic, qos := range cs.topics[clientId] {
+		topics[topic] = qos
+	}
+	return topics
 }
 
 // 订阅
 func (this *store) Subscribe(clientId string, topics ...*message.Topic) {
-	this.lock0.Lock()
-	defer this.lock0.Unlock()
+	cs := &this.clientShards[shard(clientId)]
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
 
 	// client 订阅的 topic 集合
-	if this.clientTopics[clientId] == nil {
-		this.clientTopics[clientId] = make(map[string]byte)
+	clientTopics := cs.topics[clientId]
+	if clientTopics == nil {
+		clientTopics = make(map[string]byte)
+		cs.topics[clientId] = clientTopics
 	}
-	clientTopics := this.clientTopics[clientId]
 
 	for _, topic := range topics {
 		clientTopics[topic.Name] = topic.Qos
-
-		if this.topicClients[topic.Name] == nil {
-			this.topicClients[topic.Name] = make(map[string]byte)
-		}
-		topicClientSet := this.topicClients[topic.Name]
-
-		topicClientSet[clientId] = topic.Qos
+		this.update(topic.Name, clientId, topic.Qos, false)
 	}
 }
 
 // 解除订阅
 func (this *store) RemoveSub(clientId string, topics ...string) {
-	this.lock0.Lock()
-	defer this.lock0.Unlock()
+	cs := &this.clientShards[shard(clientId)]
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
 
 	// client 订阅的 topic 集合
-	clientTopics := this.clientTopics[clientId]
+	clientTopics := cs.topics[clientId]
 	if clientTopics == nil {
 		// client 无订阅关系
 		return
 	}
 
 	for _, topic := range topics {
+		if _, ok := clientTopics[topic]; !ok {
+			continue
+		}
+
 		// 移除订阅
 		delete(clientTopics, topic)
 
 		// 主题客户端订阅集合关系移除
-		topicClientSet := this.topicClients[topic]
-		delete(topicClientSet, clientId)
+		this.update(topic, clientId, 0, true)
 	}
 }
 
 // 移除全部订阅
-func (s *store) RemoveAllSub(clientId string) {
-	s.lock0.Lock()
-	defer s.lock0.Unlock()
+func (this *store) RemoveAllSub(clientId string) {
+	cs := &this.clientShards[shard(clientId)]
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	for topic := range cs.topics[clientId] {
+		this.update(topic, clientId, 0, true)
+	}
+	delete(cs.topics, clientId)
+}
+
+// 变更过滤器的订阅者并失效相关缓存, 调用方需持有 clientId 所在分片的锁.
+// 加锁顺序固定为先 client 分片后过滤器分片
+func (this *store) update(filter string, clientId string, qos byte, remove bool) {
+	lock := &this.filterShards[shard(filter)]
+	lock.Lock()
+	defer lock.Unlock()
+
+	var entry *filterEntry
+	if v, ok := this.filters.Load(filter); ok {
+		entry = v.(*filterEntry)
+	}
+
+	switch {
+	case remove && entry == nil:
+		return
+	case remove:
+		delete(entry.subs, clientId)
+		if len(entry.subs) == 0 {
+			this.filters.Delete(filter)
+			if isWildcard(filter) {
+				this.updateWildcards(filter, true)
+			}
+		}
+	case entry == nil:
+		entry = &filterEntry{subs: map[string]byte{clientId: qos}}
+		this.filters.Store(filter, entry)
+		if isWildcard(filter) {
+			this.updateWildcards(filter, false)
+		}
+	default:
+		entry.subs[clientId] = qos
+	}
 
-	delete(s.clientTopics, clientId)
+	this.invalidate(filter)
 }
@@ -0,0 +1,340 @@
+package store
+
+import (
+	"mqtt-go/src/message"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// 匹配结果, clientId <--> qos
+func search(s *store, topic string) map[string]byte {
+	subs := make(map[string]byte)
+	for _, sub := range s.Search(topic) {
+		if _, ok := subs[sub.ClientId]; ok {
+			panic("重复的订阅者: " + sub.ClientId)
+		}
+		subs[sub.ClientId] = sub.Qos
+	}
+	return subs
+}
+
+func expectSearch(t *testing.T, s *store, topic string, want map[string]byte) {
+	t.Helper()
+	if got := search(s, topic); !reflect.DeepEqual(got, want) {
+		t.Fatalf("%s: %v, 应为 %v", topic, got, want)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	s := newStore()
+	s.Subscribe("exact", &message.Topic{Name: "a/b/c", Qos: 2})
+	s.Subscribe("plus", &message.Topic{Name: "a/+/c", Qos: 1})
+	s.Subscribe("hash", &message.Topic{Name: "a/#", Qos: 0})
+	s.Subscribe("all", &message.Topic{Name: "#", Qos: 1})
+	s.Subscribe("sys", &message.Topic{Name: "$SYS/#", Qos: 1}, &message.Topic{Name: "$SYS/+/load", Qos: 2})
+
+	expectSearch(t, s, "a/b/c", map[string]byte{"exact": 2, "plus": 1, "hash": 0, "all": 1})
+	expectSearch(t, s, "a/x/c", map[string]byte{"plus": 1, "hash": 0, "all": 1})
+	expectSearch(t, s, "a/b/c/d", map[string]byte{"hash": 0, "all": 1})
+
+	// # 匹配父级 [MQTT-4.7.1-2]
+	expectSearch(t, s, "a", map[string]byte{"hash": 0, "all": 1})
+
+	// + 匹配空层级
+	expectSearch(t, s, "a//c", map[string]byte{"plus": 1, "hash": 0, "all": 1})
+	expectSearch(t, s, "b", map[string]byte{"all": 1})
+
+	// 以 $ 开头的主题不匹配以通配符开头的过滤器 [MQTT-4.7.2-1]
+	expectSearch(t, s, "$SYS/cpu/load", map[string]byte{"sys": 2})
+	expectSearch(t, s, "$SYS/uptime", map[string]byte{"sys": 1})
+}
+
+// 匹配结果缓存随订阅变更失效
+func TestSearchInvalidate(t *testing.T) {
+	s := newStore()
+	s.Subscribe("c1", &message.Topic{Name: "a/b", Qos: 1})
+	expectSearch(t, s, "a/b", map[string]byte{"c1": 1})
+	expectSearch(t, s, "a/c", map[string]byte{})
+
+	// 新增通配符订阅
+	s.Subscribe("c2", &message.Topic{Name: "a/+", Qos: 0})
+	expectSearch(t, s, "a/b", map[string]byte{"c1": 1, "c2": 0})
+	expectSearch(t, s, "a/c", map[string]byte{"c2": 0})
+
+	// 同一 client 重叠的订阅取最大 qos, 重新订阅替换 qos
+	s.Subscribe("c1", &message.Topic{Name: "a/#", Qos: 2})
+	expectSearch(t, s, "a/b", map[string]byte{"c1": 2, "c2": 0})
+	s.Subscribe("c1", &message.Topic{Name: "a/#", Qos: 0})
+	expectSearch(t, s, "a/b", map[string]byte{"c1": 1, "c2": 0})
+
+	// 解除订阅
+	s.RemoveSub("c1", "a/b")
+	expectSearch(t, s, "a/b", map[string]byte{"c1": 0, "c2": 0})
+	s.RemoveSub("c2", "a/+")
+	expectSearch(t, s, "a/c", map[string]byte{"c1": 0})
+	s.RemoveAllSub("c1")
+	expectSearch(t, s, "a/b", map[string]byte{})
+	expectSearch(t, s, "a/c", map[string]byte{})
+
+	if n := len(s.loadWildcards()); n != 0 {
+		t.Fatalf("通配符索引未清理: %d", n)
+	}
+	if topics := s.Topics("c1"); len(topics) != 0 {
+		t.Fatalf("订阅未清理: %v", topics)
+	}
+}
+
+// 并发订阅变更及匹配后, 缓存不应残留过期的结果
+func TestSearchConcurrent(t *testing.T) {
+	s := newStore()
+	filters := []string{"a/b", "a/+", "a/#", "+/b", "#"}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				s.Search("a/b")
+			}
+		}()
+	}
+
+	var churn sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		churn.Add(1)
+		go func(i int) {
+			defer churn.Done()
+			clientId := "c" + strconv.Itoa(i)
+			for j := 0; j < 2000; j++ {
+				filter := filters[(i+j)%len(filters)]
+				s.Subscribe(clientId, &message.Topic{Name: filter, Qos: byte(j % 3)})
+				if j%2 == 0 {
+					s.RemoveSub(clientId, filter)
+				}
+			}
+		}(i)
+	}
+	churn.Wait()
+	close(stop)
+	wg.Wait()
+
+	want := make(map[string]byte)
+	for i := 0; i < 4; i++ {
+		clientId := "c" + strconv.Itoa(i)
+		for _, qos := range s.Topics(clientId) {
+			if old, ok := want[clientId]; !ok || qos > old {
+				want[clientId] = qos
+			}
+		}
+	}
+	expectSearch(t, s, "a/b", want)
+
+	var filtersLeft []string
+	s.filters.Range(func(key, _ interface{}) bool {
+		if isWildcard(key.(string)) {
+			filtersLeft = append(filtersLeft, key.(string))
+		}
+		return true
+	})
+	wildcards := append([]string(nil), s.loadWildcards()...)
+	sort.Strings(filtersLeft)
+	sort.Strings(wildcards)
+	if !reflect.DeepEqual(filtersLeft, wildcards) {
+		t.Fatalf("通配符索引 %v, 应为 %v", wildcards, filtersLeft)
+	}
+}
+
+// 原有实现: 单把读写锁, 每次匹配分配新的切片
+type lockedStore struct {
+	lock         sync.RWMutex
+	topicClients map[string]map[string]byte
+	clientTopics map[string]map[string]byte
+}
+
+func newLockedStore() *lockedStore {
+	return &lockedStore{
+		topicClients: make(map[string]map[string]byte),
+		clientTopics: make(map[string]map[string]byte),
+	}
+}
+
+func (this *lockedStore) Search(topic string) []*message.ClientSub {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	m := this.topicClients[topic]
+	if m == nil {
+		return nil
+	}
+	clientIds := make([]*message.ClientSub, 0, len(m))
+	for k, v := range m {
+		clientIds = append(clientIds, &message.ClientSub{Qos: v, ClientId: k})
+	}
+	return clientIds
+}
+
+func (this *lockedStore) Subscribe(clientId string, topics ...*message.Topic) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.clientTopics[clientId] == nil {
+		this.clientTopics[clientId] = make(map[string]byte)
+	}
+	for _, topic := range topics {
+		this.clientTopics[clientId][topic.Name] = topic.Qos
+		if this.topicClients[topic.Name] == nil {
+			this.topicClients[topic.Name] = make(map[string]byte)
+		}
+		this.topicClients[topic.Name][clientId] = topic.Qos
+	}
+}
+
+func (this *lockedStore) RemoveSub(clientId string, topics ...string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for _, topic := range topics {
+		delete(this.clientTopics[clientId], topic)
+		delete(this.topicClients[topic], clientId)
+	}
+}
+
+type subStore interface {
+	Search(topic string) []*message.ClientSub
+	Subscribe(clientId string, topics ...*message.Topic)
+	RemoveSub(clientId string, topics ...string)
+}
+
+// 1000 个主题, 每个主题 subsPerTopic 个订阅者
+func fill(s subStore, subsPerTopic int) []string {
+	topics := make([]string, 1000)
+	for i := range topics {
+		topics[i] = "sensor/" + strconv.Itoa(i) + "/data"
+		for j := 0; j < subsPerTopic; j++ {
+			s.Subscribe("c"+strconv.Itoa(j), &message.Topic{Name: topics[i], Qos: 1})
+		}
+	}
+	return topics
+}
+
+// 并发匹配, churn 为 true 时另有一个 goroutine 持续订阅、解除订阅
+func benchSearch(b *testing.B, s subStore, churn bool) {
+	topics := fill(s, 10)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var churned int64
+	if churn {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				topic := topics[i%len(topics)]
+				s.Subscribe("churn", &message.Topic{Name: topic, Qos: 0})
+				s.RemoveSub("churn", topic)
+				atomic.AddInt64(&churned, 1)
+			}
+		}()
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if len(s.Search(topics[i%len(topics)])) == 0 {
+				b.Fatal("无匹配结果")
+			}
+			i++
+		}
+	})
+	b.StopTimer()
+
+	close(stop)
+	wg.Wait()
+	if churn {
+		b.ReportMetric(float64(atomic.LoadInt64(&churned))/b.Elapsed().Seconds(), "churn/s")
+	}
+}
+
+func BenchmarkSearchLocked(b *testing.B) {
+	benchSearch(b, newLockedStore(), false)
+}
+
+func BenchmarkSearch(b *testing.B) {
+	benchSearch(b, newStore(), false)
+}
+
+// 另有 100 个不匹配及 10 个匹配发布主题的通配符过滤器
+func BenchmarkSearchWildcard(b *testing.B) {
+	s := newStore()
+	for i := 0; i < 100; i++ {
+		s.Subscribe("w"+strconv.Itoa(i), &message.Topic{Name: "sensor/+/" + strconv.Itoa(i%10), Qos: 0})
+	}
+	for i := 0; i < 10; i++ {
+		s.Subscribe("d"+strconv.Itoa(i), &message.Topic{Name: "sensor/+/data", Qos: 0})
+	}
+	benchSearch(b, s, false)
+}
+
+func BenchmarkSearchWildcardChurn(b *testing.B) {
+	s := newStore()
+	for i := 0; i < 10; i++ {
+		s.Subscribe("d"+strconv.Itoa(i), &message.Topic{Name: "sensor/+/data", Qos: 0})
+	}
+	benchSearch(b, s, true)
+}
+
+func BenchmarkSearchLockedChurn(b *testing.B) {
+	benchSearch(b, newLockedStore(), true)
+}
+
+func BenchmarkSearchChurn(b *testing.B) {
+	benchSearch(b, newStore(), true)
+}
+
+// 并发订阅、解除订阅不同主题
+func benchChurn(b *testing.B, s subStore) {
+	topics := fill(s, 10)
+	var seq int64
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		n := atomic.AddInt64(&seq, 1)
+		clientId := "churn" + strconv.FormatInt(n, 10)
+
+		// 各 goroutine 从不同主题开始, 模拟不同客户端操作不同主题
+		i := int(n) * 97
+		for pb.Next() {
+			topic := topics[i%len(topics)]
+			s.Subscribe(clientId, &message.Topic{Name: topic, Qos: 0})
+			s.RemoveSub(clientId, topic)
+			i++
+		}
+	})
+}
+
+func BenchmarkChurnLocked(b *testing.B) {
+	benchChurn(b, newLockedStore())
+}
+
+func BenchmarkChurn(b *testing.B) {
+	benchChurn(b, newStore())
+}
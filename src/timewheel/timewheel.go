@@ -0,0 +1,234 @@
+// 分层时间轮, 供心跳检测、qos 重发、会话过期及延迟消息共用
+
+package timewheel
+
+import (
+	"sync"
+	"time"
+)
+
+// 定时任务
+type Timer struct {
+	// 到期 tick
+	expire int64
+
+	fn func()
+
+	// 所在槽位的双向链表
+	prev, next *Timer
+	slot       *slot
+
+	wheel *TimingWheel
+}
+
+// 取消定时任务, 返回任务是否在到期前被取消
+func (this *Timer) Stop() bool {
+	w := this.wheel
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if this.slot == nil {
+		return false
+	}
+	this.slot.remove(this)
+	return true
+}
+
+// 重新设置到期时间, 任务已到期或已取消时重新加入时间轮
+func (this *Timer) Reset(d time.Duration) {
+	w := this.wheel
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if this.slot != nil {
+		this.slot.remove(this)
+	}
+	this.expire = w.current + w.ticks(d)
+	w.add(this)
+}
+
+// 槽位, 哨兵节点组成的环形链表
+type slot struct {
+	root Timer
+}
+
+func (this *slot) init() {
+	this.root.next = &this.root
+	this.root.prev = &this.root
+}
+
+func (this *slot) push(t *Timer) {
+	t.prev = this.root.prev
+	t.next = &this.root
+	t.prev.next = t
+	this.root.prev = t
+	t.slot = this
+}
+
+func (this *slot) remove(t *Timer) {
+	t.prev.next = t.next
+	t.next.prev = t.prev
+	t.prev, t.next, t.slot = nil, nil, nil
+}
+
+// 取出槽位内全部任务
+func (this *slot) flush() []*Timer {
+	var timers []*Timer
+	for t := this.root.next; t != &this.root; {
+		next := t.next
+		t.prev, t.next, t.slot = nil, nil, nil
+		timers = append(timers, t)
+		t = next
+	}
+	this.init()
+	return timers
+}
+
+// 分层时间轮.
+// 第 i 层每个槽位跨度为 tick * slots^i, 任务按剩余时间放入能容纳它的最低层,
+// 高层槽位到期时将任务降级放入低层, 第 0 层槽位到期时执行任务.
+// 增删任务均为 O(1), 适合大量频繁重置的定时任务
+type TimingWheel struct {
+	lock sync.Mutex
+
+	// 最小时间精度
+	tick time.Duration
+
+	// 每层槽位数
+	size int64
+
+	levels [][]slot
+
+	// 已经过的 tick 数
+	current int64
+
+	stop chan struct{}
+}
+
+// 构建时间轮, 可表示的最长时间为 tick * slots^levels, 更长的任务在最高层循环等待
+func New(tick time.Duration, slots int, levels int) *TimingWheel {
+	w := &TimingWheel{
+		tick:   tick,
+		size:   int64(slots),
+		levels: make([][]slot, levels),
+		stop:   make(chan struct{}),
+	}
+	for i := range w.levels {
+		w.levels[i] = make([]slot, slots)
+		for j := range w.levels[i] {
+			w.levels[i][j].init()
+		}
+	}
+	return w
+}
+
+// 默认时间轮, 精度 100ms, 最高层槽位跨度约 155 天
+var Default = New(100*time.Millisecond, 512, 4)
+
+func init() {
+	Default.Start()
+}
+
+// 启动驱动 goroutine
+func (this *TimingWheel) Start() {
+	go func() {
+		start := time.Now()
+		ticker := time.NewTicker(this.tick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// ticker 在驱动 goroutine 繁忙时会丢弃 tick, 按实际流逝的时间追赶
+				for target := int64(time.Since(start) / this.tick); this.now() < target; {
+					this.advance()
+				}
+			case <-this.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (this *TimingWheel) now() int64 {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.current
+}
+
+// 停止时间轮, 未到期的任务不再执行
+func (this *TimingWheel) Stop() {
+	close(this.stop)
+}
+
+// d 之后在时间轮 goroutine 中执行 fn, fn 不应阻塞
+func (this *TimingWheel) AfterFunc(d time.Duration, fn func()) *Timer {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	t := &Timer{
+		expire: this.current + this.ticks(d),
+		fn:     fn,
+		wheel:  this,
+	}
+	this.add(t)
+	return t
+}
+
+// 构建未启动的定时任务, 由 Reset 加入时间轮; fn 中需引用任务本身时使用
+func (this *TimingWheel) NewTimer(fn func()) *Timer {
+	return &Timer{fn: fn, wheel: this}
+}
+
+// 时长换算为 tick 数, 向上取整且至少为 1
+func (this *TimingWheel) ticks(d time.Duration) int64 {
+	n := int64((d + this.tick - 1) / this.tick)
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// 放入能容纳任务的最低层, 调用方需持有锁
+func (this *TimingWheel) add(t *Timer) {
+	delta := t.expire - this.current
+	span := this.size
+	for level := range this.levels {
+		if delta < span || level == len(this.levels)-1 {
+			// 超出最高层跨度的任务放入最高层, 降级时重新计算
+			index := (t.expire / (span / this.size)) % this.size
+			if delta >= span {
+				index = (this.current/(span/this.size) + this.size - 1) % this.size
+			}
+			this.levels[level][index].push(t)
+			return
+		}
+		span *= this.size
+	}
+}
+
+// 前进一个 tick, 执行到期任务
+func (this *TimingWheel) advance() {
+	this.lock.Lock()
+	this.current++
+
+	// 高层槽位到期, 任务降级
+	interval := int64(1)
+	for level := 1; level < len(this.levels); level++ {
+		interval *= this.size
+		if this.current%interval != 0 {
+			break
+		}
+		index := (this.current / interval) % this.size
+		for _, t := range this.levels[level][index].flush() {
+			this.add(t)
+		}
+	}
+
+	expired := this.levels[0][this.current%this.size].flush()
+	this.lock.Unlock()
+
+	for _, t := range expired {
+		t.fn()
+	}
+}
@@ -0,0 +1,175 @@
+package timewheel
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 手动推进的时间轮: 每层 4 个槽位, 3 层可表示 64 个 tick
+func manual() *TimingWheel {
+	return New(time.Millisecond, 4, 3)
+}
+
+// 任务跨层降级后须在准确的 tick 执行, 超出最高层跨度的任务在最高层循环等待
+func TestCascade(t *testing.T) {
+	w := manual()
+
+	fired := make(map[int64]int64)
+	for _, n := range []int64{1, 3, 4, 5, 15, 16, 17, 63, 64, 65, 100, 200, 1000} {
+		n := n
+		w.AfterFunc(time.Duration(n)*time.Millisecond, func() { fired[n] = w.current })
+	}
+	for i := 0; i < 1000; i++ {
+		w.advance()
+	}
+
+	if len(fired) != 13 {
+		t.Fatalf("执行的任务: %v", fired)
+	}
+	for n, at := range fired {
+		if n != at {
+			t.Fatalf("%d tick 的任务在 %d tick 执行", n, at)
+		}
+	}
+}
+
+// 在时间轮已推进后加入的任务按当前 tick 起算
+func TestCascadeOffset(t *testing.T) {
+	w := manual()
+	for i := 0; i < 37; i++ {
+		w.advance()
+	}
+
+	var at int64
+	w.AfterFunc(30*time.Millisecond, func() { at = w.current })
+	for i := 0; i < 100; i++ {
+		w.advance()
+	}
+	if at != 67 {
+		t.Fatalf("任务在 %d tick 执行, 应为 67", at)
+	}
+}
+
+func TestStopReset(t *testing.T) {
+	w := manual()
+
+	count := 0
+	timer := w.NewTimer(func() { count++ })
+	if timer.Stop() {
+		t.Fatal("未加入的任务不应取消成功")
+	}
+
+	timer.Reset(20 * time.Millisecond)
+	if !timer.Stop() {
+		t.Fatal("未到期的任务应取消成功")
+	}
+	for i := 0; i < 30; i++ {
+		w.advance()
+	}
+	if count != 0 {
+		t.Fatal("已取消的任务不应执行")
+	}
+
+	// 重置替换原到期时间
+	timer.Reset(20 * time.Millisecond)
+	timer.Reset(5 * time.Millisecond)
+	for i := 0; i < 30; i++ {
+		w.advance()
+	}
+	if count != 1 {
+		t.Fatalf("任务执行 %d 次, 应为 1", count)
+	}
+	if timer.Stop() {
+		t.Fatal("已到期的任务不应取消成功")
+	}
+
+	// 到期后重置再次执行
+	timer.Reset(time.Millisecond)
+	w.advance()
+	if count != 2 {
+		t.Fatalf("任务执行 %d 次, 应为 2", count)
+	}
+}
+
+// 任务在执行中重置自身
+func TestResetInCallback(t *testing.T) {
+	w := manual()
+
+	var count int
+	var timer *Timer
+	timer = w.NewTimer(func() {
+		if count++; count < 3 {
+			timer.Reset(10 * time.Millisecond)
+		}
+	})
+	timer.Reset(10 * time.Millisecond)
+	for i := 0; i < 100; i++ {
+		w.advance()
+	}
+	if count != 3 {
+		t.Fatalf("任务执行 %d 次, 应为 3", count)
+	}
+}
+
+// 时间轮运行时并发取消及重置, 全部取消后不再有任务执行
+func TestConcurrentStopReset(t *testing.T) {
+	w := New(time.Millisecond, 8, 3)
+	w.Start()
+	defer w.Stop()
+
+	var fired int64
+	timers := make([]*Timer, 64)
+	for i := range timers {
+		timers[i] = w.NewTimer(func() { atomic.AddInt64(&fired, 1) })
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				timer := timers[(g*7+i)%len(timers)]
+				if i%3 == 0 {
+					timer.Stop()
+				} else {
+					timer.Reset(time.Duration(i%20) * time.Millisecond)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for _, timer := range timers {
+		timer.Stop()
+	}
+	// 取消前已取出的任务可能仍在执行
+	time.Sleep(20 * time.Millisecond)
+	before := atomic.LoadInt64(&fired)
+	time.Sleep(50 * time.Millisecond)
+	if after := atomic.LoadInt64(&fired); after != before {
+		t.Fatalf("取消后仍有任务执行: %d -> %d", before, after)
+	}
+}
+
+// 驱动 goroutine 按实际流逝的时间执行任务
+func TestStart(t *testing.T) {
+	w := New(time.Millisecond, 16, 2)
+	w.Start()
+	defer w.Stop()
+
+	start := time.Now()
+	done := make(chan time.Duration, 1)
+	w.AfterFunc(30*time.Millisecond, func() { done <- time.Since(start) })
+	select {
+	case elapsed := <-done:
+		// 加入任务时未满一个 tick 的部分计入等待
+		if elapsed < 29*time.Millisecond {
+			t.Fatalf("任务提前执行: %v", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("任务未执行")
+	}
+}
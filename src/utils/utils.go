@@ -3,8 +3,25 @@
 package utils
 
 import (
+	"bytes"
 	"encoding/binary"
 	errors "errors"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	// remaining length 超过四个字节
+	ErrRemainLength = errors.New("remain length 超过了规定的四个字节")
+
+	// 字段长度超出报文
+	ErrShortBuffer = errors.New("字段长度超出报文")
+
+	// 字符串不是合法的 UTF-8
+	ErrInvalidUtf8 = errors.New("字符串不是合法的 UTF-8")
+
+	// 字符串包含 U+0000
+	ErrNullChar = errors.New("字符串包含 U+0000")
 )
 
 // 解码报文长度字节, 算法参考 MQTTV3.1.1 协议
@@ -39,8 +56,8 @@ func DecodeRemainLength(buf []byte) (int, int, error) {
 	}
 
 	// MQTT protocol limits Remaining Length to 4 bytes
-	if loops == 4 && encodedByte == 128 {
-		return 0, 0, errors.New("remain length 超过了规定的四个字节")
+	if loops == 4 && encodedByte&128 != 0 {
+		return 0, 0, ErrRemainLength
 	}
 
 	// 返回循环次数，表明 remain length 字段长度
@@ -74,31 +91,71 @@ func EncodeRemainLength(len int) []byte {
 
 // 解码 MQTT 中的字符串数据
 // 格式见: MQTTV3.1.1 -> 1.5.3 UTF-8 encoded strings
-func DecodeMqttString(buf []byte, fromIndex int) (string, int) {
-	// 先读取长度
-	u := int(binary.BigEndian.Uint16(buf[fromIndex:]))
+func DecodeMqttString(buf []byte, fromIndex int) (string, int, error) {
+	b, index, err := DecodeMqttBytes(buf, fromIndex)
+	if err != nil {
+		return "", 0, err
+	}
 
-	// 返回下一个未读字节的索引
-	return string(buf[fromIndex+2 : fromIndex+2+u]), fromIndex + 2 + u
+	if err := CheckMqttString(b); err != nil {
+		return "", 0, err
+	}
+	return string(b), index, nil
+}
+
+// 校验 MQTT 字符串内容
+func CheckMqttString(b []byte) error {
+	// The character data in a UTF-8 encoded string MUST be well-formed UTF-8 as defined by the Unicode
+	// specification and restated in RFC 3629 [MQTT-1.5.3-1].
+	// A UTF-8 encoded string MUST NOT include an encoding of the null character U+0000 [MQTT-1.5.3-2].
+	if !utf8.Valid(b) {
+		return ErrInvalidUtf8
+	}
+	if bytes.IndexByte(b, 0) >= 0 {
+		return ErrNullChar
+	}
+	return nil
 }
 
-// 解码可变字节数组
-func DecodeMqttBytes(buf []byte, fromIndex int) ([]byte, int) {
+// 解码可变字节数组, 引用 buf
+func DecodeMqttBytes(buf []byte, fromIndex int) ([]byte, int, error) {
 	// 先读取长度
+	if fromIndex < 0 || len(buf)-fromIndex < 2 {
+		return nil, 0, ErrShortBuffer
+	}
 	u := int(binary.BigEndian.Uint16(buf[fromIndex:]))
+	if len(buf)-fromIndex-2 < u {
+		return nil, 0, ErrShortBuffer
+	}
 
 	// 返回下一个未读字节的索引
-	return buf[fromIndex+2 : fromIndex+2+u], fromIndex + 2 + u
+	return buf[fromIndex+2 : fromIndex+2+u], fromIndex + 2 + u, nil
 }
 
 // 用于判定客户订阅的主题是否匹配发布主题
 //	pub: 发布主题
-// 	sub: 定于主题 - 主题过滤器
-// 不支持通配符
+// 	sub: 定于主题 - 主题过滤器, 支持 + 与 # 通配符
+// 以 $ 开头的主题不匹配以通配符开头的过滤器 [MQTT-4.7.2-1]
 func Match(pub string, sub string) bool {
 	if pub == sub {
 		return true
 	}
+	if strings.HasPrefix(pub, "$") && (strings.HasPrefix(sub, "+") || strings.HasPrefix(sub, "#")) {
+		return false
+	}
+
+	pubLevels, subLevels := strings.Split(pub, "/"), strings.Split(sub, "/")
+	for i, level := range subLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(pubLevels) {
+			return false
+		}
+		if level != "+" && level != pubLevels[i] {
+			return false
+		}
+	}
 
-	return false
+	return len(pubLevels) == len(subLevels)
 }